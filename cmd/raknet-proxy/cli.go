@@ -2,32 +2,85 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	_cli "github.com/urfave/cli/v2"
 
 	"github.com/percygrunwald/raknet-proxy/lib/cli"
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
 )
 
 var (
-	flagValueLogLevel       string
-	flagValueLogFormat      string
-	flagValueServerHostname string
-	flagValueServerPort     int
-	flagValueListenPort     int
-	flagValueProxyHostname  string
+	flagValueAdminListen      string
+	flagValueCaptureDir       string
+	flagValueConfig           string
+	flagValueHandshakeCookies bool
+	flagValueLogLevel         string
+	flagValueLogFormat        string
+	flagValueServerHostname   string
+	flagValueServerPort       int
+	flagValueListenPort       int
+	flagValueMetricsListen    string
+	flagValueProxyHostname    string
+	flagValueProxyProtocol    string
+	flagValueRecordDir        string
+	flagValueValidationPolicy string
+	flagValueIdleTimeout      time.Duration
+	flagValueShutdownTimeout  time.Duration
+	flagValueResolveInterval  time.Duration
 )
 
 var cliFlags = []_cli.Flag{
+	&_cli.StringFlag{
+		Name:        "admin-listen",
+		Usage:       "Address (host:port) on which to serve the admin HTTP API. Disabled if empty",
+		Destination: &flagValueAdminListen,
+	},
+	&_cli.StringFlag{
+		Name:        "capture-dir",
+		Usage:       "Directory to write packet captures started from the admin API to. Captures are disabled if empty",
+		Destination: &flagValueCaptureDir,
+	},
+	&_cli.StringFlag{
+		Name:        "config",
+		Usage:       "Path to a YAML config file. Flags that are set override its settings",
+		Destination: &flagValueConfig,
+	},
+	&_cli.BoolFlag{
+		Name:        "handshake-cookies",
+		Usage:       "Answer OpenConnectionRequest1 with a cookie, and only open upstream sockets for clients that return it",
+		Destination: &flagValueHandshakeCookies,
+	},
 	&_cli.StringFlag{
 		Name:        "proxy-hostname",
-		Usage:       "The public IP of the proxy for replacement in packets",
-		Required:    true,
+		Usage:       "The public IP of the proxy for replacement in packets (required unless set in --config)",
 		Destination: &flagValueProxyHostname,
 	},
+	&_cli.StringFlag{
+		Name:        "proxy-protocol",
+		Usage:       fmt.Sprintf("Prepend a PROXY protocol v2 header with the client's address to the first or every datagram sent upstream. Valid options: %v", proxy.ProxyProtocols),
+		Destination: &flagValueProxyProtocol,
+	},
+	&_cli.StringFlag{
+		Name:        "record-dir",
+		Usage:       "Directory to record every new session to, for raknet-replay. Sessions are not recorded if empty",
+		Destination: &flagValueRecordDir,
+	},
+	&_cli.StringFlag{
+		Name:        "validation-policy",
+		Usage:       fmt.Sprintf("What to do with payloads from clients that are not valid RakNet. Valid options: %v (default: %v)", proxy.ValidationPolicies, proxy.DefaultValidationPolicy),
+		Destination: &flagValueValidationPolicy,
+	},
+	&_cli.DurationFlag{
+		Name:        "idle-timeout",
+		Usage:       "Close proxy connections with no traffic for this long (0 to disable)",
+		Value:       30 * time.Second,
+		Action:      cli.ValidateDuration,
+		Destination: &flagValueIdleTimeout,
+	},
 	&_cli.IntFlag{
 		Name:        "listen-port",
-		Usage:       "Port on which to listen for RakNet packets from clients",
-		Required:    true,
+		Usage:       "Port on which to listen for RakNet packets from clients (required unless set in --config)",
 		Action:      cli.ValidatePort,
 		Destination: &flagValueListenPort,
 	},
@@ -45,16 +98,33 @@ var cliFlags = []_cli.Flag{
 		Action:      cli.ValidateLogLevel,
 		Destination: &flagValueLogLevel,
 	},
+	&_cli.StringFlag{
+		Name:        "metrics-listen",
+		Usage:       "Address (host:port) on which to serve Prometheus metrics at /metrics. Disabled if empty",
+		Destination: &flagValueMetricsListen,
+	},
+	&_cli.DurationFlag{
+		Name:        "shutdown-timeout",
+		Usage:       "On SIGINT/SIGTERM, how long to wait for in-flight payloads to be proxied",
+		Value:       proxy.DefaultShutdownTimeout,
+		Action:      cli.ValidateDuration,
+		Destination: &flagValueShutdownTimeout,
+	},
+	&_cli.DurationFlag{
+		Name:        "resolve-interval",
+		Usage:       "How often to resolve upstream hostnames again, for new connections to follow DNS changes (0 to disable)",
+		Value:       time.Minute,
+		Action:      cli.ValidateDuration,
+		Destination: &flagValueResolveInterval,
+	},
 	&_cli.StringFlag{
 		Name:        "server-hostname",
-		Usage:       "Hostname/IP of upstream server",
-		Required:    true,
+		Usage:       "Hostname/IP of upstream server (required unless set in --config)",
 		Destination: &flagValueServerHostname,
 	},
 	&_cli.IntFlag{
 		Name:        "server-port",
-		Usage:       "Upstream server RakNet port",
-		Required:    true,
+		Usage:       "Upstream server RakNet port (required unless set in --config)",
 		Action:      cli.ValidatePort,
 		Destination: &flagValueServerPort,
 	},
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	_cli "github.com/urfave/cli/v2"
+
+	"github.com/percygrunwald/raknet-proxy/lib/config"
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// loadConfig reads the --config file, if any, and applies the flags on top
+// of it. Flags that were set on the command line take precedence over the
+// file, and flag defaults fill in settings that neither provides. The
+// listener flags apply to the first listener.
+func loadConfig(cCtx *_cli.Context) (*config.Config, error) {
+	cfg := &config.Config{}
+	if flagValueConfig != "" {
+		var err error
+		if cfg, err = config.Load(flagValueConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	applyFlag(cCtx, "log-level", &cfg.Log.Level, flagValueLogLevel)
+	applyFlag(cCtx, "log-format", &cfg.Log.Format, flagValueLogFormat)
+	applyFlag(cCtx, "proxy-hostname", &cfg.ProxyHostname, flagValueProxyHostname)
+	applyDurationFlag(cCtx, "idle-timeout", &cfg.Timeouts.Idle, flagValueIdleTimeout)
+	applyDurationFlag(cCtx, "shutdown-timeout", &cfg.Timeouts.Shutdown, flagValueShutdownTimeout)
+	applyDurationFlag(cCtx, "resolve-interval", &cfg.DNS.ResolveInterval, flagValueResolveInterval)
+	applyFlag(cCtx, "admin-listen", &cfg.Admin.Listen, flagValueAdminListen)
+	applyFlag(cCtx, "metrics-listen", &cfg.Metrics.Listen, flagValueMetricsListen)
+	applyFlag(cCtx, "capture-dir", &cfg.Capture.Dir, flagValueCaptureDir)
+	applyFlag(cCtx, "record-dir", &cfg.Record.Dir, flagValueRecordDir)
+	applyFlag(cCtx, "validation-policy", &cfg.Validation.Policy, flagValueValidationPolicy)
+
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{})
+	}
+	listener := &cfg.Listeners[0]
+	applyFlag(cCtx, "listen-port", &listener.Port, flagValueListenPort)
+	if cCtx.IsSet("server-hostname") || cCtx.IsSet("server-port") {
+		// The upstream flags replace a pool in the file with a single upstream
+		listener.Upstreams = nil
+	}
+	applyFlag(cCtx, "server-hostname", &listener.Upstream.Hostname, flagValueServerHostname)
+	applyFlag(cCtx, "server-port", &listener.Upstream.Port, flagValueServerPort)
+	applyFlag(cCtx, "handshake-cookies", &listener.HandshakeCookies, flagValueHandshakeCookies)
+	applyFlag(cCtx, "proxy-protocol", &listener.ProxyProtocol, flagValueProxyProtocol)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyFlag sets a setting to the flag's value if the flag was set, or if the
+// setting was left empty in the config file.
+func applyFlag[T comparable](cCtx *_cli.Context, name string, setting *T, value T) {
+	var zero T
+	if cCtx.IsSet(name) || *setting == zero {
+		*setting = value
+	}
+}
+
+func applyDurationFlag(cCtx *_cli.Context, name string, setting **time.Duration, value time.Duration) {
+	if cCtx.IsSet(name) || *setting == nil {
+		*setting = &value
+	}
+}
+
+func newProxy(cfg *config.Config) (*proxy.Proxy, error) {
+	acl, err := cfg.ACL.ACL()
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := cfg.Limits.RateLimits()
+	if err != nil {
+		return nil, err
+	}
+	validation, err := proxy.ParseValidationPolicy(cfg.Validation.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]proxy.Route, 0, len(cfg.Listeners))
+	for _, listener := range cfg.Listeners {
+		route, err := newRoute(cfg, listener)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	return &proxy.Proxy{
+		Routes:          routes,
+		ProxyHostname:   cfg.ProxyHostname,
+		IdleTimeout:     cfg.IdleTimeout(0),
+		ShutdownTimeout: cfg.ShutdownTimeout(proxy.DefaultShutdownTimeout),
+		ResolveInterval: cfg.ResolveInterval(0),
+		MaxSplitCount:   cfg.Limits.MaxSplitCount,
+		MaxSplitPending: cfg.Limits.MaxSplitPending,
+		MaxSplitBytes:   cfg.Limits.MaxSplitBytes,
+		RateLimits:      rateLimits,
+		Validation:      validation,
+		ACL:             acl,
+		CaptureDir:      cfg.Capture.Dir,
+		RecordDir:       cfg.Record.Dir,
+		HealthCheck: proxy.HealthCheck{
+			Interval: cfg.HealthCheck.Interval,
+			Timeout:  cfg.HealthCheck.Timeout,
+			Rise:     cfg.HealthCheck.Rise,
+			Fall:     cfg.HealthCheck.Fall,
+		},
+		// Rewriting is decided per route, as listeners may turn it back on
+	}, nil
+}
+
+func newRoute(cfg *config.Config, listener config.ListenerConfig) (proxy.Route, error) {
+	route := proxy.Route{
+		ListenPort:              listener.Port,
+		ServerHostname:          listener.Upstream.Hostname,
+		ServerPort:              listener.Upstream.Port,
+		Balance:                 proxy.BalancePolicy(listener.Balance),
+		ProxyHostname:           listener.ProxyHostname,
+		DisableAddressRewriting: !listener.RewriteAddresses(cfg.RewriteAddresses()),
+		HandshakeCookies:        listener.HandshakeCookies,
+		ProxyProtocol:           proxy.ProxyProtocol(listener.ProxyProtocol),
+		PongCache: proxy.PongCache{
+			RefreshInterval: listener.PongCache.RefreshInterval,
+			Rewrite: proxy.PongRewrite{
+				Data:       listener.PongCache.Data,
+				ServerName: listener.PongCache.ServerName,
+				IPv4Port:   listener.PongCache.IPv4Port,
+				IPv6Port:   listener.PongCache.IPv6Port,
+				ServerGUID: listener.PongCache.ServerGUID,
+			},
+		},
+	}
+	for _, u := range listener.Upstreams {
+		route.Upstreams = append(route.Upstreams, proxy.Upstream{Hostname: u.Hostname, Port: u.Port, Weight: u.Weight})
+	}
+	if listener.ACL != nil {
+		acl, err := listener.ACL.ACL()
+		if err != nil {
+			return proxy.Route{}, err
+		}
+		route.ACL = &acl
+	}
+	return route, nil
+}
+
+// validateConfig checks a config file on its own, without applying flags,
+// printing every invalid setting with its line number.
+func validateConfig(cCtx *_cli.Context) error {
+	path := cCtx.Args().First()
+	if path == "" {
+		path = flagValueConfig
+	}
+	if path == "" {
+		return fmt.Errorf("usage: %s validate-config <file>", cCtx.App.Name)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		return _cli.Exit(err, 1)
+	}
+
+	var errs config.ValidationErrors
+	if err := cfg.Validate(); errors.As(err, &errs) {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return _cli.Exit(fmt.Sprintf("%s: %d invalid settings", path, len(errs)), 1)
+	}
+
+	fmt.Printf("%s: OK\n", path)
+	return nil
+}
@@ -2,22 +2,30 @@ package main
 
 import (
 	"os"
-
-	_ "net/http/pprof"
+	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	_cli "github.com/urfave/cli/v2"
 
-	"github.com/percygrunwald/raknet-proxy/lib/cli"
-	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+	"github.com/percygrunwald/raknet-proxy/lib/admin"
+	"github.com/percygrunwald/raknet-proxy/lib/metrics"
 )
 
 func main() {
 	app := &_cli.App{
-		Name:    "raknet-proxy",
-		Usage:   "RakNet proxy",
-		Flags:   cliFlags,
-		Action:  runApp,
+		Name:   "raknet-proxy",
+		Usage:  "RakNet proxy",
+		Flags:  cliFlags,
+		Action: runApp,
+		Commands: []*_cli.Command{
+			{
+				Name:      "validate-config",
+				Usage:     "Check a config file, reporting invalid settings with their line numbers",
+				ArgsUsage: "<file>",
+				Action:    validateConfig,
+			},
+		},
 		Version: "v0.0.1",
 	}
 
@@ -27,18 +35,41 @@ func main() {
 }
 
 func runApp(cCtx *_cli.Context) error {
-	logLevel := cli.GetLogLevel(flagValueLogLevel)
-	logFormat := cli.GetLogFormat(flagValueLogFormat)
-	log.SetFormatter(logFormat.Formatter)
-	log.SetOutput(os.Stdout)
-	log.SetLevel(logLevel.Level)
-
-	proxy := &proxy.Proxy{
-		ServerHostname: flagValueServerHostname,
-		ServerPort:     flagValueServerPort,
-		ListenPort:     flagValueListenPort,
-		ProxyHostname:  flagValueProxyHostname,
+	cfg, err := loadConfig(cCtx)
+	if err != nil {
+		return err
+	}
+
+	setLogging(cfg)
+
+	proxy, err := newProxy(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(cCtx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reloader := &reloader{cCtx: cCtx, proxy: proxy, cfg: cfg}
+	go reloader.reloadOnSignal(ctx)
+
+	if cfg.Admin.Listen != "" {
+		adminServer := &admin.Server{Addr: cfg.Admin.Listen, Proxy: proxy, Reload: reloader.reload}
+		go func() {
+			if err := adminServer.Run(ctx); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	if cfg.Metrics.Listen != "" {
+		proxy.Metrics = metrics.NewRegistry()
+		go func() {
+			if err := proxy.Metrics.ListenAndServe(ctx, cfg.Metrics.Listen); err != nil {
+				log.Error(err)
+			}
+		}()
 	}
 
-	return proxy.Run()
+	return proxy.Run(ctx)
 }
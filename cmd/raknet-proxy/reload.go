@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	_cli "github.com/urfave/cli/v2"
+
+	"github.com/percygrunwald/raknet-proxy/lib/cli"
+	"github.com/percygrunwald/raknet-proxy/lib/config"
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// restartRequired matches the settings that are only read at startup, so
+// changing them has no effect until the proxy is restarted
+var restartRequired = regexp.MustCompile(`^(listeners|listeners\[\d+\]\.(port|pong_cache\.refresh_interval)|timeouts\..*|health_check\..*|dns\..*|admin\..*|metrics\..*|capture\..*)$`)
+
+// reloader re-reads the configuration and applies it to the running proxy.
+// Proxy connections that already exist are left as they are.
+type reloader struct {
+	cCtx  *_cli.Context
+	proxy *proxy.Proxy
+
+	mu  sync.Mutex
+	cfg *config.Config
+}
+
+// reload applies the current config file and flags, returning the settings
+// that changed. An invalid config, or one changing settings that need a
+// restart, is rejected, leaving the proxy unchanged.
+func (r *reloader) reload() ([]string, error) {
+	cfg, err := loadConfig(r.cCtx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reload config, keeping the current one: %w", err)
+	}
+	return r.apply(cfg)
+}
+
+func (r *reloader) apply(cfg *config.Config) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changes := []string{}
+	restarts := []string{}
+	for _, change := range config.Diff(r.cfg, cfg) {
+		if restartRequired.MatchString(change.Field) {
+			restarts = append(restarts, change.String())
+			continue
+		}
+		changes = append(changes, change.String())
+	}
+	if len(restarts) > 0 {
+		return nil, fmt.Errorf("unable to reload config, keeping the current one: changing %v requires a restart", restarts)
+	}
+
+	next, err := newProxy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reload config, keeping the current one: %w", err)
+	}
+	if err := r.proxy.Reconfigure(next); err != nil {
+		return nil, fmt.Errorf("unable to reload config, keeping the current one: %w", err)
+	}
+	setLogging(cfg)
+	r.cfg = cfg
+
+	log.Infof("config reloaded, %d settings changed: %v", len(changes), changes)
+	return changes, nil
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP until ctx is
+// cancelled.
+func (r *reloader) reloadOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			log.Infof("received SIGHUP, reloading config")
+			if _, err := r.reload(); err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func setLogging(cfg *config.Config) {
+	logLevel := cli.GetLogLevel(cfg.Log.Level)
+	logFormat := cli.GetLogFormat(cfg.Log.Format)
+	log.SetFormatter(logFormat.Formatter)
+	log.SetOutput(os.Stdout)
+	log.SetLevel(logLevel.Level)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/config"
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// freePort returns a UDP port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func testConfig(t *testing.T, port int, extra string) *config.Config {
+	t.Helper()
+	cfg, err := config.Parse([]byte(fmt.Sprintf(`proxy_hostname: 127.0.0.1
+listeners:
+  - port: %d
+    upstream:
+      hostname: 127.0.0.1
+      port: 19133
+%s`, port, extra)))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	return cfg
+}
+
+// startReloader runs a proxy for cfg until the test ends
+func startReloader(t *testing.T, cfg *config.Config) *reloader {
+	t.Helper()
+	p, err := newProxy(cfg)
+	if err != nil {
+		t.Fatalf("newProxy: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for len(p.ACLs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return &reloader{proxy: p, cfg: cfg}
+}
+
+func allowed(p *proxy.Proxy) []netip.Prefix {
+	return p.ACLs()[0].ACL.Allow
+}
+
+func TestReloadAppliesACLAndLimits(t *testing.T) {
+	port := freePort(t)
+	r := startReloader(t, testConfig(t, port, ""))
+
+	changes, err := r.apply(testConfig(t, port, `acl:
+  allow: [10.0.0.0/8]
+limits:
+  max_sessions: 10
+`))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("changes = %v, want the ACL and the session limit", changes)
+	}
+	if got := allowed(r.proxy); len(got) != 1 || got[0] != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("ACL after reload allows %v, want 10.0.0.0/8", got)
+	}
+	if r.cfg.Limits.MaxSessions != 10 {
+		t.Errorf("reloader kept the previous config")
+	}
+}
+
+func TestReloadRejectsRestartOnlyChanges(t *testing.T) {
+	port := freePort(t)
+	current := testConfig(t, port, "")
+	r := startReloader(t, current)
+
+	tests := []struct {
+		name string
+		cfg  *config.Config
+	}{
+		{"listen port", testConfig(t, freePort(t), "acl:\n  allow: [10.0.0.0/8]\n")},
+		{"timeout", testConfig(t, port, "acl:\n  allow: [10.0.0.0/8]\ntimeouts:\n  idle: 1m\n")},
+		{"health check", testConfig(t, port, "health_check:\n  interval: 5s\n")},
+		{"metrics address", testConfig(t, port, "metrics:\n  listen: 127.0.0.1:9101\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if changes, err := r.apply(tt.cfg); err == nil {
+				t.Errorf("apply = %v, want an error", changes)
+			}
+			if r.cfg != current {
+				t.Errorf("reloader replaced the current config")
+			}
+			if got := allowed(r.proxy); len(got) != 0 {
+				t.Errorf("ACL changed by a rejected reload: %v", got)
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := map[string]bool{
+		"listeners":         true,
+		"listeners[0].port": true,
+		"listeners[1].pong_cache.refresh_interval": true,
+		"timeouts.idle":                       true,
+		"health_check.interval":               true,
+		"dns.resolve_interval":                true,
+		"admin.listen":                        true,
+		"metrics.listen":                      true,
+		"capture.dir":                         true,
+		"listeners[0].upstream.port":          false,
+		"listeners[0].pong_cache.server_name": false,
+		"listeners[0].acl.allow":              false,
+		"acl.allow":                           false,
+		"limits.max_sessions":                 false,
+		"log.level":                           false,
+		"record.dir":                          false,
+	}
+	for field, want := range tests {
+		if got := restartRequired.MatchString(field); got != want {
+			t.Errorf("restartRequired(%q) = %v, want %v", field, got, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	_cli "github.com/urfave/cli/v2"
+
+	"github.com/percygrunwald/raknet-proxy/lib/cli"
+)
+
+var (
+	flagValueLogLevel       string
+	flagValueLogFormat      string
+	flagValueRecording      string
+	flagValueServerHostname string
+	flagValueServerPort     int
+	flagValueSpeed          float64
+	flagValueWait           time.Duration
+	flagValueMaxDivergences int
+)
+
+var cliFlags = []_cli.Flag{
+	&_cli.StringFlag{
+		Name:        "log-format",
+		Usage:       fmt.Sprintf("Format in which to output logs. Valid options: %v", cli.LogFormats),
+		Value:       cli.DefaultLogFormat.Text,
+		Action:      cli.ValidateLogFormat,
+		Destination: &flagValueLogFormat,
+	},
+	&_cli.StringFlag{
+		Name:        "log-level",
+		Usage:       fmt.Sprintf("Set the log level. Valid options: %v", cli.LogLevels),
+		Value:       cli.DefaultLogLevel.Text,
+		Action:      cli.ValidateLogLevel,
+		Destination: &flagValueLogLevel,
+	},
+	&_cli.IntFlag{
+		Name:        "max-divergences",
+		Usage:       "Number of divergences from the recording to describe (0 for all)",
+		Value:       20,
+		Destination: &flagValueMaxDivergences,
+	},
+	&_cli.StringFlag{
+		Name:        "recording",
+		Usage:       "Path to a session recording made with raknet-proxy --record-dir",
+		Required:    true,
+		Destination: &flagValueRecording,
+	},
+	&_cli.StringFlag{
+		Name:        "server-hostname",
+		Usage:       "Hostname/IP of the proxy or server to replay the client's payloads to",
+		Required:    true,
+		Destination: &flagValueServerHostname,
+	},
+	&_cli.IntFlag{
+		Name:        "server-port",
+		Usage:       "RakNet port of the proxy or server",
+		Required:    true,
+		Action:      cli.ValidatePort,
+		Destination: &flagValueServerPort,
+	},
+	&_cli.Float64Flag{
+		Name:        "speed",
+		Usage:       "Replay speed relative to the recording, e.g. 2 for twice as fast. 0 sends every payload without delay",
+		Value:       1,
+		Action:      validateSpeed,
+		Destination: &flagValueSpeed,
+	},
+	&_cli.DurationFlag{
+		Name:        "wait",
+		Usage:       "How long to wait for responses after the last payload is sent",
+		Value:       2 * time.Second,
+		Action:      cli.ValidateDuration,
+		Destination: &flagValueWait,
+	},
+}
+
+func validateSpeed(ctx *_cli.Context, v float64) error {
+	if v < 0 {
+		return fmt.Errorf(`Invalid speed value: %v. Speed must not be negative`, v)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	_cli "github.com/urfave/cli/v2"
+
+	"github.com/percygrunwald/raknet-proxy/lib/cli"
+	"github.com/percygrunwald/raknet-proxy/lib/recording"
+)
+
+func main() {
+	app := &_cli.App{
+		Name:    "raknet-replay",
+		Usage:   "Replay the client side of a recorded proxy session, comparing the responses to the recording",
+		Flags:   cliFlags,
+		Action:  runApp,
+		Version: "v0.0.1",
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runApp(cCtx *_cli.Context) error {
+	logLevel := cli.GetLogLevel(flagValueLogLevel)
+	logFormat := cli.GetLogFormat(flagValueLogFormat)
+	log.SetFormatter(logFormat.Formatter)
+	log.SetOutput(os.Stdout)
+	log.SetLevel(logLevel.Level)
+
+	header, entries, err := recording.ReadFile(flagValueRecording)
+	if err != nil {
+		return err
+	}
+	sent, expected := splitEntries(entries)
+	log.Infof("replaying %d payloads from client %v (session of %v via port %d, started %v)",
+		len(sent), header.Client, header.Upstream, header.ListenPort, header.Started)
+
+	serverAddr := net.JoinHostPort(flagValueServerHostname, strconv.Itoa(flagValueServerPort))
+	received, err := replay(serverAddr, sent, flagValueSpeed, flagValueWait)
+	if err != nil {
+		return err
+	}
+
+	divergences := compare(expected, received)
+	printReport(os.Stdout, len(expected), received, divergences, flagValueMaxDivergences)
+	if len(divergences) > 0 {
+		return _cli.Exit(fmt.Sprintf("%d divergences from the recording", len(divergences)), 1)
+	}
+	return nil
+}
+
+// splitEntries separates the payloads the client sent from the responses
+// the server gave
+func splitEntries(entries []recording.Entry) ([]recording.Entry, []recording.Entry) {
+	sent, expected := []recording.Entry{}, []recording.Entry{}
+	for _, entry := range entries {
+		if entry.From == recording.FromClient {
+			sent = append(sent, entry)
+		} else {
+			expected = append(expected, entry)
+		}
+	}
+	return sent, expected
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/netip"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+	"github.com/percygrunwald/raknet-proxy/lib/recording"
+)
+
+// maskedAddr replaces the client addresses in responses, which differ between
+// the recorded session and the replay
+var maskedAddr = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+
+// maskEntries returns copies of entries with their volatile fields masked
+func maskEntries(entries []recording.Entry) []recording.Entry {
+	masked := make([]recording.Entry, len(entries))
+	for i, e := range entries {
+		masked[i] = e
+		masked[i].Payload = mask(e.Payload)
+	}
+	return masked
+}
+
+// mask zeroes the fields of a response that differ from one session to the
+// next even when the server behaves the same: server GUIDs and handshake
+// cookies, the client address the server sees, and the timestamps of
+// ConnectionRequestAccepted and connected pings and pongs. Payloads that do
+// not decode are returned as they are.
+func mask(payload []byte) []byte {
+	if raknet.IsDatagram(payload) {
+		return maskDatagram(payload)
+	}
+	m, err := raknet.DecodeOfflineMessage(payload)
+	if err != nil {
+		return payload
+	}
+
+	switch m := m.(type) {
+	case *raknet.UnconnectedPong:
+		m.ServerGUID = 0
+	case *raknet.OpenConnectionReply1:
+		m.ServerGUID, m.Cookie = 0, 0
+	case *raknet.OpenConnectionReply2:
+		m.ServerGUID, m.ClientAddress = 0, maskedAddr
+	default:
+		return payload
+	}
+	return m.Append(nil)
+}
+
+func maskDatagram(payload []byte) []byte {
+	d, err := raknet.DecodeDatagram(payload)
+	if err != nil {
+		return payload
+	}
+	for _, f := range d.Frames {
+		maskFrame(f)
+	}
+	return d.Append(nil)
+}
+
+func maskFrame(f *raknet.Frame) {
+	id, ok := f.MessageID()
+	if !ok || f.Split {
+		return
+	}
+
+	switch id {
+	case raknet.IDConnectedPing, raknet.IDConnectedPong:
+		// Ping time, and pong time for pongs
+		f.Body = maskFrom(f.Body, 1)
+	case raknet.IDConnectionRequestAccepted:
+		m, err := raknet.DecodeConnectedMessage(f.Body)
+		if err != nil {
+			return
+		}
+		accepted := m.(*raknet.ConnectionRequestAccepted)
+		accepted.ClientAddress = maskedAddr
+		accepted.RequestTimestamp, accepted.AcceptedTimestamp = 0, 0
+		f.Body = accepted.Append(nil)
+	}
+}
+
+// maskFrom returns a copy of b zeroed from offset
+func maskFrom(b []byte, offset int) []byte {
+	b = append([]byte(nil), b...)
+	if offset < len(b) {
+		clear(b[offset:])
+	}
+	return b
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+	"github.com/percygrunwald/raknet-proxy/lib/recording"
+)
+
+func TestCompareMasksVolatileFields(t *testing.T) {
+	reply2 := func(guid uint64, client string, mtu uint16) []byte {
+		return (&raknet.OpenConnectionReply2{ServerGUID: guid, ClientAddress: netip.MustParseAddrPort(client), MTU: mtu}).Append(nil)
+	}
+	accepted := func(client string, timestamp uint64) []byte {
+		m := &raknet.ConnectionRequestAccepted{
+			ClientAddress:     netip.MustParseAddrPort(client),
+			SystemAddresses:   []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:19132")},
+			RequestTimestamp:  timestamp,
+			AcceptedTimestamp: timestamp,
+		}
+		d := &raknet.Datagram{SequenceNumber: 1, Frames: []*raknet.Frame{{Reliability: raknet.ReliableOrdered, Body: m.Append(nil)}}}
+		return d.Append(nil)
+	}
+	pong := func(pongTime byte) []byte {
+		body := []byte{raknet.IDConnectedPong, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, pongTime}
+		return (&raknet.Datagram{SequenceNumber: 2, Frames: []*raknet.Frame{{Reliability: raknet.Unreliable, Body: body}}}).Append(nil)
+	}
+	entries := func(payloads ...[]byte) []recording.Entry {
+		entries := []recording.Entry{}
+		for _, p := range payloads {
+			entries = append(entries, recording.Entry{From: recording.FromServer, Payload: p})
+		}
+		return entries
+	}
+
+	expected := entries(reply2(1, "198.51.100.7:51234", 1400), accepted("198.51.100.7:51234", 100), pong(1))
+	received := entries(reply2(2, "[2001:db8::7]:40000", 1400), accepted("[2001:db8::7]:40000", 200), pong(2))
+	if divergences := compare(expected, received); len(divergences) != 0 {
+		t.Errorf("compare reported %d divergences for responses differing only in volatile fields: %v", len(divergences), divergences)
+	}
+
+	received = entries(reply2(1, "198.51.100.7:51234", 1200), accepted("198.51.100.7:51234", 100), pong(1))
+	if divergences := compare(expected, received); len(divergences) != 1 {
+		t.Errorf("compare reported %d divergences for a different MTU, want 1: %v", len(divergences), divergences)
+	}
+}
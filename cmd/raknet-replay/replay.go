@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/recording"
+)
+
+// matchWindow is how far ahead in the recording a response is looked for,
+// allowing for responses that are reordered or lost
+const matchWindow = 32
+
+// replay sends the client's payloads to addr from a fresh socket, with their
+// recorded timing scaled by speed, and collects the responses until wait
+// after the last payload.
+func replay(addr string, sent []recording.Entry, speed float64, wait time.Duration) ([]recording.Entry, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %v: %w", addr, err)
+	}
+	conn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial %v: %w", addr, err)
+	}
+	defer conn.Close()
+	log.Debugf("replaying %v->%v", conn.LocalAddr(), conn.RemoteAddr())
+
+	start := time.Now()
+	received := []recording.Entry{}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		received = receive(conn, start)
+	}()
+
+	for i, entry := range sent {
+		if speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(entry.Offset) / speed))))
+		}
+		if _, err := conn.Write(entry.Payload); err != nil {
+			return nil, fmt.Errorf("unable to send payload %d: %w", i+1, err)
+		}
+		log.Tracef("sent payload %d: %x", i+1, entry.Payload)
+	}
+
+	time.Sleep(wait)
+	conn.Close()
+	wg.Wait()
+	return received, nil
+}
+
+// receive reads responses until conn is closed
+func receive(conn *net.UDPConn, start time.Time) []recording.Entry {
+	received := []recording.Entry{}
+	b := make([]byte, 65535)
+	for {
+		n, err := conn.Read(b)
+		if errors.Is(err, net.ErrClosed) {
+			return received
+		}
+		if err != nil {
+			log.Debugf("unable to read response: %v", err)
+			continue
+		}
+		payload := append([]byte(nil), b[:n]...)
+		received = append(received, recording.Entry{Offset: time.Since(start), From: recording.FromServer, Payload: payload})
+		log.Tracef("received response %d: %x", len(received), payload)
+	}
+}
+
+// divergence is a difference between the recorded responses and those
+// received. Either entry is nil if it has no counterpart.
+type divergence struct {
+	expectedIndex int
+	expected      *recording.Entry
+	receivedIndex int
+	received      *recording.Entry
+}
+
+// compare aligns the received responses with the recorded ones and returns
+// where they differ. Each response is matched with an identical recorded one
+// within the next matchWindow; recorded responses skipped over are reported
+// missing. A response with no identical match is paired with the next
+// recorded one if they have the same ID, and is unexpected otherwise.
+// Responses are compared, and reported, with their volatile fields masked.
+func compare(expected, received []recording.Entry) []divergence {
+	expected, received = maskEntries(expected), maskEntries(received)
+	divergences := []divergence{}
+	next := 0
+	for i := range received {
+		if k := findMatch(expected, next, received[i].Payload); k >= 0 {
+			for ; next < k; next++ {
+				divergences = append(divergences, divergence{expectedIndex: next, expected: &expected[next], receivedIndex: -1})
+			}
+			next++
+			continue
+		}
+
+		d := divergence{expectedIndex: -1, receivedIndex: i, received: &received[i]}
+		if next < len(expected) && firstByte(expected[next].Payload) == firstByte(received[i].Payload) {
+			d.expectedIndex, d.expected = next, &expected[next]
+			next++
+		}
+		divergences = append(divergences, d)
+	}
+	for ; next < len(expected); next++ {
+		divergences = append(divergences, divergence{expectedIndex: next, expected: &expected[next], receivedIndex: -1})
+	}
+	return divergences
+}
+
+func findMatch(expected []recording.Entry, from int, payload []byte) int {
+	for k := from; k < len(expected) && k < from+matchWindow; k++ {
+		if string(expected[k].Payload) == string(payload) {
+			return k
+		}
+	}
+	return -1
+}
+
+func firstByte(b []byte) int {
+	if len(b) == 0 {
+		return -1
+	}
+	return int(b[0])
+}
+
+func (d divergence) String() string {
+	switch {
+	case d.received == nil:
+		return fmt.Sprintf("missing: recorded response %d (%s) was not received", d.expectedIndex+1, describe(*d.expected))
+	case d.expected == nil:
+		return fmt.Sprintf("unexpected: response %d (%s) is not in the recording", d.receivedIndex+1, describe(*d.received))
+	}
+
+	offset := firstDifference(d.expected.Payload, d.received.Payload)
+	return fmt.Sprintf("different: response %d (%s) differs from recorded response %d (%s) from byte %d\n  recorded: %x\n  received: %x",
+		d.receivedIndex+1, describe(*d.received), d.expectedIndex+1, describe(*d.expected), offset,
+		excerpt(d.expected.Payload, offset), excerpt(d.received.Payload, offset))
+}
+
+func describe(e recording.Entry) string {
+	return fmt.Sprintf("ID 0x%02x, %d bytes at %v", firstByte(e.Payload)&0xff, len(e.Payload), e.Offset.Round(time.Millisecond))
+}
+
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+// excerpt returns up to 16 bytes of b from offset
+func excerpt(b []byte, offset int) []byte {
+	if offset >= len(b) {
+		return nil
+	}
+	return b[offset:min(len(b), offset+16)]
+}
+
+func printReport(w io.Writer, expected int, received []recording.Entry, divergences []divergence, max int) {
+	for i, d := range divergences {
+		if max > 0 && i == max {
+			fmt.Fprintf(w, "... and %d more\n", len(divergences)-max)
+			break
+		}
+		fmt.Fprintln(w, d)
+	}
+
+	counts := map[string]int{}
+	for _, d := range divergences {
+		switch {
+		case d.received == nil:
+			counts["missing"]++
+		case d.expected == nil:
+			counts["unexpected"]++
+		default:
+			counts["different"]++
+		}
+	}
+	fmt.Fprintf(w, "%d responses recorded, %d received: %d missing, %d unexpected, %d different\n",
+		expected, len(received), counts["missing"], counts["unexpected"], counts["different"])
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 
 	_ "net/http/pprof"
 
@@ -34,7 +36,7 @@ func runApp(cCtx *_cli.Context) error {
 	log.SetOutput(os.Stdout)
 	log.SetLevel(logLevel.Level)
 
-	serverAddr := fmt.Sprintf("%s:%d", flagValueServerHostname, flagValueServerPort)
+	serverAddr := net.JoinHostPort(flagValueServerHostname, strconv.Itoa(flagValueServerPort))
 	log.Debugf("dialing %v", serverAddr)
 	conn, err := raknet.Dial(serverAddr)
 	if err != nil {
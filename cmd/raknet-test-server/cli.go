@@ -12,6 +12,8 @@ var (
 	flagValueLogLevel   string
 	flagValueLogFormat  string
 	flagValueListenPort int
+	flagValuePongData   string
+	flagValueProxyProto bool
 )
 
 var cliFlags = []_cli.Flag{
@@ -29,6 +31,16 @@ var cliFlags = []_cli.Flag{
 		Action:      cli.ValidateLogFormat,
 		Destination: &flagValueLogFormat,
 	},
+	&_cli.StringFlag{
+		Name:        "pong-data",
+		Usage:       "Advertisement to send in answer to unconnected pings",
+		Destination: &flagValuePongData,
+	},
+	&_cli.BoolFlag{
+		Name:        "proxy-protocol",
+		Usage:       "Strip PROXY protocol v2 headers from datagrams, logging the client addresses they carry",
+		Destination: &flagValueProxyProto,
+	},
 	&_cli.StringFlag{
 		Name:        "log-level",
 		Usage:       fmt.Sprintf("Set the log level. Valid options: %v", cli.LogLevels),
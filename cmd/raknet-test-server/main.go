@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 
 	_ "net/http/pprof"
@@ -11,6 +12,7 @@ import (
 	_cli "github.com/urfave/cli/v2"
 
 	"github.com/percygrunwald/raknet-proxy/lib/cli"
+	"github.com/percygrunwald/raknet-proxy/lib/proxyproto"
 )
 
 func main() {
@@ -36,11 +38,19 @@ func runApp(cCtx *_cli.Context) error {
 
 	listenAddr := fmt.Sprintf(":%d", flagValueListenPort)
 	log.Debugf("listening on %v", listenAddr)
-	listener, err := raknet.Listen(listenAddr)
+	listenConfig := raknet.ListenConfig{}
+	proxyProtocol := &proxyProtocolListener{}
+	if flagValueProxyProto {
+		listenConfig.UpstreamPacketListener = proxyProtocol
+	}
+	listener, err := listenConfig.Listen(listenAddr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %v: %w", listenAddr, err)
 	}
 	defer listener.Close()
+	if flagValuePongData != "" {
+		listener.PongData([]byte(flagValuePongData))
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -50,7 +60,30 @@ func runApp(cCtx *_cli.Context) error {
 		}
 
 		log.Tracef("client connected: %v", conn.RemoteAddr())
+		if proxyProtocol.conn != nil {
+			if source, ok := proxyProtocol.conn.Source(conn.RemoteAddr()); ok {
+				log.Infof("client %v connected through proxy %v", source, conn.RemoteAddr())
+			} else {
+				log.Warnf("client %v connected without a PROXY protocol header", conn.RemoteAddr())
+			}
+			proxyProtocol.conn.Forget(conn.RemoteAddr())
+		}
 
 		conn.Close()
 	}
 }
+
+// proxyProtocolListener opens the server's socket, stripping PROXY protocol
+// headers from what it reads
+type proxyProtocolListener struct {
+	conn *proxyproto.PacketConn
+}
+
+func (l *proxyProtocolListener) ListenPacket(network, address string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	l.conn = proxyproto.NewPacketConn(conn)
+	return l.conn, nil
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// acl is the JSON form of proxy.RouteACL, and the body of PUT /acl. In a
+// request, a listen port of zero sets the ACL of every route without one of
+// its own.
+type acl struct {
+	ListenPort int      `json:"listen_port"`
+	Allow      []string `json:"allow"`
+	Deny       []string `json:"deny"`
+	Own        bool     `json:"own,omitempty"`
+}
+
+func newACL(a proxy.RouteACL) acl {
+	return acl{ListenPort: a.ListenPort, Allow: prefixStrings(a.ACL.Allow), Deny: prefixStrings(a.ACL.Deny), Own: a.Own}
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	values := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		values = append(values, prefix.String())
+	}
+	return values
+}
+
+func (a acl) ACL() (proxy.ACL, error) {
+	result := proxy.ACL{}
+	for _, s := range a.Allow {
+		prefix, err := proxy.ParsePrefix(s)
+		if err != nil {
+			return proxy.ACL{}, err
+		}
+		result.Allow = append(result.Allow, prefix)
+	}
+	for _, s := range a.Deny {
+		prefix, err := proxy.ParsePrefix(s)
+		if err != nil {
+			return proxy.ACL{}, err
+		}
+		result.Deny = append(result.Deny, prefix)
+	}
+	return result, nil
+}
+
+// handleACL serves GET /acl, listing each route's ACL, and PUT /acl,
+// replacing one until the next reload.
+func (s *Server) handleACL(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		acls := []acl{}
+		for _, a := range s.Proxy.ACLs() {
+			acls = append(acls, newACL(a))
+		}
+		writeJSON(w, http.StatusOK, acls)
+	case http.MethodPut:
+		s.handleACLPut(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) handleACLPut(w http.ResponseWriter, r *http.Request) {
+	request := acl{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ACL: %w", err))
+		return
+	}
+	result, err := request.ACL()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Proxy.SetACL(request.ListenPort, result); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	acls := []acl{}
+	for _, a := range s.Proxy.ACLs() {
+		acls = append(acls, newACL(a))
+	}
+	writeJSON(w, http.StatusOK, acls)
+}
@@ -0,0 +1,138 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Server is the admin HTTP API of the proxy. It is opt-in, and should only be
+// bound to an address that untrusted users cannot reach.
+type Server struct {
+	Addr  string
+	Proxy *proxy.Proxy
+
+	// Reload re-reads the proxy's configuration and applies it, returning a
+	// description of each setting that changed
+	Reload func() ([]string, error)
+}
+
+// Run serves the admin API until ctx is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("unable to start admin listener: %w", err)
+	}
+
+	server := &http.Server{Handler: s.Handler()}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	log.Infof("admin API listening on %v", listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("admin API stopped: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/upstreams", s.handleUpstreams)
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/sessions/", s.handleSessions)
+	mux.HandleFunc("/bans", s.handleBans)
+	mux.HandleFunc("/bans/", s.handleBans)
+	mux.HandleFunc("/acl", s.handleACL)
+	mux.HandleFunc("/captures", s.handleCaptures)
+	mux.HandleFunc("/captures/", s.handleCaptures)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+		return
+	}
+
+	changes, err := s.Reload()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"changes": changes})
+}
+
+// upstream is the JSON form of proxy.UpstreamStatus
+type upstream struct {
+	ListenPort int       `json:"listen_port"`
+	Name       string    `json:"name"`
+	Address    string    `json:"address"`
+	Healthy    bool      `json:"healthy"`
+	Sessions   int64     `json:"sessions"`
+	Pings      uint64    `json:"pings"`
+	Pongs      uint64    `json:"pongs"`
+	LastRTTMs  float64   `json:"last_rtt_ms"`
+	AvgRTTMs   float64   `json:"avg_rtt_ms"`
+	LastCheck  time.Time `json:"last_check"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	upstreams := []upstream{}
+	for _, u := range s.Proxy.Upstreams() {
+		upstreams = append(upstreams, upstream{
+			ListenPort: u.ListenPort,
+			Name:       u.Name,
+			Address:    u.Address,
+			Healthy:    u.Healthy,
+			Sessions:   u.Sessions,
+			Pings:      u.Pings,
+			Pongs:      u.Pongs,
+			LastRTTMs:  milliseconds(u.LastRTT),
+			AvgRTTMs:   milliseconds(u.AvgRTT),
+			LastCheck:  u.LastCheck,
+			LastError:  u.LastError,
+		})
+	}
+	writeJSON(w, http.StatusOK, upstreams)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("unable to write admin API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
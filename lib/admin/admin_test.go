@@ -0,0 +1,250 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// udpSocket returns a local UDP socket, closed when the test ends
+func udpSocket(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startProxy runs a proxy to an upstream that swallows every payload, until
+// the test ends
+func startProxy(t *testing.T) (*proxy.Proxy, *net.UDPAddr) {
+	t.Helper()
+	upstream := udpSocket(t)
+	free := udpSocket(t)
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	p := &proxy.Proxy{
+		ListenPort:     port,
+		ServerHostname: "127.0.0.1",
+		ServerPort:     upstream.LocalAddr().(*net.UDPAddr).Port,
+		ProxyHostname:  "127.0.0.1",
+		CaptureDir:     t.TempDir(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for len(p.ACLs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return p, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+// startSession opens a session through the proxy, returning the client's
+// address
+func startSession(t *testing.T, s *Server, proxyAddr *net.UDPAddr) string {
+	t.Helper()
+	client := udpSocket(t)
+	request := &raknet.OpenConnectionRequest1{Protocol: 11, MTU: 576}
+	if _, err := client.WriteToUDP(request.Append(nil), proxyAddr); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+	addr := client.LocalAddr().String()
+
+	deadline := time.Now().Add(time.Second)
+	for serve(t, s, "GET", "/sessions/"+addr, "").Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("no session for %v", addr)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return addr
+}
+
+func serve(t *testing.T, s *Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, method, path string, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("%s %s = %d %s, want %d", method, path, w.Code, strings.TrimSpace(w.Body.String()), status)
+	}
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.NewDecoder(w.Body).Decode(&v); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	return v
+}
+
+func TestMethodChecks(t *testing.T) {
+	p, _ := startProxy(t)
+	s := &Server{Proxy: p, Reload: func() ([]string, error) { return nil, nil }}
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/reload"},
+		{"POST", "/sessions"},
+		{"PUT", "/sessions/127.0.0.1:1"},
+		{"GET", "/sessions/127.0.0.1:1/ban"},
+		{"POST", "/bans"},
+		{"GET", "/bans/127.0.0.1"},
+		{"POST", "/acl"},
+		{"DELETE", "/acl"},
+		{"PUT", "/captures"},
+		{"GET", "/captures/1"},
+	}
+	for _, tt := range tests {
+		w := serve(t, s, tt.method, tt.path, "")
+		expectStatus(t, w, tt.method, tt.path, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	p, proxyAddr := startProxy(t)
+	s := &Server{Proxy: p}
+	addr := startSession(t, s, proxyAddr)
+
+	w := serve(t, s, "GET", "/sessions", "")
+	expectStatus(t, w, "GET", "/sessions", http.StatusOK)
+	// The embedded details are unexported, so responses are read as maps
+	sessions := decode[[]map[string]any](t, w)
+	if len(sessions) != 1 || sessions[0]["client_addr"] != addr || sessions[0]["payloads_from_client"] != nil {
+		t.Errorf("GET /sessions = %v, want the session from %v without details", sessions, addr)
+	}
+
+	w = serve(t, s, "GET", fmt.Sprintf("/sessions?listen_port=%d", proxyAddr.Port+1), "")
+	if sessions := decode[[]map[string]any](t, w); len(sessions) != 0 {
+		t.Errorf("GET /sessions on another port = %v, want none", sessions)
+	}
+
+	w = serve(t, s, "GET", "/sessions/"+addr, "")
+	if detail := decode[map[string]any](t, w); detail["client_addr"] != addr || detail["payloads_from_client"] == nil || detail["mtu"] == nil {
+		t.Errorf("GET /sessions/%v = %v, want the session's details", addr, detail)
+	}
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/sessions/not-an-address", http.StatusBadRequest},
+		{"GET", "/sessions/" + addr + "?listen_port=x", http.StatusBadRequest},
+		{"GET", "/sessions/127.0.0.1:1", http.StatusNotFound},
+		{"DELETE", "/sessions/127.0.0.1:1", http.StatusNotFound},
+		{"POST", "/sessions/127.0.0.1:1/ban", http.StatusNotFound},
+		{"GET", "/sessions/" + addr + "/other", http.StatusNotFound},
+		{"DELETE", "/sessions/" + addr, http.StatusOK},
+		{"GET", "/sessions/" + addr, http.StatusNotFound},
+	} {
+		expectStatus(t, serve(t, s, tt.method, tt.path, ""), tt.method, tt.path, tt.status)
+	}
+}
+
+func TestBan(t *testing.T) {
+	p, proxyAddr := startProxy(t)
+	s := &Server{Proxy: p}
+	addr := startSession(t, s, proxyAddr)
+
+	w := serve(t, s, "POST", "/sessions/"+addr+"/ban", "")
+	expectStatus(t, w, "POST", "/sessions/.../ban", http.StatusOK)
+	if result := decode[map[string]any](t, w); result["banned"] != "127.0.0.1" || result["disconnected"] != 1.0 {
+		t.Errorf("ban = %v", result)
+	}
+	if len(p.Sessions()) != 0 {
+		t.Errorf("banned client still has sessions")
+	}
+
+	w = serve(t, s, "GET", "/bans", "")
+	if bans := decode[[]ban](t, w); len(bans) != 1 || bans[0].Addr != "127.0.0.1" || bans[0].Until != nil {
+		t.Errorf("GET /bans = %+v", bans)
+	}
+	expectStatus(t, serve(t, s, "DELETE", "/bans/not-an-ip", ""), "DELETE", "/bans/not-an-ip", http.StatusBadRequest)
+	expectStatus(t, serve(t, s, "DELETE", "/bans/127.0.0.1", ""), "DELETE", "/bans/127.0.0.1", http.StatusOK)
+	expectStatus(t, serve(t, s, "DELETE", "/bans/127.0.0.1", ""), "DELETE", "/bans/127.0.0.1", http.StatusNotFound)
+}
+
+func TestACL(t *testing.T) {
+	p, proxyAddr := startProxy(t)
+	s := &Server{Proxy: p}
+
+	w := serve(t, s, "PUT", "/acl", `{"allow": ["10.0.0.0/8", "::ffff:198.51.100.0/120"], "deny": ["10.1.0.0/16"]}`)
+	expectStatus(t, w, "PUT", "/acl", http.StatusOK)
+	acls := decode[[]acl](t, w)
+	if len(acls) != 1 || strings.Join(acls[0].Allow, ",") != "10.0.0.0/8,198.51.100.0/24" || strings.Join(acls[0].Deny, ",") != "10.1.0.0/16" {
+		t.Errorf("PUT /acl = %+v", acls)
+	}
+
+	w = serve(t, s, "GET", "/acl", "")
+	if got := decode[[]acl](t, w); len(got) != 1 || len(got[0].Allow) != 2 || got[0].ListenPort != proxyAddr.Port {
+		t.Errorf("GET /acl = %+v", got)
+	}
+
+	for _, body := range []string{`{"allow": ["not a range"]}`, `{"allow": `, fmt.Sprintf(`{"listen_port": %d}`, proxyAddr.Port+1)} {
+		expectStatus(t, serve(t, s, "PUT", "/acl", body), "PUT", "/acl "+body, http.StatusBadRequest)
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	p, _ := startProxy(t)
+	s := &Server{Proxy: p}
+
+	w := serve(t, s, "POST", "/captures", `{"client": "127.0.0.1:5000"}`)
+	expectStatus(t, w, "POST", "/captures", http.StatusCreated)
+	started := decode[capture](t, w)
+	if started.Client != "127.0.0.1:5000" || started.Path == "" {
+		t.Errorf("POST /captures = %+v", started)
+	}
+
+	w = serve(t, s, "GET", "/captures", "")
+	if captures := decode[[]capture](t, w); len(captures) != 1 || captures[0].ID != started.ID {
+		t.Errorf("GET /captures = %+v", captures)
+	}
+
+	path := fmt.Sprintf("/captures/%d", started.ID)
+	expectStatus(t, serve(t, s, "POST", "/captures", `{"client": "not an address"}`), "POST", "/captures", http.StatusBadRequest)
+	expectStatus(t, serve(t, s, "DELETE", "/captures/x", ""), "DELETE", "/captures/x", http.StatusBadRequest)
+	expectStatus(t, serve(t, s, "DELETE", path, ""), "DELETE", path, http.StatusOK)
+	expectStatus(t, serve(t, s, "DELETE", path, ""), "DELETE", path, http.StatusNotFound)
+}
+
+func TestReload(t *testing.T) {
+	s := &Server{Reload: func() ([]string, error) { return []string{"log.level: info -> debug"}, nil }}
+	w := serve(t, s, "POST", "/reload", "")
+	expectStatus(t, w, "POST", "/reload", http.StatusOK)
+	if result := decode[map[string][]string](t, w); len(result["changes"]) != 1 {
+		t.Errorf("POST /reload = %v", result)
+	}
+
+	s.Reload = func() ([]string, error) { return nil, fmt.Errorf("invalid config") }
+	expectStatus(t, serve(t, s, "POST", "/reload", ""), "POST", "/reload", http.StatusBadRequest)
+}
@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// capture is the JSON form of proxy.CaptureStatus
+type capture struct {
+	ID         int       `json:"id"`
+	Path       string    `json:"path"`
+	ListenPort int       `json:"listen_port,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Started    time.Time `json:"started"`
+	Packets    uint64    `json:"packets"`
+}
+
+func newCapture(c proxy.CaptureStatus) capture {
+	j := capture{ID: c.ID, Path: c.Path, ListenPort: c.Filter.ListenPort, Started: c.Started, Packets: c.Packets}
+	switch {
+	case c.Filter.Client.IsValid() && c.Filter.ClientPort != 0:
+		j.Client = netip.AddrPortFrom(c.Filter.Client, c.Filter.ClientPort).String()
+	case c.Filter.Client.IsValid():
+		j.Client = c.Filter.Client.String()
+	}
+	return j
+}
+
+// captureRequest selects what POST /captures records. The client is an IP,
+// for all of its sessions, or an IP and port, for a single session. Both
+// fields are optional; with neither, all traffic is captured.
+type captureRequest struct {
+	ListenPort int    `json:"listen_port"`
+	Client     string `json:"client"`
+}
+
+func (c captureRequest) filter() (proxy.CaptureFilter, error) {
+	filter := proxy.CaptureFilter{ListenPort: c.ListenPort}
+	if c.Client == "" {
+		return filter, nil
+	}
+	if addrPort, err := netip.ParseAddrPort(c.Client); err == nil {
+		filter.Client, filter.ClientPort = addrPort.Addr(), addrPort.Port()
+		return filter, nil
+	}
+	addr, err := netip.ParseAddr(c.Client)
+	if err != nil {
+		return filter, fmt.Errorf("invalid client %q: not an IP address, or an IP address and port", c.Client)
+	}
+	filter.Client = addr
+	return filter, nil
+}
+
+// handleCaptures serves GET /captures, listing the running captures,
+// POST /captures, starting one, and DELETE /captures/<id>, stopping one.
+func (s *Server) handleCaptures(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/captures"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		captures := []capture{}
+		for _, c := range s.Proxy.Captures() {
+			captures = append(captures, newCapture(c))
+		}
+		writeJSON(w, http.StatusOK, captures)
+	case path == "" && r.Method == http.MethodPost:
+		s.handleCaptureStart(w, r)
+	case path != "" && r.Method == http.MethodDelete:
+		s.handleCaptureStop(w, path)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) handleCaptureStart(w http.ResponseWriter, r *http.Request) {
+	request := captureRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid capture request: %w", err))
+			return
+		}
+	}
+	filter, err := request.filter()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	status, err := s.Proxy.StartCapture(filter)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newCapture(status))
+}
+
+func (s *Server) handleCaptureStop(w http.ResponseWriter, path string) {
+	id, err := strconv.Atoi(path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid capture ID %q", path))
+		return
+	}
+	status, ok := s.Proxy.StopCapture(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no capture %d", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, newCapture(status))
+}
@@ -0,0 +1,223 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// session is the JSON form of proxy.SessionStatus
+type session struct {
+	ListenPort        int       `json:"listen_port"`
+	ClientAddr        string    `json:"client_addr"`
+	Upstream          string    `json:"upstream"`
+	ServerAddr        string    `json:"server_addr"`
+	ProxyAsClientPort int       `json:"proxy_as_client_port"`
+	Started           time.Time `json:"started"`
+	AgeSeconds        float64   `json:"age_seconds"`
+	LastActivity      time.Time `json:"last_activity"`
+	BytesFromClient   uint64    `json:"bytes_from_client"`
+	BytesFromServer   uint64    `json:"bytes_from_server"`
+
+	*sessionDetail
+}
+
+// sessionDetail is only included when a single session is fetched
+type sessionDetail struct {
+	LastActivityFromClient time.Time         `json:"last_activity_from_client"`
+	LastActivityFromServer time.Time         `json:"last_activity_from_server"`
+	PayloadsFromClient     uint64            `json:"payloads_from_client"`
+	PayloadsFromServer     uint64            `json:"payloads_from_server"`
+	BacklogFromClient      int               `json:"backlog_from_client"`
+	BacklogFromServer      int               `json:"backlog_from_server"`
+	ClientRTTMs            float64           `json:"client_rtt_ms"`
+	ServerRTTMs            float64           `json:"server_rtt_ms"`
+	MTU                    uint32            `json:"mtu"`
+	Errors                 map[string]uint64 `json:"errors"`
+}
+
+func newSession(s proxy.SessionStatus, detail bool) session {
+	lastActivity := s.LastActivity[proxy.FromClient]
+	if s.LastActivity[proxy.FromServer].After(lastActivity) {
+		lastActivity = s.LastActivity[proxy.FromServer]
+	}
+	proxyAsClientPort := 0
+	if addr, err := netip.ParseAddrPort(s.ProxyAsClientAddr); err == nil {
+		proxyAsClientPort = int(addr.Port())
+	}
+
+	j := session{
+		ListenPort:        s.ListenPort,
+		ClientAddr:        s.ClientAddr.String(),
+		Upstream:          s.Upstream,
+		ServerAddr:        s.ServerAddr,
+		ProxyAsClientPort: proxyAsClientPort,
+		Started:           s.Started,
+		AgeSeconds:        time.Since(s.Started).Seconds(),
+		LastActivity:      lastActivity,
+		BytesFromClient:   s.Bytes[proxy.FromClient],
+		BytesFromServer:   s.Bytes[proxy.FromServer],
+	}
+	if detail {
+		j.sessionDetail = &sessionDetail{
+			LastActivityFromClient: s.LastActivity[proxy.FromClient],
+			LastActivityFromServer: s.LastActivity[proxy.FromServer],
+			PayloadsFromClient:     s.Payloads[proxy.FromClient],
+			PayloadsFromServer:     s.Payloads[proxy.FromServer],
+			BacklogFromClient:      s.Backlog[proxy.FromClient],
+			BacklogFromServer:      s.Backlog[proxy.FromServer],
+			ClientRTTMs:            milliseconds(s.RTT[proxy.FromClient]),
+			ServerRTTMs:            milliseconds(s.RTT[proxy.FromServer]),
+			MTU:                    s.MTU,
+			Errors:                 s.Errors,
+		}
+	}
+	return j
+}
+
+// handleSessions serves GET /sessions, listing every session, and the
+// routes for a single session:
+//
+//	GET    /sessions/<client addr>      the session's details
+//	DELETE /sessions/<client addr>      disconnect the session
+//	POST   /sessions/<client addr>/ban  ban the client's IP and disconnect it
+//
+// A client with sessions on several routes is picked out with the
+// listen_port query parameter.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	if path == "" {
+		s.handleSessionList(w, r)
+		return
+	}
+
+	addr, action, _ := strings.Cut(path, "/")
+	client, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid client address %q: %w", addr, err))
+		return
+	}
+	listenPort, err := listenPortParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		s.handleSessionGet(w, listenPort, client)
+	case action == "" && r.Method == http.MethodDelete:
+		s.handleSessionDelete(w, listenPort, client)
+	case action == "ban" && r.Method == http.MethodPost:
+		s.handleSessionBan(w, listenPort, client)
+	case action == "" || action == "ban":
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleSessionList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use GET"))
+		return
+	}
+	listenPort, err := listenPortParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sessions := []session{}
+	for _, status := range s.Proxy.Sessions() {
+		if listenPort == 0 || status.ListenPort == listenPort {
+			sessions = append(sessions, newSession(status, false))
+		}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) handleSessionGet(w http.ResponseWriter, listenPort int, client netip.AddrPort) {
+	status, ok := s.Proxy.Session(listenPort, client)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no session for client %v", client))
+		return
+	}
+	writeJSON(w, http.StatusOK, newSession(status, true))
+}
+
+func (s *Server) handleSessionDelete(w http.ResponseWriter, listenPort int, client netip.AddrPort) {
+	if !s.Proxy.Disconnect(listenPort, client) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no session for client %v", client))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"disconnected": 1})
+}
+
+func (s *Server) handleSessionBan(w http.ResponseWriter, listenPort int, client netip.AddrPort) {
+	if _, ok := s.Proxy.Session(listenPort, client); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no session for client %v", client))
+		return
+	}
+	disconnected := s.Proxy.Ban(client.Addr())
+	writeJSON(w, http.StatusOK, map[string]any{"banned": client.Addr().Unmap().String(), "disconnected": disconnected})
+}
+
+// ban is the JSON form of proxy.Ban
+type ban struct {
+	Addr  string     `json:"addr"`
+	Since time.Time  `json:"since"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// handleBans serves GET /bans, listing the banned IPs, and
+// DELETE /bans/<ip>, lifting a ban.
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/bans"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		bans := []ban{}
+		for _, b := range s.Proxy.Bans() {
+			j := ban{Addr: b.Addr.String(), Since: b.Since}
+			if !b.Until.IsZero() {
+				j.Until = &b.Until
+			}
+			bans = append(bans, j)
+		}
+		writeJSON(w, http.StatusOK, bans)
+	case path != "" && r.Method == http.MethodDelete:
+		s.handleUnban(w, path)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) handleUnban(w http.ResponseWriter, path string) {
+	addr, err := netip.ParseAddr(path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid IP address %q: %w", path, err))
+		return
+	}
+	if !s.Proxy.Unban(addr) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%v is not banned", addr))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"unbanned": addr.Unmap().String()})
+}
+
+func listenPortParam(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("listen_port")
+	if value == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid listen_port %q: %w", value, err)
+	}
+	return port, nil
+}
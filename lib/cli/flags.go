@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"reflect"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -56,6 +57,13 @@ func ValidatePort(ctx *cli.Context, v int) error {
 	return nil
 }
 
+func ValidateDuration(ctx *cli.Context, v time.Duration) error {
+	if v < 0 {
+		return fmt.Errorf(`Invalid duration value: %v. Duration must not be negative`, v)
+	}
+	return nil
+}
+
 func ValidateLogLevel(ctx *cli.Context, v string) error {
 	return newValidateStringOption[LogLevel](LogLevels)(ctx, v)
 }
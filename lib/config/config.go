@@ -0,0 +1,285 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// Config is the raknet-proxy configuration file. Optional settings are
+// pointers, so that a setting left out of the file can be told apart from one
+// set to its zero value, and filled in from flags or defaults.
+type Config struct {
+	Log           LogConfig         `yaml:"log"`
+	ProxyHostname string            `yaml:"proxy_hostname"`
+	Listeners     []ListenerConfig  `yaml:"listeners"`
+	Timeouts      TimeoutsConfig    `yaml:"timeouts"`
+	ACL           ACLConfig         `yaml:"acl"`
+	Rewrite       RewriteConfig     `yaml:"rewrite"`
+	Validation    ValidationConfig  `yaml:"validation"`
+	Limits        LimitsConfig      `yaml:"limits"`
+	HealthCheck   HealthCheckConfig `yaml:"health_check"`
+	DNS           DNSConfig         `yaml:"dns"`
+	Admin         AdminConfig       `yaml:"admin"`
+	Metrics       MetricsConfig     `yaml:"metrics"`
+	Capture       CaptureConfig     `yaml:"capture"`
+	Record        RecordConfig      `yaml:"record"`
+
+	// path and root locate settings in the file for error messages
+	path string
+	root *yaml.Node
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// ListenerConfig is a port the proxy listens on for clients, and the
+// upstream servers it proxies them to: either a single Upstream, or a pool
+// of Upstreams balanced by the Balance policy. ProxyHostname, ACL and
+// Rewrite override the top-level settings for this listener only.
+type ListenerConfig struct {
+	Port             int              `yaml:"port"`
+	Upstream         UpstreamConfig   `yaml:"upstream"`
+	Upstreams        []UpstreamConfig `yaml:"upstreams"`
+	Balance          string           `yaml:"balance"`
+	ProxyHostname    string           `yaml:"proxy_hostname"`
+	ACL              *ACLConfig       `yaml:"acl"`
+	Rewrite          RewriteConfig    `yaml:"rewrite"`
+	PongCache        PongCacheConfig  `yaml:"pong_cache"`
+	HandshakeCookies bool             `yaml:"handshake_cookies"`
+	ProxyProtocol    string           `yaml:"proxy_protocol"`
+}
+
+// PongCacheConfig makes a listener answer unconnected pings from a pong
+// fetched in the background, optionally changing what it advertises.
+type PongCacheConfig struct {
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	Data            string        `yaml:"data"`
+	ServerName      string        `yaml:"server_name"`
+	IPv4Port        int           `yaml:"ipv4_port"`
+	IPv6Port        int           `yaml:"ipv6_port"`
+	ServerGUID      uint64        `yaml:"server_guid"`
+}
+
+type UpstreamConfig struct {
+	Hostname string `yaml:"hostname"`
+	Port     int    `yaml:"port"`
+	Weight   int    `yaml:"weight"`
+}
+
+func (u UpstreamConfig) isSet() bool {
+	return u.Hostname != "" || u.Port != 0
+}
+
+type TimeoutsConfig struct {
+	Idle     *time.Duration `yaml:"idle"`
+	Shutdown *time.Duration `yaml:"shutdown"`
+}
+
+// ACLConfig lists the IP addresses and CIDR ranges of clients that are
+// allowed or denied.
+type ACLConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// AllowFile and DenyFile add the entries of files with one entry per
+	// line, which are read again on reload
+	AllowFile string `yaml:"allow_file"`
+	DenyFile  string `yaml:"deny_file"`
+}
+
+type RewriteConfig struct {
+	// Addresses enables rewriting of the system addresses in the handshake
+	Addresses *bool `yaml:"addresses"`
+}
+
+type ValidationConfig struct {
+	// Policy is what happens to payloads from clients that are not valid
+	// RakNet: forward, log or drop
+	Policy string `yaml:"policy"`
+}
+
+type LimitsConfig struct {
+	MaxSplitCount   uint32 `yaml:"max_split_count"`
+	MaxSplitPending int    `yaml:"max_split_pending"`
+	MaxSplitBytes   int    `yaml:"max_split_bytes"`
+
+	// Rate limits, see proxy.RateLimits
+	MaxSessions             int           `yaml:"max_sessions"`
+	NewSessionsPerIP        float64       `yaml:"new_sessions_per_ip"`
+	NewSessionsBurst        int           `yaml:"new_sessions_burst"`
+	SessionPacketsPerSecond float64       `yaml:"session_packets_per_second"`
+	SessionBytesPerSecond   float64       `yaml:"session_bytes_per_second"`
+	Action                  string        `yaml:"action"`
+	BanDuration             time.Duration `yaml:"ban_duration"`
+}
+
+// HealthCheckConfig enables pinging of the upstreams, marking them down
+// after Fall unanswered pings and back up after Rise answered ones.
+type HealthCheckConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Rise     int           `yaml:"rise"`
+	Fall     int           `yaml:"fall"`
+}
+
+type DNSConfig struct {
+	// ResolveInterval is how often upstream hostnames are resolved again
+	ResolveInterval *time.Duration `yaml:"resolve_interval"`
+}
+
+type AdminConfig struct {
+	// Listen is the host:port of the admin HTTP API, which is disabled if
+	// empty
+	Listen string `yaml:"listen"`
+}
+
+type MetricsConfig struct {
+	// Listen is the host:port on which Prometheus metrics are served at
+	// /metrics, which is disabled if empty
+	Listen string `yaml:"listen"`
+}
+
+type CaptureConfig struct {
+	// Dir is where packet captures started from the admin API are written
+	Dir string `yaml:"dir"`
+}
+
+type RecordConfig struct {
+	// Dir is where new sessions are recorded, for raknet-replay
+	Dir string `yaml:"dir"`
+}
+
+// Load reads and parses a configuration file. It does not validate the
+// settings, see Validate.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.path = path
+	return c, nil
+}
+
+// Parse parses a configuration from YAML. Unknown settings are an error.
+func Parse(b []byte) (*Config, error) {
+	c := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse config: %w", err)
+	}
+
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(b, root); err != nil {
+		return nil, fmt.Errorf("unable to parse config: %w", err)
+	}
+	c.root = root
+	return c, nil
+}
+
+// IdleTimeout returns the idle timeout, or def if it is not set.
+func (c *Config) IdleTimeout(def time.Duration) time.Duration {
+	return durationOr(c.Timeouts.Idle, def)
+}
+
+// ShutdownTimeout returns the shutdown timeout, or def if it is not set.
+func (c *Config) ShutdownTimeout(def time.Duration) time.Duration {
+	return durationOr(c.Timeouts.Shutdown, def)
+}
+
+// ResolveInterval returns the upstream re-resolution interval, or def if it
+// is not set.
+func (c *Config) ResolveInterval(def time.Duration) time.Duration {
+	return durationOr(c.DNS.ResolveInterval, def)
+}
+
+// RewriteAddresses reports whether handshake addresses should be rewritten,
+// which they are unless the file turns it off.
+func (c *Config) RewriteAddresses() bool {
+	return c.Rewrite.enabled(true)
+}
+
+// RewriteAddresses reports whether handshake addresses should be rewritten on
+// this listener, given the top-level setting.
+func (l ListenerConfig) RewriteAddresses(def bool) bool {
+	return l.Rewrite.enabled(def)
+}
+
+func (r RewriteConfig) enabled(def bool) bool {
+	if r.Addresses == nil {
+		return def
+	}
+	return *r.Addresses
+}
+
+func durationOr(d *time.Duration, def time.Duration) time.Duration {
+	if d == nil {
+		return def
+	}
+	return *d
+}
+
+// RateLimits returns the rate limits, with the default action if none is
+// set.
+func (c LimitsConfig) RateLimits() (proxy.RateLimits, error) {
+	action, err := proxy.ParseLimitAction(c.Action)
+	if err != nil {
+		return proxy.RateLimits{}, err
+	}
+	return proxy.RateLimits{
+		NewSessionsPerIP:        c.NewSessionsPerIP,
+		NewSessionsBurst:        c.NewSessionsBurst,
+		MaxSessions:             c.MaxSessions,
+		SessionPacketsPerSecond: c.SessionPacketsPerSecond,
+		SessionBytesPerSecond:   c.SessionBytesPerSecond,
+		Action:                  action,
+		BanDuration:             c.BanDuration,
+	}, nil
+}
+
+// ACL parses the allow and deny lists, and reads the files.
+func (c ACLConfig) ACL() (proxy.ACL, error) {
+	acl := proxy.ACL{}
+	var err error
+	if acl.Allow, err = parsePrefixes(c.Allow, c.AllowFile); err != nil {
+		return proxy.ACL{}, err
+	}
+	if acl.Deny, err = parsePrefixes(c.Deny, c.DenyFile); err != nil {
+		return proxy.ACL{}, err
+	}
+	return acl, nil
+}
+
+func parsePrefixes(list []string, path string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		prefix, err := proxy.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if path == "" {
+		return prefixes, nil
+	}
+	fromFile, err := proxy.ReadPrefixFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(prefixes, fromFile...), nil
+}
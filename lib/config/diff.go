@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Change is a setting that differs between two configurations
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Old, c.New)
+}
+
+// Diff lists the settings that differ between old and new, named by their
+// path in the file (e.g. "listeners[0].upstream.port").
+func Diff(old, new *Config) []Change {
+	return diffValues("", reflect.ValueOf(*old), reflect.ValueOf(*new), nil)
+}
+
+func diffValues(field string, old, new reflect.Value, changes []Change) []Change {
+	switch old.Kind() {
+	case reflect.Struct:
+		for i := 0; i < old.NumField(); i++ {
+			name := yamlName(old.Type().Field(i))
+			if name == "" {
+				continue
+			}
+			changes = diffValues(joinField(field, name), old.Field(i), new.Field(i), changes)
+		}
+		return changes
+	case reflect.Slice:
+		// Lists of settings are compared element by element when only their
+		// contents changed, and as a whole otherwise
+		if old.Len() == new.Len() && old.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < old.Len(); i++ {
+				changes = diffValues(fmt.Sprintf("%s[%d]", field, i), old.Index(i), new.Index(i), changes)
+			}
+			return changes
+		}
+	}
+
+	if reflect.DeepEqual(old.Interface(), new.Interface()) {
+		return changes
+	}
+	return append(changes, Change{Field: field, Old: formatValue(old), New: formatValue(new)})
+}
+
+// yamlName returns the name of a setting in the file, or "" for fields that
+// are not settings.
+func yamlName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "(unset)"
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct {
+		return fmt.Sprintf("%d entries", v.Len())
+	}
+	if v.Kind() == reflect.String {
+		return fmt.Sprintf("%q", v.String())
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
@@ -0,0 +1,313 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/percygrunwald/raknet-proxy/lib/cli"
+	"github.com/percygrunwald/raknet-proxy/lib/proxy"
+)
+
+// FieldError is an invalid setting, located by its path in the file (e.g.
+// "listeners[0].upstream.port") and, when known, its line.
+type FieldError struct {
+	Path  string
+	Field string
+	Line  int
+	Err   error
+}
+
+func (e FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %v", e.Path, e.Line, e.Field, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is every invalid setting found in a configuration
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// validator collects field errors, locating each field in the parsed file
+type validator struct {
+	c    *Config
+	errs ValidationErrors
+}
+
+// Validate checks every setting, returning ValidationErrors listing all the
+// invalid ones, or nil.
+func (c *Config) Validate() error {
+	v := &validator{c: c}
+
+	v.check("log.level", c.Log.Level != "", func() error { return cli.ValidateLogLevel(nil, c.Log.Level) })
+	v.check("log.format", c.Log.Format != "", func() error { return cli.ValidateLogFormat(nil, c.Log.Format) })
+	v.check("proxy_hostname", c.needsProxyHostname(), func() error { return required(c.ProxyHostname) })
+	v.validateListeners()
+	v.checkDuration("timeouts.idle", c.Timeouts.Idle)
+	v.checkDuration("timeouts.shutdown", c.Timeouts.Shutdown)
+	v.checkDuration("dns.resolve_interval", c.DNS.ResolveInterval)
+	v.checkACL("acl", c.ACL)
+	v.check("validation.policy", c.Validation.Policy != "", func() error {
+		_, err := proxy.ParseValidationPolicy(c.Validation.Policy)
+		return err
+	})
+	v.validateLimits()
+	v.check("health_check.interval", true, func() error { return cli.ValidateDuration(nil, c.HealthCheck.Interval) })
+	v.check("health_check.timeout", true, func() error { return cli.ValidateDuration(nil, c.HealthCheck.Timeout) })
+	v.check("health_check.rise", true, func() error { return notNegative(c.HealthCheck.Rise) })
+	v.check("health_check.fall", true, func() error { return notNegative(c.HealthCheck.Fall) })
+	v.check("admin.listen", c.Admin.Listen != "", func() error { return validateHostPort(c.Admin.Listen) })
+	v.check("metrics.listen", c.Metrics.Listen != "", func() error { return validateHostPort(c.Metrics.Listen) })
+	v.check("capture.dir", c.Capture.Dir != "", func() error { return validateDir(c.Capture.Dir) })
+	v.check("record.dir", c.Record.Dir != "", func() error { return validateDir(c.Record.Dir) })
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+func (v *validator) validateListeners() {
+	if len(v.c.Listeners) == 0 {
+		v.add("listeners", fmt.Errorf("at least one listener is required"))
+		return
+	}
+
+	ports := map[int]int{}
+	for i, l := range v.c.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		v.check(field+".port", true, func() error { return validatePort(l.Port) })
+		if first, ok := ports[l.Port]; ok && l.Port != 0 {
+			v.add(field+".port", fmt.Errorf("port %d is already used by listeners[%d]", l.Port, first))
+		} else {
+			ports[l.Port] = i
+		}
+		v.validateUpstreams(field, l)
+		v.check(field+".pong_cache.refresh_interval", true, func() error { return cli.ValidateDuration(nil, l.PongCache.RefreshInterval) })
+		v.check(field+".pong_cache.ipv4_port", true, func() error { return cli.ValidatePort(nil, l.PongCache.IPv4Port) })
+		v.check(field+".pong_cache.ipv6_port", true, func() error { return cli.ValidatePort(nil, l.PongCache.IPv6Port) })
+		v.check(field+".proxy_protocol", l.ProxyProtocol != "", func() error { return validateProxyProtocol(l.ProxyProtocol) })
+		if l.ACL != nil {
+			v.checkACL(field+".acl", *l.ACL)
+		}
+	}
+}
+
+func (v *validator) validateUpstreams(field string, l ListenerConfig) {
+	if l.Upstream.isSet() && len(l.Upstreams) > 0 {
+		v.add(field+".upstreams", fmt.Errorf("only one of upstream and upstreams may be set"))
+		return
+	}
+	v.check(field+".balance", l.Balance != "", func() error { return validateBalance(l.Balance) })
+	if len(l.Upstreams) == 0 {
+		v.validateUpstream(field+".upstream", l.Upstream)
+		return
+	}
+	for i, u := range l.Upstreams {
+		v.validateUpstream(fmt.Sprintf("%s.upstreams[%d]", field, i), u)
+	}
+}
+
+func (v *validator) validateUpstream(field string, u UpstreamConfig) {
+	v.check(field+".hostname", true, func() error { return required(u.Hostname) })
+	v.check(field+".port", true, func() error { return validatePort(u.Port) })
+	v.check(field+".weight", true, func() error { return notNegative(u.Weight) })
+}
+
+// needsProxyHostname reports whether a listener relies on the top-level proxy
+// hostname, not having its own
+func (c *Config) needsProxyHostname() bool {
+	for _, l := range c.Listeners {
+		if l.ProxyHostname == "" {
+			return true
+		}
+	}
+	return len(c.Listeners) == 0
+}
+
+func (v *validator) checkDuration(field string, d *time.Duration) {
+	v.check(field, d != nil, func() error { return cli.ValidateDuration(nil, *d) })
+}
+
+func (v *validator) validateLimits() {
+	l := v.c.Limits
+	v.check("limits.max_split_pending", true, func() error { return notNegative(l.MaxSplitPending) })
+	v.check("limits.max_split_bytes", true, func() error { return notNegative(l.MaxSplitBytes) })
+	v.check("limits.max_sessions", true, func() error { return notNegative(l.MaxSessions) })
+	v.check("limits.new_sessions_per_ip", true, func() error { return notNegative(l.NewSessionsPerIP) })
+	v.check("limits.new_sessions_burst", true, func() error { return notNegative(l.NewSessionsBurst) })
+	v.check("limits.session_packets_per_second", true, func() error { return notNegative(l.SessionPacketsPerSecond) })
+	v.check("limits.session_bytes_per_second", true, func() error { return notNegative(l.SessionBytesPerSecond) })
+	v.check("limits.action", l.Action != "", func() error {
+		_, err := proxy.ParseLimitAction(l.Action)
+		return err
+	})
+	v.check("limits.ban_duration", true, func() error { return cli.ValidateDuration(nil, l.BanDuration) })
+}
+
+func (v *validator) checkACL(field string, acl ACLConfig) {
+	v.checkPrefixes(field+".allow", acl.Allow)
+	v.checkPrefixes(field+".deny", acl.Deny)
+	v.checkPrefixFile(field+".allow_file", acl.AllowFile)
+	v.checkPrefixFile(field+".deny_file", acl.DenyFile)
+}
+
+func (v *validator) checkPrefixFile(field string, path string) {
+	v.check(field, path != "", func() error {
+		_, err := proxy.ReadPrefixFile(path)
+		return err
+	})
+}
+
+func (v *validator) checkPrefixes(field string, prefixes []string) {
+	for i, s := range prefixes {
+		v.check(fmt.Sprintf("%s[%d]", field, i), true, func() error {
+			_, err := proxy.ParsePrefix(s)
+			return err
+		})
+	}
+}
+
+// check runs validate if the setting is present, recording its error
+func (v *validator) check(field string, present bool, validate func() error) {
+	if !present {
+		return
+	}
+	if err := validate(); err != nil {
+		v.add(field, err)
+	}
+}
+
+func (v *validator) add(field string, err error) {
+	v.errs = append(v.errs, FieldError{Path: v.c.path, Field: field, Line: v.c.line(field), Err: err})
+}
+
+// line returns the line of a setting, given its path in the form
+// "listeners[0].upstream.port", or 0 if it is not in the file.
+func (c *Config) line(field string) int {
+	if c.root == nil || len(c.root.Content) == 0 {
+		return 0
+	}
+
+	node := c.root.Content[0]
+	line := node.Line
+	for _, part := range strings.Split(field, ".") {
+		key, index := splitIndex(part)
+		if node = mappingValue(node, key); node == nil {
+			return line
+		}
+		line = node.Line
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return line
+			}
+			node = node.Content[index]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+// splitIndex splits "listeners[0]" into "listeners" and 0. Parts without an
+// index return -1.
+func splitIndex(part string) (string, int) {
+	open := strings.IndexByte(part, '[')
+	if open < 0 || !strings.HasSuffix(part, "]") {
+		return part, -1
+	}
+	index, err := strconv.Atoi(part[open+1 : len(part)-1])
+	if err != nil {
+		return part, -1
+	}
+	return part[:open], index
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func validateBalance(s string) error {
+	for _, policy := range proxy.BalancePolicies {
+		if proxy.BalancePolicy(s) == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid balance policy %q. Valid options: %v", s, proxy.BalancePolicies)
+}
+
+func validatePort(port int) error {
+	if port == 0 {
+		return fmt.Errorf("a port is required")
+	}
+	return cli.ValidatePort(nil, port)
+}
+
+func validateHostPort(s string) error {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port in address %q", s)
+	}
+	return nil
+}
+
+func validateDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", path)
+	}
+	return nil
+}
+
+func required(s string) error {
+	if s == "" {
+		return fmt.Errorf("a value is required")
+	}
+	return nil
+}
+
+func notNegative[T int | float64](n T) error {
+	if n < 0 {
+		return fmt.Errorf("must not be negative, got %v", n)
+	}
+	return nil
+}
+
+func validateProxyProtocol(s string) error {
+	for _, mode := range proxy.ProxyProtocols {
+		if proxy.ProxyProtocol(s) == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid PROXY protocol mode %q. Valid options: %v", s, proxy.ProxyProtocols)
+}
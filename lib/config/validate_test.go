@@ -0,0 +1,146 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const invalidConfig = `proxy_hostname: play.example.com
+log:
+  level: loud
+listeners:
+  - port: 19132
+    upstream:
+      hostname: a.example.com
+      port: 19133
+  - port: 19132
+    upstreams:
+      - hostname: b.example.com
+        port: 70000
+      - hostname: ""
+        port: 19133
+  - port: 19134
+    upstream:
+      hostname: c.example.com
+limits:
+  max_sessions: -1
+`
+
+func TestValidateLines(t *testing.T) {
+	c, err := Parse([]byte(invalidConfig))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	err = c.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate = %v, want ValidationErrors", err)
+	}
+
+	want := map[string]int{
+		"log.level":                          3,
+		"listeners[1].port":                  9,
+		"listeners[1].upstreams[0].port":     12,
+		"listeners[1].upstreams[1].hostname": 13,
+		// A missing setting points to the setting it belongs in
+		"listeners[2].upstream.port": 17,
+		"limits.max_sessions":        19,
+	}
+	got := map[string]int{}
+	for _, fieldErr := range errs {
+		got[fieldErr.Field] = fieldErr.Line
+	}
+	for field, line := range want {
+		if got[field] != line {
+			t.Errorf("%s reported at line %d, want %d", field, got[field], line)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Validate = %v, want errors for %d fields", err, len(want))
+	}
+}
+
+func TestValidateDuplicatePorts(t *testing.T) {
+	c, err := Parse([]byte(invalidConfig))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for _, fieldErr := range c.Validate().(ValidationErrors) {
+		if fieldErr.Field == "listeners[1].port" && !strings.Contains(fieldErr.Err.Error(), "already used by listeners[0]") {
+			t.Errorf("duplicate port error = %v", fieldErr.Err)
+		}
+	}
+}
+
+func TestLoadErrorsNameTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raknet-proxy.yaml")
+	if err := os.WriteFile(path, []byte(invalidConfig), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	msg := c.Validate().Error()
+	if want := path + ":12: listeners[1].upstreams[0].port: "; !strings.Contains(msg, want) {
+		t.Errorf("Validate error %q does not contain %q", msg, want)
+	}
+}
+
+func TestValidateValid(t *testing.T) {
+	c, err := Parse([]byte(`proxy_hostname: play.example.com
+listeners:
+  - port: 19132
+    upstreams:
+      - hostname: a.example.com
+        port: 19133
+      - hostname: b.example.com
+        port: 19133
+  - port: 19134
+    proxy_hostname: other.example.com
+    upstream:
+      hostname: c.example.com
+      port: 19135
+acl:
+  allow: [10.0.0.0/8]
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestParseUnknownKeys(t *testing.T) {
+	for _, s := range []string{
+		"proxy_hostnme: play.example.com\n",
+		"listeners:\n  - port: 19132\n    upstream:\n      hostname: a.example.com\n      prot: 19133\n",
+	} {
+		if _, err := Parse([]byte(s)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an unknown field error", s)
+		}
+	}
+}
+
+func TestSplitIndex(t *testing.T) {
+	tests := []struct {
+		part  string
+		key   string
+		index int
+	}{
+		{"listeners[1]", "listeners", 1},
+		{"upstreams[12]", "upstreams", 12},
+		{"port", "port", -1},
+		{"listeners[x]", "listeners[x]", -1},
+		{"listeners[1", "listeners[1", -1},
+	}
+	for _, tt := range tests {
+		if key, index := splitIndex(tt.part); key != tt.key || index != tt.index {
+			t.Errorf("splitIndex(%q) = %q, %d, want %q, %d", tt.part, key, index, tt.key, tt.index)
+		}
+	}
+}
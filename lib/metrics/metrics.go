@@ -0,0 +1,357 @@
+// Package metrics implements the few Prometheus metric types the proxy needs,
+// and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds metrics and writes them out in the order they were
+// registered.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	bw := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return counter.n, err
+}
+
+// Handler serves the metrics to Prometheus.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// desc is the name, help and label names shared by the series of a metric
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+}
+
+// series returns the name of a series with its labels, plus extra labels
+// given as name/value pairs
+func (d desc) series(suffix string, values []string, extra ...string) string {
+	b := strings.Builder{}
+	b.WriteString(d.name)
+	b.WriteString(suffix)
+	if len(values) == 0 && len(extra) == 0 {
+		return b.String()
+	}
+	b.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, d.labels[i], escapeLabel(v))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if i > 0 || len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extra[i], escapeLabel(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// vec holds the children of a metric, one per combination of label values
+type vec[T any] struct {
+	desc
+	mu       sync.RWMutex
+	children map[string]*child[T]
+	newChild func() *T
+}
+
+type child[T any] struct {
+	values []string
+	metric *T
+}
+
+func newVec[T any](d desc, newChild func() *T) *vec[T] {
+	return &vec[T]{desc: d, children: map[string]*child[T]{}, newChild: newChild}
+}
+
+// with returns the child for the label values, creating it on first use
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.children[key]; ok {
+		return c.metric
+	}
+	c = &child[T]{values: append([]string(nil), values...), metric: v.newChild()}
+	v.children[key] = c
+	return c.metric
+}
+
+// sorted returns the children ordered by label values, so that output is
+// stable between scrapes
+func (v *vec[T]) sorted() []*child[T] {
+	v.mu.RLock()
+	children := make([]*child[T], 0, len(v.children))
+	for _, c := range v.children {
+		children = append(children, c)
+	}
+	v.mu.RUnlock()
+
+	sort.Slice(children, func(i, j int) bool {
+		return strings.Join(children[i].values, "\xff") < strings.Join(children[j].values, "\xff")
+	})
+	return children
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+type CounterVec struct {
+	*vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(desc{name: name, help: help, kind: "counter", labels: labels}, func() *Counter { return &Counter{} })}
+	r.register(v)
+	return v
+}
+
+// With returns the counter for the label values.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		fmt.Fprintf(w, "%s %d\n", v.series("", c.values), c.metric.v.Load())
+	}
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *Gauge) Set(n int64) {
+	g.v.Store(n)
+}
+
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec(desc{name: name, help: help, kind: "gauge", labels: labels}, func() *Gauge { return &Gauge{} })}
+	r.register(v)
+	return v
+}
+
+// With returns the gauge for the label values.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		fmt.Fprintf(w, "%s %d\n", v.series("", c.values), c.metric.v.Load())
+	}
+}
+
+// Sample is a value of a gauge computed when metrics are collected, with
+// its label values
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type gaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose values are computed by collect each
+// time metrics are written.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&gaugeFunc{desc: desc{name: name, help: help, kind: "gauge", labels: labels}, collect: collect})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	samples := g.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s %s\n", g.series("", s.Labels), formatFloat(s.Value))
+	}
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+type HistogramVec struct {
+	*vec[Histogram]
+	buckets []float64
+}
+
+// NewHistogramVec registers a histogram with the given upper bounds for its
+// buckets, in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	newHistogram := func() *Histogram {
+		// The last count is for observations above every bound
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+	}
+	v := &HistogramVec{vec: newVec(desc{name: name, help: help, kind: "histogram", labels: labels}, newHistogram), buckets: buckets}
+	r.register(v)
+	return v
+}
+
+// With returns the histogram for the label values.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, c := range v.sorted() {
+		h := c.metric
+		h.mu.Lock()
+		cumulative := uint64(0)
+		for i, bound := range v.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s %d\n", v.series("_bucket", c.values, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s %d\n", v.series("_bucket", c.values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s %s\n", v.series("_sum", c.values), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s %d\n", v.series("_count", c.values), h.count)
+		h.mu.Unlock()
+	}
+}
+
+// ExponentialBuckets returns count bucket bounds, starting at start and each
+// factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	counters := r.NewCounterVec("test_total", "Help with a \\ and a\nnewline.", "label")
+	counters.With("b").Add(2)
+	counters.With("a\\b\"c\nd").Inc()
+	counters.With("a").Inc()
+
+	gauges := r.NewGaugeVec("test_gauge", "A gauge.")
+	gauges.With().Set(-3)
+
+	r.NewGaugeFunc("test_collected", "A collected gauge.", []string{"route", "direction"}, func() []Sample {
+		return []Sample{
+			{Labels: []string{"2", "client"}, Value: 1.5},
+			{Labels: []string{"1", "server"}, Value: 3},
+			{Labels: []string{"1", "client"}, Value: 0.25},
+		}
+	})
+
+	histograms := r.NewHistogramVec("test_seconds", "A histogram.", []float64{0.5, 1}, "route")
+	for _, v := range []float64{4, 0.25, 0.5} {
+		histograms.With("1").Observe(v)
+	}
+	histograms.With("0")
+
+	want := `# HELP test_total Help with a \\ and a\nnewline.
+# TYPE test_total counter
+test_total{label="a"} 1
+test_total{label="a\\b\"c\nd"} 1
+test_total{label="b"} 2
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge -3
+# HELP test_collected A collected gauge.
+# TYPE test_collected gauge
+test_collected{route="1",direction="client"} 0.25
+test_collected{route="1",direction="server"} 3
+test_collected{route="2",direction="client"} 1.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="0",le="0.5"} 0
+test_seconds_bucket{route="0",le="1"} 0
+test_seconds_bucket{route="0",le="+Inf"} 0
+test_seconds_sum{route="0"} 0
+test_seconds_count{route="0"} 0
+test_seconds_bucket{route="1",le="0.5"} 2
+test_seconds_bucket{route="1",le="1"} 2
+test_seconds_bucket{route="1",le="+Inf"} 3
+test_seconds_sum{route="1"} 4.75
+test_seconds_count{route="1"} 3
+`
+	// Series come out in the same order on every scrape
+	for i := 0; i < 3; i++ {
+		b := strings.Builder{}
+		n, err := r.WriteTo(&b)
+		if err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		if b.String() != want {
+			t.Fatalf("WriteTo wrote:\n%s\nwant:\n%s", b.String(), want)
+		}
+		if n != int64(len(want)) {
+			t.Errorf("WriteTo returned %d, wrote %d bytes", n, len(want))
+		}
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "A counter.").With().Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if body := w.Body.String(); !strings.HasSuffix(body, "test_total 1\n") {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestVecLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("With with the wrong number of label values did not panic")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "A counter.", "a", "b").With("only one")
+}
+
+func TestFormatFloat(t *testing.T) {
+	for v, want := range map[float64]string{0: "0", 1.5: "1.5", 1e-06: "1e-06", 1e21: "1e+21"} {
+		if got := formatFloat(v); got != want {
+			t.Errorf("formatFloat(%v) = %q, want %q", v, got, want)
+		}
+	}
+	if got := ExponentialBuckets(0.001, 2, 4); len(got) != 4 || got[0] != 0.001 || got[3] != 0.008 {
+		t.Errorf("ExponentialBuckets = %v", got)
+	}
+}
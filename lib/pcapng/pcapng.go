@@ -0,0 +1,153 @@
+// Package pcapng writes packet captures in the pcapng format read by
+// Wireshark and tcpdump, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+package pcapng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// LinkTypeRaw is the link type of interfaces whose packets start with an
+// IPv4 or IPv6 header.
+const LinkTypeRaw uint16 = 101
+
+const (
+	blockTypeSectionHeader     uint32 = 0x0a0d0d0a
+	blockTypeInterfaceDesc     uint32 = 0x00000001
+	blockTypeEnhancedPacket    uint32 = 0x00000006
+	byteOrderMagic             uint32 = 0x1a2b3c4d
+	optionEnd                  uint16 = 0
+	optionComment              uint16 = 1
+	optionSectionUserAppl      uint16 = 4
+	optionInterfaceName        uint16 = 2
+	optionInterfaceDescription uint16 = 3
+	// A snap length of zero means packets are not truncated
+	snapLen uint32 = 0
+
+	// Each block starts with its type and length, and ends with its length
+	// again
+	blockHeaderAndTrailerLength = 12
+)
+
+// Interface describes one of the interfaces packets are captured on.
+type Interface struct {
+	Name        string
+	Description string
+	LinkType    uint16
+}
+
+// Writer writes a capture of one section, with its interfaces declared up
+// front. It is safe for concurrent use.
+type Writer struct {
+	mu         sync.Mutex
+	w          *bufio.Writer
+	interfaces int
+}
+
+// NewWriter writes the section header and interface descriptions to w.
+// Packets refer to the interfaces by their index.
+func NewWriter(w io.Writer, application string, interfaces []Interface) (*Writer, error) {
+	pw := &Writer{w: bufio.NewWriter(w), interfaces: len(interfaces)}
+
+	shb := binary.LittleEndian.AppendUint32(nil, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // Major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // Minor version
+	// The section length is not known in advance
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	shb = appendOptions(shb, option{optionSectionUserAppl, application})
+	if err := pw.writeBlock(blockTypeSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		idb := binary.LittleEndian.AppendUint16(nil, iface.LinkType)
+		idb = binary.LittleEndian.AppendUint16(idb, 0) // Reserved
+		idb = binary.LittleEndian.AppendUint32(idb, snapLen)
+		idb = appendOptions(idb, option{optionInterfaceName, iface.Name}, option{optionInterfaceDescription, iface.Description})
+		if err := pw.writeBlock(blockTypeInterfaceDesc, idb); err != nil {
+			return nil, err
+		}
+	}
+	return pw, nil
+}
+
+// WritePacket writes a packet captured on an interface at time t, with an
+// optional comment.
+func (pw *Writer) WritePacket(iface int, t time.Time, data []byte, comment string) error {
+	if iface < 0 || iface >= pw.interfaces {
+		return fmt.Errorf("unable to write packet: no interface %d", iface)
+	}
+
+	// Timestamps are in microseconds, the default resolution
+	ts := uint64(t.UnixMicro())
+	epb := make([]byte, 0, 32+len(data)+len(comment))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(iface))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data))) // Captured length
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data))) // Original length
+	epb = appendPadded(epb, data)
+	epb = appendOptions(epb, option{optionComment, comment})
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.writeBlock(blockTypeEnhancedPacket, epb)
+}
+
+// Flush writes any buffered blocks to the underlying writer.
+func (pw *Writer) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.w.Flush()
+}
+
+func (pw *Writer) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(blockHeaderAndTrailerLength + len(body))
+	header := binary.LittleEndian.AppendUint32(nil, blockType)
+	header = binary.LittleEndian.AppendUint32(header, length)
+	trailer := binary.LittleEndian.AppendUint32(nil, length)
+
+	for _, b := range [][]byte{header, body, trailer} {
+		if _, err := pw.w.Write(b); err != nil {
+			return fmt.Errorf("unable to write pcapng block: %w", err)
+		}
+	}
+	return nil
+}
+
+type option struct {
+	code  uint16
+	value string
+}
+
+// appendOptions appends the options with non-empty values, and the end of
+// options marker if there were any
+func appendOptions(b []byte, options ...option) []byte {
+	written := false
+	for _, o := range options {
+		if o.value == "" {
+			continue
+		}
+		b = binary.LittleEndian.AppendUint16(b, o.code)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(o.value)))
+		b = appendPadded(b, []byte(o.value))
+		written = true
+	}
+	if written {
+		b = binary.LittleEndian.AppendUint16(b, optionEnd)
+		b = binary.LittleEndian.AppendUint16(b, 0)
+	}
+	return b
+}
+
+// appendPadded appends v, padded with zeros to a multiple of 4 bytes
+func appendPadded(b []byte, v []byte) []byte {
+	b = append(b, v...)
+	padding := (4 - len(v)%4) % 4
+	return append(b, make([]byte, padding)...)
+}
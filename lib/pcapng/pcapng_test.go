@@ -0,0 +1,126 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// block is a pcapng block read back from a capture
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+// readBlocks splits a capture into blocks, checking that each block's
+// leading and trailing lengths agree and are a multiple of 4
+func readBlocks(t *testing.T, b []byte) []block {
+	t.Helper()
+	blocks := []block{}
+	for len(b) > 0 {
+		if len(b) < blockHeaderAndTrailerLength {
+			t.Fatalf("%d trailing bytes", len(b))
+		}
+		length := binary.LittleEndian.Uint32(b[4:])
+		if length%4 != 0 || int(length) > len(b) {
+			t.Fatalf("block of type %#x has length %d, with %d bytes left", binary.LittleEndian.Uint32(b), length, len(b))
+		}
+		if trailer := binary.LittleEndian.Uint32(b[length-4:]); trailer != length {
+			t.Fatalf("block of type %#x has length %d, trailing length %d", binary.LittleEndian.Uint32(b), length, trailer)
+		}
+		blocks = append(blocks, block{blockType: binary.LittleEndian.Uint32(b), body: b[8 : length-4]})
+		b = b[length:]
+	}
+	return blocks
+}
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, "test", []Interface{{Name: "client", Description: "client leg", LinkType: LinkTypeRaw}})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	at := time.UnixMicro(0x0000000123456789)
+	if err := w.WritePacket(0, at, []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee}, "a comment"); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+	if err := w.WritePacket(1, at, []byte{0xaa}, ""); err == nil {
+		t.Errorf("WritePacket on an undeclared interface succeeded")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(blocks))
+	}
+
+	shb := blocks[0]
+	want, _ := hex.DecodeString("4d3c2b1a" + "0100" + "0000" + "ffffffffffffffff" +
+		"0400" + "0400" + "74657374" + // shb_userappl "test"
+		"0000" + "0000")
+	if shb.blockType != blockTypeSectionHeader || !bytes.Equal(shb.body, want) {
+		t.Errorf("section header block %#x: % x, want % x", shb.blockType, shb.body, want)
+	}
+
+	idb := blocks[1]
+	want, _ = hex.DecodeString("6500" + "0000" + "00000000" +
+		"0200" + "0600" + "636c69656e74" + "0000" + // if_name "client", padded
+		"0300" + "0a00" + "636c69656e74206c6567" + "0000" + // if_description "client leg", padded
+		"0000" + "0000")
+	if idb.blockType != blockTypeInterfaceDesc || !bytes.Equal(idb.body, want) {
+		t.Errorf("interface description block %#x: % x, want % x", idb.blockType, idb.body, want)
+	}
+
+	epb := blocks[2]
+	want, _ = hex.DecodeString("00000000" + "01000000" + "89674523" + // interface, timestamp high and low
+		"05000000" + "05000000" + // captured and original lengths
+		"aabbccddee" + "000000" + // packet, padded
+		"0100" + "0900" + "6120636f6d6d656e74" + "000000" + // opt_comment, padded
+		"0000" + "0000")
+	if epb.blockType != blockTypeEnhancedPacket || !bytes.Equal(epb.body, want) {
+		t.Errorf("enhanced packet block %#x: % x, want % x", epb.blockType, epb.body, want)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// A well known IPv4 header example, with its checksum field zeroed
+	header, _ := hex.DecodeString("450000730000400040110000c0a80001c0a800c7")
+	if got := checksum(header); got != 0xb861 {
+		t.Errorf("checksum = %#04x, want 0xb861", got)
+	}
+	binary.BigEndian.PutUint16(header[10:], 0xb861)
+	if got := checksum(header); got != 0 {
+		t.Errorf("checksum over a valid header = %#04x, want 0", got)
+	}
+	// An odd trailing byte is padded with zero
+	if got, want := checksum([]byte{0x01, 0x02, 0x03}), checksum([]byte{0x01, 0x02, 0x03, 0x00}); got != want {
+		t.Errorf("checksum of an odd length = %#04x, want %#04x", got, want)
+	}
+}
+
+func TestUDPPacketIPv4(t *testing.T) {
+	packet := UDPPacket(netip.MustParseAddrPort("192.168.1.20:19132"), netip.MustParseAddrPort("[::ffff:203.0.113.7]:51234"), []byte{0x01, 0x02, 0x03})
+	want, _ := hex.DecodeString("4500001f0000000040117d0ac0a80114cb007107" + // IPv4 header, checksum 0x7d0a
+		"4abcc822000b0000" + // UDP header, no checksum
+		"010203")
+	if !bytes.Equal(packet, want) {
+		t.Errorf("UDPPacket = % x, want % x", packet, want)
+	}
+}
+
+func TestUDPPacketIPv6(t *testing.T) {
+	packet := UDPPacket(netip.MustParseAddrPort("[2001:db8::1]:19132"), netip.MustParseAddrPort("[2001:db8::2]:51234"), []byte{0x01, 0x02, 0x03})
+	want, _ := hex.DecodeString("60000000" + "000b" + "11" + "40" +
+		"20010db8000000000000000000000001" +
+		"20010db8000000000000000000000002" +
+		"4abcc822000b8d82" + // UDP header, checksum 0x8d82
+		"010203")
+	if !bytes.Equal(packet, want) {
+		t.Errorf("UDPPacket = % x, want % x", packet, want)
+	}
+}
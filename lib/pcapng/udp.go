@@ -0,0 +1,79 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	ipv4HeaderLength = 20
+	ipv6HeaderLength = 40
+	udpHeaderLength  = 8
+	protocolUDP      = 17
+	defaultTTL       = 64
+)
+
+// UDPPacket wraps a UDP payload in synthetic IP and UDP headers, for
+// interfaces of LinkTypeRaw. src and dst must be of the same address family.
+func UDPPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	udpLength := udpHeaderLength + len(payload)
+	udp := binary.BigEndian.AppendUint16(nil, src.Port())
+	udp = binary.BigEndian.AppendUint16(udp, dst.Port())
+	udp = binary.BigEndian.AppendUint16(udp, uint16(udpLength))
+	udp = binary.BigEndian.AppendUint16(udp, 0) // Checksum, filled in below
+	udp = append(udp, payload...)
+
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	if srcAddr.Is4() {
+		// A zero UDP checksum means none was computed, which IPv4 allows
+		return append(ipv4Header(srcAddr, dstAddr, udpLength), udp...)
+	}
+
+	// IPv6 requires the checksum, over a pseudo-header and the datagram
+	pseudo := append(srcAddr.AsSlice(), dstAddr.AsSlice()...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(udpLength))
+	pseudo = binary.BigEndian.AppendUint32(pseudo, protocolUDP)
+	sum := checksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(ipv6Header(srcAddr, dstAddr, udpLength), udp...)
+}
+
+func ipv4Header(src, dst netip.Addr, payloadLength int) []byte {
+	h := make([]byte, 0, ipv4HeaderLength)
+	h = append(h, 0x45, 0) // Version 4, 5 words long; DSCP/ECN
+	h = binary.BigEndian.AppendUint16(h, uint16(ipv4HeaderLength+payloadLength))
+	h = binary.BigEndian.AppendUint32(h, 0) // Identification, flags and fragment offset
+	h = append(h, defaultTTL, protocolUDP)
+	h = binary.BigEndian.AppendUint16(h, 0) // Checksum, filled in below
+	h = append(h, src.AsSlice()...)
+	h = append(h, dst.AsSlice()...)
+	binary.BigEndian.PutUint16(h[10:], checksum(h))
+	return h
+}
+
+func ipv6Header(src, dst netip.Addr, payloadLength int) []byte {
+	h := make([]byte, 0, ipv6HeaderLength)
+	h = binary.BigEndian.AppendUint32(h, 6<<28) // Version 6, no traffic class or flow label
+	h = binary.BigEndian.AppendUint16(h, uint16(payloadLength))
+	h = append(h, protocolUDP, defaultTTL)
+	h = append(h, src.AsSlice()...)
+	return append(h, dst.AsSlice()...)
+}
+
+// checksum is the Internet checksum of RFC 1071
+func checksum(b []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ACL decides which clients may use the proxy. A client matching a deny
+// prefix is rejected. Otherwise, if there are allow prefixes, the client must
+// match one of them. An empty ACL allows everyone.
+type ACL struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Allows reports whether the ACL lets the client at addr through.
+func (a ACL) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a.Deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.Allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefix parses an IPv4 or IPv6 CIDR range, or a single IP address
+// which is taken as a range of one address. IPv4-mapped IPv6 ranges are
+// taken as the IPv4 range they map.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR range %q: %w", s, err)
+		}
+		return unmapPrefix(s, prefix)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q: %w", s, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// unmapPrefix turns an IPv4-mapped IPv6 range into its IPv4 range, since
+// clients' addresses are unmapped before being matched. A mapped range wider
+// than the mapped IPv4 space is an error.
+func unmapPrefix(s string, prefix netip.Prefix) (netip.Prefix, error) {
+	if !prefix.Addr().Is4In6() {
+		return prefix.Masked(), nil
+	}
+	const mappedBits = 128 - 32
+	if prefix.Bits() < mappedBits {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR range %q: IPv4-mapped ranges must be at least /%d", s, mappedBits)
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-mappedBits).Masked(), nil
+}
+
+// ReadPrefixes reads IP addresses and CIDR ranges, one per line. Blank lines
+// and comments starting with # are ignored.
+func ReadPrefixes(r io.Reader) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s, _, _ := strings.Cut(scanner.Text(), "#")
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		prefix, err := ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// ReadPrefixFile reads a file of IP addresses and CIDR ranges, see
+// ReadPrefixes.
+func ReadPrefixFile(path string) ([]netip.Prefix, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read IP list: %w", err)
+	}
+	defer file.Close()
+
+	prefixes, err := ReadPrefixes(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read IP list %v: %w", path, err)
+	}
+	return prefixes, nil
+}
+
+// RouteACL is the ACL applied to new proxy connections on a route.
+type RouteACL struct {
+	ListenPort int
+	ACL        ACL
+	// Own is set if the route has its own ACL rather than the proxy's
+	Own bool
+}
+
+// ACLs returns the ACL of every route.
+func (p *Proxy) ACLs() []RouteACL {
+	acls := []RouteACL{}
+	if !p.running.Load() {
+		return acls
+	}
+	for _, l := range p.activeListeners() {
+		settings := l.settings.Load()
+		acls = append(acls, RouteACL{ListenPort: l.route.ListenPort, ACL: settings.acl, Own: settings.route.ACL != nil})
+	}
+	return acls
+}
+
+// SetACL replaces the ACL applied to new proxy connections on a route, or on
+// every route without an ACL of its own if listenPort is zero. Existing
+// connections are left alone. The change lasts until the proxy is next
+// reconfigured.
+func (p *Proxy) SetACL(listenPort int, acl ACL) error {
+	if !p.running.Load() {
+		return fmt.Errorf("unable to set ACL: proxy not running")
+	}
+	if listenPort != 0 && p.listener(listenPort) == nil {
+		return fmt.Errorf("unable to set ACL: not listening on port %d", listenPort)
+	}
+
+	for _, l := range p.activeListeners() {
+		if listenPort == 0 && l.settings.Load().route.ACL != nil {
+			continue
+		}
+		if listenPort == 0 || l.route.ListenPort == listenPort {
+			l.setACL(acl, listenPort != 0)
+		}
+	}
+	return nil
+}
+
+func (l *listener) setACL(acl ACL, own bool) {
+	for {
+		current := l.settings.Load()
+		next := *current
+		next.acl = acl
+		if own {
+			// Keep the route's ACL when the proxy-wide one is set later on
+			next.route.ACL = &acl
+		}
+		if l.settings.CompareAndSwap(current, &next) {
+			break
+		}
+	}
+	log.Infof("ACL on %v set to allow %v, deny %v", l.listenAddr, acl.Allow, acl.Deny)
+}
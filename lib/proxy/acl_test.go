@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"198.51.100.7", "198.51.100.7/32"},
+		{"198.51.100.0/24", "198.51.100.0/24"},
+		{"198.51.100.7/24", "198.51.100.0/24"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"::ffff:198.51.100.7", "198.51.100.7/32"},
+		{"::ffff:198.51.100.0/120", "198.51.100.0/24"},
+		{"::ffff:198.51.100.7/128", "198.51.100.7/32"},
+		{"::ffff:0.0.0.0/96", "0.0.0.0/0"},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrefix(tt.s)
+		if err != nil {
+			t.Errorf("ParsePrefix(%q): %v", tt.s, err)
+			continue
+		}
+		if !got.IsValid() || got.String() != tt.want {
+			t.Errorf("ParsePrefix(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "not an address", "198.51.100.0/33", "::ffff:198.51.100.0/95", "198.51.100.0/"} {
+		if got, err := ParsePrefix(s); err == nil {
+			t.Errorf("ParsePrefix(%q) = %v, want an error", s, got)
+		}
+	}
+}
+
+func TestACLAllowsMappedRanges(t *testing.T) {
+	prefix, err := ParsePrefix("::ffff:198.51.100.0/120")
+	if err != nil {
+		t.Fatalf("ParsePrefix: %v", err)
+	}
+	acl := ACL{Allow: []netip.Prefix{prefix}}
+	for _, s := range []string{"198.51.100.7", "::ffff:198.51.100.7"} {
+		if !acl.Allows(netip.MustParseAddr(s)) {
+			t.Errorf("%v not allowed by %v", s, prefix)
+		}
+	}
+	if acl.Allows(netip.MustParseAddr("198.51.101.7")) {
+		t.Errorf("198.51.101.7 allowed by %v", prefix)
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	acl := ACL{
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")},
+		Deny:  []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+	}
+	tests := map[string]bool{
+		"10.0.0.1":        true,
+		"::ffff:10.0.0.1": true,
+		"2001:db8::1":     true,
+		"192.0.2.1":       false,
+		"2001:db9::1":     false,
+		// Deny wins over allow
+		"10.1.2.3":        false,
+		"::ffff:10.1.2.3": false,
+	}
+	for s, want := range tests {
+		if got := acl.Allows(netip.MustParseAddr(s)); got != want {
+			t.Errorf("Allows(%v) = %v, want %v", s, got, want)
+		}
+	}
+
+	denyOnly := ACL{Deny: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+	if !denyOnly.Allows(netip.MustParseAddr("192.0.2.1")) || denyOnly.Allows(netip.MustParseAddr("10.1.0.1")) {
+		t.Errorf("an ACL with only deny entries should allow everyone else")
+	}
+	if !(ACL{}).Allows(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("an empty ACL should allow everyone")
+	}
+}
+
+func TestReadPrefixes(t *testing.T) {
+	prefixes, err := ReadPrefixes(strings.NewReader(`# banned ranges
+
+10.0.0.0/8
+  192.0.2.1   # a single address
+::ffff:198.51.100.0/120
+	# indented comment
+`))
+	if err != nil {
+		t.Fatalf("ReadPrefixes: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "198.51.100.0/24"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("ReadPrefixes = %v, want %v", prefixes, want)
+	}
+	for i, prefix := range prefixes {
+		if prefix.String() != want[i] {
+			t.Errorf("entry %d = %v, want %v", i, prefix, want[i])
+		}
+	}
+
+	_, err = ReadPrefixes(strings.NewReader("10.0.0.0/8\n\nnot an address\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("ReadPrefixes error = %v, want one naming line 3", err)
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ban is a client IP the proxy refuses new connections from.
+type Ban struct {
+	Addr  netip.Addr
+	Since time.Time
+	// Until is when the ban expires, zero if it does not
+	Until time.Time
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && now.After(b.Until)
+}
+
+// outlasts reports whether b is in force for longer than other
+func (b Ban) outlasts(other Ban, now time.Time) bool {
+	switch {
+	case b.expired(now):
+		return false
+	case b.Until.IsZero():
+		return true
+	}
+	return !other.Until.IsZero() && b.Until.After(other.Until)
+}
+
+// banList holds the IPs banned at runtime. Unlike the ACL, it is kept when
+// the proxy is reconfigured. It is safe for concurrent use.
+type banList struct {
+	mu    sync.RWMutex
+	addrs map[netip.Addr]Ban
+}
+
+func newBanList() *banList {
+	return &banList{addrs: map[netip.Addr]Ban{}}
+}
+
+func (b *banList) banned(addr netip.Addr) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ban, ok := b.addrs[addr.Unmap()]
+	return ok && !ban.expired(time.Now())
+}
+
+// expire forgets the bans that have expired
+func (b *banList) expire(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for addr, ban := range b.addrs {
+		if ban.expired(now) {
+			delete(b.addrs, addr)
+			log.Infof("ban of %v expired", addr)
+		}
+	}
+}
+
+// Ban refuses new connections from a client IP and disconnects its existing
+// ones, returning how many were disconnected.
+func (p *Proxy) Ban(addr netip.Addr) int {
+	if !p.running.Load() {
+		return 0
+	}
+	return p.banFor(addr, 0)
+}
+
+// banFor bans a client IP for a duration, or for good if it is zero, and
+// disconnects its existing connections. A longer ban in place is kept.
+func (p *Proxy) banFor(addr netip.Addr, duration time.Duration) int {
+	addr = addr.Unmap()
+	now := time.Now()
+	ban := Ban{Addr: addr, Since: now}
+	if duration > 0 {
+		ban.Until = now.Add(duration)
+	}
+
+	p.bans.mu.Lock()
+	if current, ok := p.bans.addrs[addr]; !ok || !current.outlasts(ban, now) {
+		p.bans.addrs[addr] = ban
+	}
+	p.bans.mu.Unlock()
+
+	conns := p.sessions(0, addr)
+	log.Infof("banned %v, disconnecting %d proxy connections", addr, len(conns))
+	for _, pConn := range conns {
+		pConn.disconnect("client banned")
+	}
+	return len(conns)
+}
+
+// Unban lets a banned client IP connect again, reporting whether it was
+// banned.
+func (p *Proxy) Unban(addr netip.Addr) bool {
+	if !p.running.Load() {
+		return false
+	}
+	p.bans.mu.Lock()
+	defer p.bans.mu.Unlock()
+
+	addr = addr.Unmap()
+	ban, ok := p.bans.addrs[addr]
+	if ok {
+		delete(p.bans.addrs, addr)
+		log.Infof("unbanned %v", addr)
+	}
+	return ok && !ban.expired(time.Now())
+}
+
+// Bans returns the banned client IPs, oldest first.
+func (p *Proxy) Bans() []Ban {
+	bans := []Ban{}
+	if !p.running.Load() {
+		return bans
+	}
+	now := time.Now()
+	p.bans.mu.RLock()
+	for _, ban := range p.bans.addrs {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	p.bans.mu.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].Since.Equal(bans[j].Since) {
+			return bans[i].Since.Before(bans[j].Since)
+		}
+		return bans[i].Addr.Less(bans[j].Addr)
+	})
+	return bans
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/pcapng"
+)
+
+// Interfaces of a capture file, one per leg of the proxy connections
+const (
+	captureInterfaceClient = iota
+	captureInterfaceUpstream
+)
+
+var captureInterfaces = []pcapng.Interface{
+	captureInterfaceClient: {
+		Name:        "client",
+		Description: "Between clients and the proxy's listen ports",
+		LinkType:    pcapng.LinkTypeRaw,
+	},
+	captureInterfaceUpstream: {
+		Name:        "upstream",
+		Description: "Between the proxy and the upstream servers",
+		LinkType:    pcapng.LinkTypeRaw,
+	},
+}
+
+// CaptureFilter selects the proxy connections a capture records. Zero values
+// match any connection.
+type CaptureFilter struct {
+	ListenPort int
+	Client     netip.Addr
+	ClientPort uint16
+}
+
+func (f CaptureFilter) matches(pConn *proxyConnection) bool {
+	switch {
+	case f.ListenPort != 0 && f.ListenPort != pConn.opts.listenPort:
+		return false
+	case f.Client.IsValid() && f.Client.Unmap() != pConn.clientAddrPort.Addr():
+		return false
+	case f.ClientPort != 0 && f.ClientPort != pConn.clientAddrPort.Port():
+		return false
+	}
+	return true
+}
+
+// CaptureStatus describes a running capture.
+type CaptureStatus struct {
+	ID      int
+	Path    string
+	Filter  CaptureFilter
+	Started time.Time
+	Packets uint64
+}
+
+type capture struct {
+	id      int
+	path    string
+	filter  CaptureFilter
+	started time.Time
+	packets atomic.Uint64
+
+	file   *os.File
+	writer *pcapng.Writer
+}
+
+func (c *capture) status() CaptureStatus {
+	return CaptureStatus{ID: c.id, Path: c.path, Filter: c.filter, Started: c.started, Packets: c.packets.Load()}
+}
+
+// captureSet holds the running captures. Proxy connections read the current
+// set for every payload, so it is replaced rather than modified.
+type captureSet struct {
+	mu     sync.Mutex
+	nextID int
+	active atomic.Pointer[[]*capture]
+}
+
+func (s *captureSet) current() []*capture {
+	if s == nil {
+		return nil
+	}
+	if active := s.active.Load(); active != nil {
+		return *active
+	}
+	return nil
+}
+
+// StartCapture starts writing the payloads of the proxy connections matching
+// filter, on both legs, to a new pcapng file in the capture directory.
+// Connections that start later are captured too.
+func (p *Proxy) StartCapture(filter CaptureFilter) (CaptureStatus, error) {
+	if !p.running.Load() {
+		return CaptureStatus{}, fmt.Errorf("unable to start capture: proxy not running")
+	}
+	if p.CaptureDir == "" {
+		return CaptureStatus{}, fmt.Errorf("unable to start capture: no capture directory configured")
+	}
+
+	s := p.captures
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	c := &capture{id: s.nextID, filter: filter, started: time.Now()}
+	c.path = filepath.Join(p.CaptureDir, fmt.Sprintf("raknet-proxy-%s-%d.pcapng", c.started.Format("20060102-150405"), c.id))
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return CaptureStatus{}, fmt.Errorf("unable to create capture file: %w", err)
+	}
+	writer, err := pcapng.NewWriter(file, "raknet-proxy", captureInterfaces)
+	if err != nil {
+		file.Close()
+		return CaptureStatus{}, err
+	}
+	c.file, c.writer = file, writer
+
+	active := append(append([]*capture{}, s.current()...), c)
+	s.active.Store(&active)
+	log.Infof("capturing to %v", c.path)
+	return c.status(), nil
+}
+
+// StopCapture stops a capture and closes its file, reporting whether it was
+// running.
+func (p *Proxy) StopCapture(id int) (CaptureStatus, bool) {
+	if !p.running.Load() {
+		return CaptureStatus{}, false
+	}
+	s := p.captures
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active := []*capture{}
+	var stopped *capture
+	for _, c := range s.current() {
+		if c.id == id {
+			stopped = c
+		} else {
+			active = append(active, c)
+		}
+	}
+	if stopped == nil {
+		return CaptureStatus{}, false
+	}
+	s.active.Store(&active)
+	stopped.close()
+	return stopped.status(), true
+}
+
+// Captures returns the running captures.
+func (p *Proxy) Captures() []CaptureStatus {
+	statuses := []CaptureStatus{}
+	if !p.running.Load() {
+		return statuses
+	}
+	for _, c := range p.captures.current() {
+		statuses = append(statuses, c.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// stopCaptures stops every capture, when the proxy stops
+func (p *Proxy) stopCaptures() {
+	for _, c := range p.Captures() {
+		p.StopCapture(c.ID)
+	}
+}
+
+// close flushes and closes the capture file. Payloads being written
+// concurrently may be lost.
+func (c *capture) close() {
+	if err := c.writer.Flush(); err != nil {
+		log.Errorf("unable to write capture %v: %v", c.path, err)
+	}
+	if err := c.file.Close(); err != nil {
+		log.Errorf("unable to close capture %v: %v", c.path, err)
+	}
+	log.Infof("stopped capture to %v, %d packets", c.path, c.packets.Load())
+}
+
+// capture records a payload on one leg of the connection, between the peer
+// on that leg and the proxy's local address, in every matching capture.
+func (pConn *proxyConnection) capture(iface int, peer, local net.Addr, fromPeer bool, payload UDPPayload) {
+	captures := pConn.opts.captures.current()
+	if len(captures) == 0 {
+		return
+	}
+
+	var packet []byte
+	now := time.Now()
+	for _, c := range captures {
+		if !c.filter.matches(pConn) {
+			continue
+		}
+		if packet == nil {
+			packet = capturePacket(peer, local, fromPeer, payload)
+		}
+		if err := c.writer.WritePacket(iface, now, packet, ""); err != nil {
+			pConn.logf(log.Debugf, "unable to capture payload to %v: %v", c.path, err)
+			continue
+		}
+		c.packets.Add(1)
+	}
+}
+
+// capturePacket wraps a payload in IP and UDP headers. Wireshark only
+// dissects packets whose addresses are of the same family, so if the proxy's
+// address is of the other family, it is replaced with the unspecified address
+// of the peer's.
+func capturePacket(peer, local net.Addr, fromPeer bool, payload UDPPayload) []byte {
+	peerAddrPort, localAddrPort := udpAddrPort(peer), udpAddrPort(local)
+	if peerAddrPort.Addr().Is4() != localAddrPort.Addr().Is4() {
+		unspecified := netip.IPv6Unspecified()
+		if peerAddrPort.Addr().Is4() {
+			unspecified = netip.IPv4Unspecified()
+		}
+		localAddrPort = netip.AddrPortFrom(unspecified, localAddrPort.Port())
+	}
+
+	if fromPeer {
+		return pcapng.UDPPacket(peerAddrPort, localAddrPort, payload)
+	}
+	return pcapng.UDPPacket(localAddrPort, peerAddrPort, payload)
+}
+
+func udpAddrPort(addr net.Addr) netip.AddrPort {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr == nil {
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	return unmapAddrPort(udpAddr.AddrPort())
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/pcapng"
+	"github.com/percygrunwald/raknet-proxy/lib/proxyproto"
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// capturedPackets returns the interface and data of each Enhanced Packet
+// Block in a pcapng capture
+func capturedPackets(t *testing.T, b []byte) (ifaces []int, packets [][]byte) {
+	t.Helper()
+	for len(b) >= 12 {
+		blockType, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if length < 12 || int(length) > len(b) {
+			t.Fatalf("block of type %#x has length %d, with %d bytes left", blockType, length, len(b))
+		}
+		if blockType == 6 {
+			body := b[8:]
+			capLen := binary.LittleEndian.Uint32(body[12:])
+			ifaces = append(ifaces, int(binary.LittleEndian.Uint32(body)))
+			packets = append(packets, body[20:20+capLen])
+		}
+		b = b[length:]
+	}
+	return ifaces, packets
+}
+
+func TestCaptureLeavesOutProxyProtocolHeader(t *testing.T) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer sink.Close()
+	serverConn, err := net.DialUDP("udp", nil, sink.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer serverConn.Close()
+
+	buf := &bytes.Buffer{}
+	writer, err := pcapng.NewWriter(buf, "test", captureInterfaces)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	captures := &captureSet{}
+	captures.active.Store(&[]*capture{{writer: writer}})
+
+	client := netip.MustParseAddrPort("198.51.100.7:51234")
+	pConn := &proxyConnection{
+		clientAddr:        net.UDPAddrFromAddrPort(client),
+		clientAddrPort:    client,
+		proxyAsServerAddr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:19132")),
+		proxyAsClientAddr: serverConn.LocalAddr(),
+		serverAddr:        sink.LocalAddr().(*net.UDPAddr),
+		serverConn:        serverConn,
+		opts:              sessionOptions{proxyProtocol: ProxyProtocolEvery, captures: captures},
+	}
+	pConn.proxyHeader = pConn.proxyProtocolHeader()
+
+	payload := (&raknet.OpenConnectionRequest1{Protocol: 11, MTU: 576}).Append(nil)
+	if _, err := pConn.writeToServer(payload); err != nil {
+		t.Fatalf("writeToServer: %v", err)
+	}
+
+	// The upstream gets the header, the capture only the RakNet payload
+	sink.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, MaxUDPSize)
+	n, _, err := sink.ReadFromUDP(b)
+	if err != nil {
+		t.Fatalf("upstream received nothing: %v", err)
+	}
+	if _, rest, err := proxyproto.Decode(b[:n]); err != nil || !bytes.Equal(rest, payload) {
+		t.Errorf("upstream received % x, want a PROXY protocol header and % x (%v)", b[:n], payload, err)
+	}
+
+	writer.Flush()
+	ifaces, packets := capturedPackets(t, buf.Bytes())
+	if len(packets) != 1 || ifaces[0] != captureInterfaceUpstream {
+		t.Fatalf("captured %d packets on interfaces %v, want 1 on the upstream interface", len(packets), ifaces)
+	}
+	// Past the synthetic IPv4 and UDP headers
+	if captured := packets[0][28:]; !bytes.Equal(captured, payload) {
+		t.Errorf("captured % x, want % x", captured, payload)
+	}
+}
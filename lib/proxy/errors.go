@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxConsecutiveErrors is the number of transient errors in a row after which
+// a connection is considered broken and torn down
+const maxConsecutiveErrors uint32 = 100
+
+// errorClass groups socket errors by how the proxy reacts to them
+type errorClass int
+
+const (
+	// errorTransient may go away on its own, e.g. a full socket buffer
+	errorTransient errorClass = iota
+	// errorClosed means the socket was closed, nothing more can be done on it
+	errorClosed
+	// errorUpstreamUnreachable means the upstream server answered with an
+	// ICMP port unreachable, i.e. nothing is listening any more
+	errorUpstreamUnreachable
+	errorClassCount
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorClosed:
+		return "closed"
+	case errorUpstreamUnreachable:
+		return "upstream unreachable"
+	default:
+		return "transient"
+	}
+}
+
+func classifyError(err error) errorClass {
+	switch {
+	case errors.Is(err, net.ErrClosed):
+		return errorClosed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorUpstreamUnreachable
+	default:
+		return errorTransient
+	}
+}
+
+// isShutdownError reports whether err is the result of the connection's own
+// sockets being closed or unblocked on purpose
+func isShutdownError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// handleError counts a socket error against the connection and tears the
+// connection down if the error is fatal. It reports whether the connection
+// is still usable.
+func (pConn *proxyConnection) handleError(op string, err error) bool {
+	class := classifyError(err)
+	pConn.errorCounts[class].Add(1)
+	pConn.opts.metrics.socketError(class)
+
+	switch class {
+	case errorClosed:
+		pConn.logf(log.Debugf, "%s: %v", op, err)
+		pConn.close("socket closed")
+		return false
+	case errorUpstreamUnreachable:
+		pConn.logf(log.Warnf, "%s: upstream %v unreachable: %v", op, pConn.serverAddr, err)
+		pConn.sendDisconnectNotification(FromServer)
+		pConn.close("upstream unreachable")
+		return false
+	}
+
+	consecutive := pConn.consecutiveErrors.Add(1)
+	pConn.logf(log.Debugf, "%s (%d in a row): %v", op, consecutive, err)
+	if consecutive >= maxConsecutiveErrors {
+		pConn.logf(log.Warnf, "%s: giving up after %d errors in a row: %v", op, consecutive, err)
+		pConn.sendDisconnectNotifications()
+		pConn.close("too many errors")
+		return false
+	}
+	return true
+}
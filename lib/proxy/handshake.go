@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// cookiePeriod is how often the cookies handed to clients change. A cookie is
+// accepted in the period it was handed out and the next one.
+const cookiePeriod = 10 * time.Second
+
+// cookieJar hands out and checks the cookies of routes with handshake cookies.
+// A cookie is a MAC of the client's address and protocol version, so no state
+// is kept for clients until they return one: 24 bits of MAC, followed by the
+// protocol version, which the proxy needs to start the handshake with the
+// upstream.
+type cookieJar struct {
+	key []byte
+}
+
+func newCookieJar() (*cookieJar, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("unable to generate handshake cookie key: %w", err)
+	}
+	return &cookieJar{key: key}, nil
+}
+
+func (j *cookieJar) cookie(client netip.AddrPort, protocol byte, now time.Time) uint32 {
+	return j.mac(client, protocol, now.Unix()/int64(cookiePeriod.Seconds()))<<8 | uint32(protocol)
+}
+
+// verify checks a cookie returned by a client, returning the protocol version
+// it was handed out for.
+func (j *cookieJar) verify(client netip.AddrPort, cookie uint32, now time.Time) (byte, bool) {
+	protocol := byte(cookie)
+	period := now.Unix() / int64(cookiePeriod.Seconds())
+	for _, p := range []int64{period, period - 1} {
+		if subtle.ConstantTimeEq(int32(j.mac(client, protocol, p)), int32(cookie>>8)) == 1 {
+			return protocol, true
+		}
+	}
+	return 0, false
+}
+
+func (j *cookieJar) mac(client netip.AddrPort, protocol byte, period int64) uint32 {
+	addr := client.Addr().Unmap().As16()
+	b := binary.BigEndian.AppendUint64(nil, uint64(period))
+	b = append(b, addr[:]...)
+	b = binary.BigEndian.AppendUint16(b, client.Port())
+	b = append(b, protocol)
+
+	h := hmac.New(sha256.New, j.key)
+	h.Write(b)
+	sum := h.Sum(nil)
+	return uint32(sum[0])<<16 | uint32(sum[1])<<8 | uint32(sum[2])
+}
+
+// verifyRequest2 decodes an OpenConnectionRequest2 and checks its cookie,
+// returning the request and the client's protocol version.
+func (j *cookieJar) verifyRequest2(client netip.AddrPort, payload UDPPayload) (*raknet.OpenConnectionRequest2, byte, error) {
+	m, err := raknet.DecodeOfflineMessage(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	request := m.(*raknet.OpenConnectionRequest2)
+	if !request.HasCookie {
+		return nil, 0, fmt.Errorf("no cookie in OpenConnectionRequest2")
+	}
+	protocol, ok := j.verify(client, request.Cookie, time.Now())
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid cookie %08x in OpenConnectionRequest2", request.Cookie)
+	}
+	return request, protocol, nil
+}
+
+// verifyHandshake reports whether a client without a proxy connection may
+// start one. On routes with handshake cookies, the client must first prove
+// that it receives what is sent to its address, by returning the cookie from
+// the proxy's OpenConnectionReply1 in its OpenConnectionRequest2. Until then
+// no upstream socket is opened, and its other payloads are dropped.
+func (l *listener) verifyHandshake(clientAddr *net.UDPAddr, payload UDPPayload, settings *settings) bool {
+	cookies := settings.opts.cookies
+	if cookies == nil {
+		return true
+	}
+	if l.answerRequest1(clientAddr, payload, settings.opts) {
+		return false
+	}
+	if len(payload) == 0 || payload[0] != raknet.IDOpenConnectionRequest2 {
+		log.Tracef("client %v has not completed the handshake, dropping payload", clientAddr)
+		settings.opts.metrics.drop(dropHandshake)
+		return false
+	}
+	if _, _, err := cookies.verifyRequest2(unmapAddrPort(clientAddr.AddrPort()), payload); err != nil {
+		log.Debugf("dropping handshake from %v: %v", clientAddr, err)
+		settings.opts.metrics.drop(dropInvalidCookie)
+		return false
+	}
+	return true
+}
+
+// answerRequest1 answers an OpenConnectionRequest1 with a cookie, on routes
+// with handshake cookies. It reports whether the payload was such a request,
+// dealt with.
+func (l *listener) answerRequest1(clientAddr *net.UDPAddr, payload UDPPayload, opts sessionOptions) bool {
+	if opts.cookies == nil || len(payload) == 0 || payload[0] != raknet.IDOpenConnectionRequest1 {
+		return false
+	}
+	m, err := raknet.DecodeOfflineMessage(payload)
+	if err != nil {
+		log.Tracef("dropping invalid OpenConnectionRequest1 from %v: %v", clientAddr, err)
+		opts.metrics.drop(dropHandshake)
+		return true
+	}
+
+	request := m.(*raknet.OpenConnectionRequest1)
+	reply := &raknet.OpenConnectionReply1{
+		ServerGUID: l.serverGUID(),
+		Security:   true,
+		Cookie:     opts.cookies.cookie(unmapAddrPort(clientAddr.AddrPort()), request.Protocol, time.Now()),
+		MTU:        request.MTU,
+	}
+	if _, err := l.conn.WriteToUDP(reply.Append(nil), clientAddr); err != nil {
+		log.Debugf("unable to answer OpenConnectionRequest1 from %v: %v", clientAddr, err)
+		return true
+	}
+	opts.metrics.cookiesSent.Inc()
+	return true
+}
+
+// serverGUID returns the GUID the listener answers handshakes with: the one
+// it advertises in its pongs if it caches them, or one of its own
+func (l *listener) serverGUID() uint64 {
+	if guid := l.settings.Load().route.PongCache.Rewrite.ServerGUID; guid != 0 {
+		return guid
+	}
+	if cached := l.pong.Load(); cached != nil {
+		return cached.pong.ServerGUID
+	}
+	return l.guid
+}
+
+// upstreamHandshake is the proxy's side of the handshake with the upstream,
+// on routes with handshake cookies. The upstream never saw the client's
+// OpenConnectionRequest1, so the proxy sends its own once the client's
+// OpenConnectionRequest2 arrives, holding that until the upstream's reply.
+type upstreamHandshake struct {
+	mu sync.Mutex
+	// request2 is the client's request, awaiting the upstream's reply
+	request2 *raknet.OpenConnectionRequest2
+	// reply1 is the upstream's reply, once received
+	reply1 *raknet.OpenConnectionReply1
+}
+
+// forwardRequest2 sends the client's OpenConnectionRequest2 to the upstream,
+// without the proxy's cookie, first starting the handshake with the upstream
+// if it has not replied yet.
+func (pConn *proxyConnection) forwardRequest2(payload UDPPayload) (int, error) {
+	request, protocol, err := pConn.opts.cookies.verifyRequest2(pConn.clientAddrPort, payload)
+	if err != nil {
+		pConn.logf(log.Debugf, "dropping handshake from client: %v", err)
+		pConn.opts.metrics.drop(dropInvalidCookie)
+		return 0, nil
+	}
+	if pConn.opts.rewriteAddresses {
+		serverAddrPort := unmapAddrPort(pConn.serverAddr.AddrPort())
+		pConn.logf(log.Tracef, "rewriting server address %v->%v", request.ServerAddress, serverAddrPort)
+		request.ServerAddress = serverAddrPort
+	}
+
+	h := &pConn.handshake
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reply1 != nil {
+		return pConn.writeToServer(request2For(request, h.reply1))
+	}
+	h.request2 = request
+	pConn.logf(log.Tracef, "starting handshake with server, protocol %d, MTU %d", protocol, request.MTU)
+	request1 := &raknet.OpenConnectionRequest1{Protocol: protocol, MTU: request.MTU}
+	pConn.trimRequest1(request1)
+	return pConn.writeToServer(request1.Append(nil))
+}
+
+// completeRequest1 takes the upstream's OpenConnectionReply1, which the
+// client has no use for, and sends it the client's OpenConnectionRequest2.
+func (pConn *proxyConnection) completeRequest1(payload UDPPayload) (int, error) {
+	m, err := raknet.DecodeOfflineMessage(payload)
+	if err != nil {
+		pConn.logf(log.Debugf, "dropping OpenConnectionReply1 from server: %v", err)
+		return 0, nil
+	}
+
+	h := &pConn.handshake
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reply1 = m.(*raknet.OpenConnectionReply1)
+	request := h.request2
+	if request == nil {
+		return 0, nil
+	}
+	h.request2 = nil
+	return pConn.writeToServer(request2For(request, h.reply1))
+}
+
+// request2For encodes the client's OpenConnectionRequest2 for the upstream,
+// with the upstream's cookie if it asked for one
+func request2For(request *raknet.OpenConnectionRequest2, reply *raknet.OpenConnectionReply1) UDPPayload {
+	r := *request
+	r.HasCookie, r.Cookie = reply.Security, reply.Cookie
+	if reply.MTU > 0 {
+		r.MTU = min(r.MTU, reply.MTU)
+	}
+	return r.Append(nil)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar, err := newCookieJar()
+	if err != nil {
+		t.Fatalf("newCookieJar: %v", err)
+	}
+	client := netip.MustParseAddrPort("203.0.113.7:51234")
+	// At the start of a period, so that the next period starts a period later
+	now := time.Unix(1000*int64(cookiePeriod.Seconds()), 0)
+	cookie := jar.cookie(client, 11, now)
+
+	tests := []struct {
+		name   string
+		client netip.AddrPort
+		cookie uint32
+		now    time.Time
+		ok     bool
+	}{
+		{"valid", client, cookie, now, true},
+		{"valid later in the period", client, cookie, now.Add(cookiePeriod - time.Second), true},
+		{"valid in the next period", client, cookie, now.Add(cookiePeriod), true},
+		{"valid from the IPv4-mapped address", netip.MustParseAddrPort("[::ffff:203.0.113.7]:51234"), cookie, now, true},
+		{"expired", client, cookie, now.Add(2 * cookiePeriod), false},
+		{"from before it was handed out", client, cookie, now.Add(-cookiePeriod), false},
+		{"from another address", netip.MustParseAddrPort("203.0.113.8:51234"), cookie, now, false},
+		{"from another port", netip.MustParseAddrPort("203.0.113.7:51235"), cookie, now, false},
+		{"bad protocol byte", client, cookie ^ 0x01, now, false},
+		{"bad MAC", client, cookie ^ 0x0100, now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocol, ok := jar.verify(tt.client, tt.cookie, tt.now)
+			if ok != tt.ok {
+				t.Fatalf("verify(%s, %08x) = %v, want %v", tt.client, tt.cookie, ok, tt.ok)
+			}
+			if ok && protocol != 11 {
+				t.Errorf("verify returned protocol %d, want 11", protocol)
+			}
+		})
+	}
+
+	other, err := newCookieJar()
+	if err != nil {
+		t.Fatalf("newCookieJar: %v", err)
+	}
+	if _, ok := other.verify(client, cookie, now); ok {
+		t.Errorf("cookie accepted by a jar with another key")
+	}
+}
+
+func TestCookieJarVerifyRequest2(t *testing.T) {
+	jar, err := newCookieJar()
+	if err != nil {
+		t.Fatalf("newCookieJar: %v", err)
+	}
+	client := netip.MustParseAddrPort("203.0.113.7:51234")
+	request := &raknet.OpenConnectionRequest2{ServerAddress: netip.MustParseAddrPort("192.0.2.1:19132"), MTU: 1400, ClientGUID: 7}
+
+	if _, _, err := jar.verifyRequest2(client, request.Append(nil)); err == nil {
+		t.Errorf("verifyRequest2 without a cookie, want an error")
+	}
+
+	request.HasCookie, request.Cookie = true, jar.cookie(client, 11, time.Now())
+	got, protocol, err := jar.verifyRequest2(client, request.Append(nil))
+	if err != nil {
+		t.Fatalf("verifyRequest2: %v", err)
+	}
+	if protocol != 11 || got.ClientGUID != request.ClientGUID || got.MTU != request.MTU {
+		t.Errorf("verifyRequest2 = %+v, %d", got, protocol)
+	}
+
+	if _, _, err := jar.verifyRequest2(netip.MustParseAddrPort("203.0.113.8:51234"), request.Append(nil)); err == nil {
+		t.Errorf("verifyRequest2 from another address, want an error")
+	}
+}
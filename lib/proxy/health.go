@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// HealthCheck configures active health checking of upstreams with RakNet
+// unconnected pings. An upstream is marked down after Fall consecutive pings
+// go unanswered, and back up after Rise consecutive pongs.
+type HealthCheck struct {
+	// Interval between pings to each upstream. Zero disables health checks.
+	Interval time.Duration
+	// Timeout is how long to wait for a pong. Zero uses the default.
+	Timeout time.Duration
+	// Rise and Fall are the thresholds for marking an upstream up and down.
+	// Zero values use the defaults.
+	Rise int
+	Fall int
+}
+
+const (
+	DefaultHealthCheckTimeout = time.Second
+	DefaultHealthCheckRise    = 2
+	DefaultHealthCheckFall    = 3
+
+	// rttSmoothing is the weight of each new sample in the average RTT
+	rttSmoothing = 0.2
+)
+
+// upstreamHealth is the outcome of the health checks of an upstream
+type upstreamHealth struct {
+	mu sync.Mutex
+	// Consecutive successful and failed checks; one of them is always zero
+	successes int
+	failures  int
+
+	pings     uint64
+	pongs     uint64
+	lastRTT   time.Duration
+	avgRTT    time.Duration
+	lastCheck time.Time
+	lastError error
+}
+
+// UpstreamStatus is a snapshot of an upstream's state.
+type UpstreamStatus struct {
+	ListenPort int
+	Name       string
+	Address    string
+	Healthy    bool
+	Sessions   int64
+
+	// Health check results. Pings is zero if health checks are disabled.
+	Pings     uint64
+	Pongs     uint64
+	LastRTT   time.Duration
+	AvgRTT    time.Duration
+	LastCheck time.Time
+	LastError string
+}
+
+// Upstreams returns the state of every route's upstreams.
+func (p *Proxy) Upstreams() []UpstreamStatus {
+	if !p.running.Load() {
+		return nil
+	}
+	statuses := []UpstreamStatus{}
+	for _, l := range p.activeListeners() {
+		for _, u := range l.settings.Load().upstreams.upstreams {
+			statuses = append(statuses, u.status(l.route.ListenPort))
+		}
+	}
+	return statuses
+}
+
+func (u *upstream) status(listenPort int) UpstreamStatus {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+
+	status := UpstreamStatus{
+		ListenPort: listenPort,
+		Name:       u.name,
+		Address:    u.addr.String(),
+		Healthy:    u.healthy.Load(),
+		Sessions:   u.sessions.Load(),
+		Pings:      u.health.pings,
+		Pongs:      u.health.pongs,
+		LastRTT:    u.health.lastRTT,
+		AvgRTT:     u.health.avgRTT,
+		LastCheck:  u.health.lastCheck,
+	}
+	if u.health.lastError != nil {
+		status.LastError = u.health.lastError.Error()
+	}
+	return status
+}
+
+// checkUpstreams pings every upstream of every route each interval, until
+// ctx is cancelled.
+func (p *Proxy) checkUpstreams(ctx context.Context) {
+	hc := p.HealthCheck
+	hc.Timeout = p.healthCheckTimeout()
+	if hc.Rise == 0 {
+		hc.Rise = DefaultHealthCheckRise
+	}
+	if hc.Fall == 0 {
+		hc.Fall = DefaultHealthCheckFall
+	}
+
+	ticker := newTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkUpstreamsOnce(hc)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// healthCheckTimeout is how long to wait for a pong from an upstream
+func (p *Proxy) healthCheckTimeout() time.Duration {
+	if p.HealthCheck.Timeout == 0 {
+		return DefaultHealthCheckTimeout
+	}
+	return p.HealthCheck.Timeout
+}
+
+// checkUpstreamsOnce pings every upstream in parallel, waiting for the
+// results. Upstreams shared by several routes are pinged once.
+func (p *Proxy) checkUpstreamsOnce(hc HealthCheck) {
+	checked := map[*upstream]bool{}
+	wg := sync.WaitGroup{}
+	for _, l := range p.activeListeners() {
+		settings := l.settings.Load()
+		header := settings.opts.proxyProtocol.localHeader()
+		for _, u := range settings.upstreams.upstreams {
+			if checked[u] {
+				continue
+			}
+			checked[u] = true
+
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				_, rtt, err := pingUpstream(u.addr, header, hc.Timeout)
+				u.recordCheck(rtt, err, hc)
+			}(u)
+		}
+	}
+	wg.Wait()
+}
+
+// recordCheck updates the upstream's health with the result of a check,
+// marking it up or down once enough checks agree.
+func (u *upstream) recordCheck(rtt time.Duration, err error, hc HealthCheck) {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+
+	h := &u.health
+	h.pings++
+	h.lastCheck = time.Now()
+	h.lastError = err
+	if err != nil {
+		h.successes = 0
+		h.failures++
+		if h.failures == hc.Fall && u.healthy.Swap(false) {
+			log.Warnf("upstream %v is down: %d health checks failed, last: %v", u, h.failures, err)
+		}
+		return
+	}
+
+	h.pongs++
+	h.lastRTT = rtt
+	if h.avgRTT == 0 {
+		h.avgRTT = rtt
+	} else {
+		h.avgRTT = time.Duration(rttSmoothing*float64(rtt) + (1-rttSmoothing)*float64(h.avgRTT))
+	}
+	h.failures = 0
+	h.successes++
+	if h.successes == hc.Rise && !u.healthy.Swap(true) {
+		log.Infof("upstream %v is up: %d health checks passed, rtt %v", u, h.successes, rtt)
+	}
+}
+
+// pingUpstream sends an unconnected ping to addr from a fresh socket, after
+// the given PROXY protocol header if any, and waits for the matching pong.
+func pingUpstream(addr *net.UDPAddr, header []byte, timeout time.Duration) (*raknet.UnconnectedPong, time.Duration, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to dial upstream %v: %w", addr, err)
+	}
+	defer conn.Close()
+
+	sent := time.Now()
+	ping := &raknet.UnconnectedPing{SendTimestamp: uint64(sent.UnixMilli()), ClientGUID: rand.Uint64()}
+	if _, err := conn.Write(ping.Append(append([]byte{}, header...))); err != nil {
+		return nil, 0, fmt.Errorf("unable to ping upstream %v: %w", addr, err)
+	}
+	conn.SetReadDeadline(sent.Add(timeout))
+
+	b := make([]byte, MaxUDPSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, 0, fmt.Errorf("no pong from upstream %v: %w", addr, err)
+		}
+		msg, err := raknet.DecodeOfflineMessage(b[:n])
+		if pong, ok := msg.(*raknet.UnconnectedPong); ok && err == nil && pong.SendTimestamp == ping.SendTimestamp {
+			return pong, time.Since(sent), nil
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxyproto"
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// pongResponder answers unconnected pings on a local UDP socket while
+// answering is set, stripping PROXY protocol headers
+type pongResponder struct {
+	conn      *net.UDPConn
+	answering atomic.Bool
+	headers   atomic.Int32
+}
+
+func newPongResponder(t *testing.T) *pongResponder {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	r := &pongResponder{conn: conn}
+	r.answering.Store(true)
+	t.Cleanup(func() { conn.Close() })
+	go r.serve()
+	return r
+}
+
+func (r *pongResponder) serve() {
+	b := make([]byte, MaxUDPSize)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		payload := b[:n]
+		if proxyproto.HasHeader(payload) {
+			if _, payload, err = proxyproto.Decode(payload); err != nil {
+				continue
+			}
+			r.headers.Add(1)
+		}
+		msg, err := raknet.DecodeOfflineMessage(payload)
+		ping, ok := msg.(*raknet.UnconnectedPing)
+		if err != nil || !ok || !r.answering.Load() {
+			continue
+		}
+		pong := &raknet.UnconnectedPong{SendTimestamp: ping.SendTimestamp, ServerGUID: 42, Data: []byte("test")}
+		r.conn.WriteToUDP(pong.Append(nil), addr)
+	}
+}
+
+func (r *pongResponder) addr() *net.UDPAddr {
+	return r.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestPingUpstream(t *testing.T) {
+	r := newPongResponder(t)
+
+	pong, rtt, err := pingUpstream(r.addr(), nil, time.Second)
+	if err != nil {
+		t.Fatalf("pingUpstream: %v", err)
+	}
+	if pong.ServerGUID != 42 || string(pong.Data) != "test" || rtt <= 0 {
+		t.Errorf("pingUpstream = %+v, %v", pong, rtt)
+	}
+	if n := r.headers.Load(); n != 0 {
+		t.Errorf("responder saw %d PROXY protocol headers, want none", n)
+	}
+
+	if _, _, err := pingUpstream(r.addr(), ProxyProtocolEvery.localHeader(), time.Second); err != nil {
+		t.Fatalf("pingUpstream with a header: %v", err)
+	}
+	if n := r.headers.Load(); n != 1 {
+		t.Errorf("responder saw %d PROXY protocol headers, want 1", n)
+	}
+
+	r.answering.Store(false)
+	if pong, _, err := pingUpstream(r.addr(), nil, 50*time.Millisecond); err == nil {
+		t.Errorf("pingUpstream = %+v from a silent upstream, want an error", pong)
+	}
+}
+
+func TestRecordCheckRiseAndFall(t *testing.T) {
+	r := newPongResponder(t)
+	hc := HealthCheck{Timeout: 50 * time.Millisecond, Rise: 2, Fall: 3}
+	u := &upstream{name: "test", addr: r.addr(), upstreamState: newUpstreamState()}
+	check := func(want bool) {
+		t.Helper()
+		_, rtt, err := pingUpstream(u.addr, nil, hc.Timeout)
+		u.recordCheck(rtt, err, hc)
+		if got := u.healthy.Load(); got != want {
+			t.Fatalf("after check %d, healthy = %v, want %v (last error: %v)", u.health.pings, got, want, err)
+		}
+	}
+
+	r.answering.Store(false)
+	check(true)
+	check(true)
+	check(false)
+	check(false)
+
+	// A failure in the middle of a rise starts it over
+	r.answering.Store(true)
+	check(false)
+	r.answering.Store(false)
+	check(false)
+	r.answering.Store(true)
+	check(false)
+	check(true)
+	check(true)
+
+	status := u.status(0)
+	if status.Pings != 9 || status.Pongs != 4 || status.LastError != "" || status.AvgRTT <= 0 {
+		t.Errorf("status = %+v", status)
+	}
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RateLimits protect the proxy and its upstreams from floods. Zero values
+// disable each limit.
+type RateLimits struct {
+	// NewSessionsPerIP is the rate, per second, at which a client IP may
+	// start proxy connections, in bursts of up to NewSessionsBurst. The burst
+	// defaults to the rate, rounded up.
+	NewSessionsPerIP float64
+	NewSessionsBurst int
+
+	// MaxSessions caps the proxy connections open across all routes. Clients
+	// turned away by it are never banned, as it is not their doing.
+	MaxSessions int
+
+	// SessionPacketsPerSecond and SessionBytesPerSecond limit the payloads
+	// each client may send, in bursts of up to a second's worth. A burst
+	// always fits at least one payload of the largest size RakNet sends.
+	SessionPacketsPerSecond float64
+	SessionBytesPerSecond   float64
+
+	// Action is what happens to payloads over a limit
+	Action LimitAction
+	// BanDuration is how long LimitActionBan bans clients for
+	BanDuration time.Duration
+}
+
+// LimitAction is what happens to a client that goes over a rate limit
+type LimitAction string
+
+const (
+	// LimitActionDrop drops the payloads over the limit
+	LimitActionDrop LimitAction = "drop"
+	// LimitActionBan drops the payload, disconnects the client and bans its
+	// IP for the ban duration
+	LimitActionBan LimitAction = "ban"
+)
+
+var LimitActions = []LimitAction{LimitActionDrop, LimitActionBan}
+
+const (
+	DefaultLimitAction = LimitActionDrop
+	DefaultBanDuration = time.Minute
+
+	// limitsCleanupInterval is how often expired bans and the rate limits of
+	// clients that have gone quiet are forgotten
+	limitsCleanupInterval = time.Minute
+)
+
+// Drop reasons of the rate limits
+const (
+	dropMaxSessions       = "max_sessions"
+	dropNewSessionRate    = "new_session_rate"
+	dropSessionPacketRate = "session_packet_rate"
+	dropSessionByteRate   = "session_byte_rate"
+)
+
+// ParseLimitAction parses the name of a limit action. The empty string is the
+// default action.
+func ParseLimitAction(s string) (LimitAction, error) {
+	if s == "" {
+		return DefaultLimitAction, nil
+	}
+	for _, action := range LimitActions {
+		if string(action) == s {
+			return action, nil
+		}
+	}
+	return "", fmt.Errorf("unknown limit action %q, valid actions: %v", s, LimitActions)
+}
+
+func (l RateLimits) newSessionsBurst() float64 {
+	if l.NewSessionsBurst > 0 {
+		return float64(l.NewSessionsBurst)
+	}
+	return float64(int(l.NewSessionsPerIP + 0.999))
+}
+
+func (l RateLimits) banDuration() time.Duration {
+	if l.BanDuration == 0 {
+		return DefaultBanDuration
+	}
+	return l.BanDuration
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+// It is not safe for concurrent use.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens if there are enough, reporting whether there were
+func (b *tokenBucket) take(n, rate, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// ipLimiter limits the rate of new proxy connections from each client IP. It
+// is safe for concurrent use.
+type ipLimiter struct {
+	mu      sync.Mutex
+	buckets map[netip.Addr]*tokenBucket
+}
+
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{buckets: map[netip.Addr]*tokenBucket{}}
+}
+
+func (l *ipLimiter) allow(addr netip.Addr, limits RateLimits, now time.Time) bool {
+	if limits.NewSessionsPerIP == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	addr = addr.Unmap()
+	bucket, ok := l.buckets[addr]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.buckets[addr] = bucket
+	}
+	return bucket.take(1, limits.NewSessionsPerIP, limits.newSessionsBurst(), now)
+}
+
+// forgetIdle forgets the buckets that have not been used for a while, which
+// would be full by now anyway
+func (l *ipLimiter) forgetIdle(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for addr, bucket := range l.buckets {
+		if now.Sub(bucket.last) > limitsCleanupInterval {
+			delete(l.buckets, addr)
+		}
+	}
+}
+
+// cleanupLimits forgets expired bans and idle rate limits each cleanup
+// interval, until ctx is cancelled.
+func (p *Proxy) cleanupLimits(ctx context.Context) {
+	ticker := time.NewTicker(limitsCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			p.newSessions.forgetIdle(now)
+			p.bans.expire(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Proxy) sessionCount() int {
+	count := 0
+	for _, l := range p.activeListeners() {
+		count += l.sessions.len()
+	}
+	return count
+}
+
+// admitSession reports whether a client may start a new proxy connection
+// under the rate limits.
+func (l *listener) admitSession(clientAddr netip.AddrPort, settings *settings) bool {
+	limits := settings.opts.limits
+	if limits.MaxSessions > 0 && l.proxy.sessionCount() >= limits.MaxSessions {
+		log.Debugf("%d proxy connections open, turning away %v", limits.MaxSessions, clientAddr)
+		settings.opts.metrics.drop(dropMaxSessions)
+		return false
+	}
+	if !l.proxy.newSessions.allow(clientAddr.Addr(), limits, time.Now()) {
+		l.limitHit(clientAddr, settings.opts, dropNewSessionRate)
+		return false
+	}
+	return true
+}
+
+// withinRate reports whether a payload from the client is within the
+// session's rate limits. It is only called from the listener's goroutine.
+func (pConn *proxyConnection) withinRate(payload UDPPayload) (bool, string) {
+	limits := pConn.opts.limits
+	now := time.Now()
+	packetsBurst := max(limits.SessionPacketsPerSecond, 1)
+	if limits.SessionPacketsPerSecond > 0 && !pConn.packetBucket.take(1, limits.SessionPacketsPerSecond, packetsBurst, now) {
+		return false, dropSessionPacketRate
+	}
+	bytesBurst := max(limits.SessionBytesPerSecond, maxPayloadSize)
+	if limits.SessionBytesPerSecond > 0 && !pConn.byteBucket.take(float64(len(payload)), limits.SessionBytesPerSecond, bytesBurst, now) {
+		return false, dropSessionByteRate
+	}
+	return true, ""
+}
+
+// limitHit drops a payload over a rate limit, banning the client if the
+// limits say so
+func (l *listener) limitHit(clientAddr netip.AddrPort, opts sessionOptions, reason string) {
+	opts.metrics.drop(reason)
+	if opts.limits.Action != LimitActionBan {
+		log.Debugf("client %v over the %s limit, dropping payload", clientAddr, reason)
+		return
+	}
+	log.Warnf("client %v over the %s limit, banning it for %v", clientAddr, reason, opts.limits.banDuration())
+	l.proxy.banFor(clientAddr.Addr(), opts.limits.banDuration())
+}
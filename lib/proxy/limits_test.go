@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithinRateAllowsPayloadsLargerThanTheRate(t *testing.T) {
+	pConn := &proxyConnection{opts: sessionOptions{limits: RateLimits{SessionBytesPerSecond: 100, SessionPacketsPerSecond: 0.5}}}
+	payload := make(UDPPayload, maxPayloadSize)
+
+	if ok, reason := pConn.withinRate(payload); !ok {
+		t.Fatalf("first payload over the %s limit, want a burst of one full payload", reason)
+	}
+	if ok, _ := pConn.withinRate(payload); ok {
+		t.Errorf("second payload within the limits, want it dropped")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := tokenBucket{}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if !b.take(1, 1, 3, now) {
+			t.Fatalf("take %d failed within the burst", i+1)
+		}
+	}
+	if b.take(1, 1, 3, now) {
+		t.Errorf("take succeeded past the burst")
+	}
+	if !b.take(1, 1, 3, now.Add(time.Second)) {
+		t.Errorf("take failed after a second's refill")
+	}
+	if !b.take(3, 1, 3, now.Add(time.Hour)) || b.tokens != 0 {
+		t.Errorf("bucket refilled past the burst: %v tokens left", b.tokens)
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listener accepts clients on a route's port, with its own proxy
+// connections
+type listener struct {
+	proxy      *Proxy
+	route      Route
+	listenAddr *net.UDPAddr
+	conn       *net.UDPConn
+	sessions   *sessionTable
+
+	// settings are applied to new proxy connections, and are replaced when
+	// the proxy is reconfigured
+	settings atomic.Pointer[settings]
+
+	// pong is the last pong fetched from an upstream, if the route caches
+	// pongs
+	pong atomic.Pointer[cachedPong]
+	// guid is the GUID the listener answers handshakes with, if it has no
+	// pong to take one from
+	guid uint64
+}
+
+func newListener(p *Proxy, route Route, settings *settings) (*listener, error) {
+	// An unspecified listen address on the "udp" network gives a dual-stack
+	// socket, accepting both IPv4 and IPv6 clients
+	listenAddrString := fmt.Sprintf(":%d", route.ListenPort)
+	listenAddr, err := net.ResolveUDPAddr("udp", listenAddrString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve listen address %v: %w", listenAddrString, err)
+	}
+
+	conn, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start client listener on %v: %w", listenAddr, err)
+	}
+
+	log.Infof("Listening on %v, proxying to %v (%s)", listenAddr, settings.upstreams.upstreams, settings.upstreams.policy)
+	l := &listener{
+		proxy:      p,
+		route:      route,
+		listenAddr: listenAddr,
+		conn:       conn,
+		sessions:   newSessionTable(),
+		guid:       rand.Uint64(),
+	}
+	l.settings.Store(settings)
+	return l, nil
+}
+
+// serve reads payloads from clients and hands them to their proxy
+// connection until ctx is cancelled or the listener fails.
+func (l *listener) serve(ctx context.Context) error {
+	// Unblock the read loop on cancellation. The listener itself stays open
+	// so that disconnect notifications can still be sent to clients.
+	stop := context.AfterFunc(ctx, func() {
+		l.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	b := make([]byte, MaxUDPSize)
+	for {
+		n, clientAddr, err := l.conn.ReadFromUDP(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Infof("stopping listener on %v: %v", l.listenAddr, context.Cause(ctx))
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("client listener on %v closed: %w", l.listenAddr, err)
+			}
+			log.Debugf("error reading from UDP: %v", err)
+			continue
+		}
+		// Copy out of the read buffer, since the payload is handed off to another
+		// goroutine and the buffer is reused by the next read
+		payload := make(UDPPayload, n)
+		copy(payload, b[0:n])
+		log.Tracef(`read %v->%v: (%d)"%s"`, clientAddr, l.listenAddr, n, hex.EncodeToString(payload))
+
+		l.handlePayloadFromClient(clientAddr, payload)
+	}
+}
+
+func (l *listener) handlePayloadFromClient(clientAddr *net.UDPAddr, payload UDPPayload) {
+	// Check if existing conn exists for client
+	clientAddrPort := clientAddr.AddrPort()
+	pConn, ok := l.sessions.get(clientAddrPort)
+	if ok {
+		if !l.checkPayload(clientAddr, payload, pConn.opts) {
+			return
+		}
+		if within, reason := pConn.withinRate(payload); !within {
+			l.limitHit(pConn.clientAddrPort, pConn.opts, reason)
+			return
+		}
+		if l.answerRequest1(clientAddr, payload, pConn.opts) {
+			return
+		}
+	} else {
+		settings := l.settings.Load()
+		if !l.admit(clientAddr, payload, settings) {
+			return
+		}
+		log.Debugf("no proxy connection found for %v, starting...", clientAddr)
+
+		if pConn = l.startProxyConnection(clientAddr, settings); pConn == nil {
+			return
+		}
+	}
+	log.Tracef(`writing payload from client %v to chan <- "%s"`, clientAddr, hex.EncodeToString(payload))
+	pConn.enqueuePayloadFromClient(payload)
+}
+
+// admit reports whether a payload from a client without a proxy connection
+// should start one. Payloads that are rejected, or that the listener answers
+// itself, are not.
+func (l *listener) admit(clientAddr *net.UDPAddr, payload UDPPayload, settings *settings) bool {
+	clientAddrPort := unmapAddrPort(clientAddr.AddrPort())
+	if !settings.acl.Allows(clientAddrPort.Addr()) {
+		log.Tracef("client %v rejected by ACL, dropping payload", clientAddr)
+		settings.opts.metrics.drop(dropACL)
+		return false
+	}
+	if l.proxy.bans.banned(clientAddrPort.Addr()) {
+		log.Tracef("client %v is banned, dropping payload", clientAddr)
+		settings.opts.metrics.drop(dropBanned)
+		return false
+	}
+	if !l.checkPayload(clientAddr, payload, settings.opts) {
+		return false
+	}
+	if l.answerPing(clientAddr, payload) || !l.verifyHandshake(clientAddr, payload, settings) {
+		return false
+	}
+	return l.admitSession(clientAddrPort, settings)
+}
+
+// startProxyConnection creates a proxy connection for a new client, to an
+// upstream picked from the route's pool. It returns nil if no connection
+// could be made, in which case the client's payload is dropped.
+func (l *listener) startProxyConnection(clientAddr *net.UDPAddr, settings *settings) *proxyConnection {
+	clientAddrPort := clientAddr.AddrPort()
+	upstream, err := settings.upstreams.pick(clientAddrPort.Addr())
+	if err != nil {
+		log.Warnf("unable to start new proxy connection for %v, dropping payload: %v", clientAddr, err)
+		settings.opts.metrics.drop(dropNoUpstream)
+		return nil
+	}
+	pConn, err := newProxyConnection(l.conn, clientAddr, upstream, settings.proxyAddr, settings.opts, l.sessions.remove)
+	if err != nil {
+		log.Errorf("unable to start new proxy connection for %v, dropping payload: %v", clientAddr, err)
+		settings.opts.metrics.dialError(upstream)
+		settings.opts.metrics.drop(dropDialError)
+		return nil
+	}
+
+	l.sessions.add(clientAddrPort, pConn)
+	settings.opts.metrics.sessionsCreated.Inc()
+	log.Debugf("%d active proxy connections on %v", l.sessions.len(), l.listenAddr)
+	return pConn
+}
+
+// reapIdleConnections closes every proxy connection where one side has been
+// silent for longer than timeout.
+func (l *listener) reapIdleConnections(now time.Time, timeout time.Duration) {
+	for _, pConn := range l.sessions.all() {
+		if now.Sub(pConn.idleSince()) > timeout {
+			pConn.sendDisconnectNotifications()
+			pConn.close(fmt.Sprintf("idle for more than %v", timeout))
+		}
+	}
+}
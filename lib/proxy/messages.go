@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"net/netip"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// Direction is the side of the proxy a payload came from
+type Direction int
+
+const (
+	FromClient Direction = iota
+	FromServer
+)
+
+// other returns the opposite direction
+func (d Direction) other() Direction {
+	if d == FromClient {
+		return FromServer
+	}
+	return FromClient
+}
+
+func (d Direction) String() string {
+	if d == FromClient {
+		return "client"
+	}
+	return "server"
+}
+
+const (
+	DefaultMaxSplitCount   uint32 = 4096
+	DefaultMaxSplitPending int    = 64
+	DefaultMaxSplitBytes   int    = 16 * 1024 * 1024
+)
+
+// MessageHook is called with every complete connected message that passes
+// through the proxy, once split messages have been reassembled. The message
+// must not be modified or retained after the hook returns.
+type MessageHook func(client netip.AddrPort, direction Direction, message []byte)
+
+// inspectFrame passes a connected frame to the session's message hooks. Split
+// frames are buffered until their message is complete; the frame itself is
+// always forwarded untouched.
+func (pConn *proxyConnection) inspectFrame(direction Direction, f *raknet.Frame) {
+	message, err := pConn.reassemblers[direction].Add(f)
+	if err != nil {
+		pConn.logf(log.Debugf, "dropping split message from %v: %v", direction, err)
+		return
+	}
+	if message == nil {
+		return
+	}
+	if f.Split {
+		pConn.logf(log.Tracef, `reassembled split message %d from %v: (%d)"%s"`, f.SplitID, direction,
+			len(message.Body), hex.EncodeToString(message.Body))
+	}
+
+	pConn.measureRTT(direction, message.Body)
+	for _, hook := range pConn.opts.messageHooks {
+		hook(pConn.clientAddrPort, direction, message.Body)
+	}
+}
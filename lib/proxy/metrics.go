@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/metrics"
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// Reasons for dropping a payload from a client, as counted in the metrics
+const (
+	dropACL          = "acl"
+	dropBanned       = "banned"
+	dropNoUpstream   = "no_upstream"
+	dropDialError    = "dial_error"
+	dropClosed       = "closed"
+	dropInvalidPing  = "invalid_ping"
+	dropNoPongCached = "no_pong_cached"
+	// Handshake cookies
+	dropHandshake     = "handshake"
+	dropInvalidCookie = "invalid_cookie"
+)
+
+// proxyMetrics are the metrics of a proxy, labelled by route (the listen
+// port) and, for traffic, by the direction it came from
+type proxyMetrics struct {
+	sessionsCreated *metrics.CounterVec
+	sessionsClosed  *metrics.CounterVec
+	packets         *metrics.CounterVec
+	bytes           *metrics.CounterVec
+	packetIDs       *metrics.CounterVec
+	dropped         *metrics.CounterVec
+	dialErrors      *metrics.CounterVec
+	socketErrors    *metrics.CounterVec
+	pingsAnswered   *metrics.CounterVec
+	cookiesSent     *metrics.CounterVec
+	invalid         *metrics.CounterVec
+	rtt             *metrics.HistogramVec
+
+	mu     sync.Mutex
+	routes map[int]*routeMetrics
+}
+
+// routeMetrics are the metrics of one route, resolved up front so that the
+// packet paths need no label lookups
+type routeMetrics struct {
+	m     *proxyMetrics
+	route string
+
+	sessionsCreated *metrics.Counter
+	sessionsClosed  *metrics.Counter
+	pingsAnswered   *metrics.Counter
+	cookiesSent     *metrics.Counter
+	packets         [2]*metrics.Counter
+	bytes           [2]*metrics.Counter
+	// Counters by packet ID, created on first use so that only IDs that were
+	// seen are exported
+	packetIDs [2][256]atomic.Pointer[metrics.Counter]
+	rtt       [2]*metrics.Histogram
+}
+
+func newProxyMetrics(r *metrics.Registry, p *Proxy) *proxyMetrics {
+	m := &proxyMetrics{
+		sessionsCreated: r.NewCounterVec("raknet_proxy_sessions_created_total", "Proxy connections created.", "route"),
+		sessionsClosed:  r.NewCounterVec("raknet_proxy_sessions_closed_total", "Proxy connections closed.", "route"),
+		packets:         r.NewCounterVec("raknet_proxy_packets_total", "Payloads received, by the side they came from.", "route", "direction"),
+		bytes:           r.NewCounterVec("raknet_proxy_bytes_total", "Bytes received, by the side they came from.", "route", "direction"),
+		packetIDs:       r.NewCounterVec("raknet_proxy_packet_ids_total", "Payloads received, by their first byte: the offline message ID or datagram flags.", "route", "direction", "id"),
+		dropped:         r.NewCounterVec("raknet_proxy_dropped_payloads_total", "Payloads dropped instead of being proxied.", "route", "reason"),
+		dialErrors:      r.NewCounterVec("raknet_proxy_upstream_dial_errors_total", "Failures to open a socket to an upstream.", "route", "upstream"),
+		socketErrors:    r.NewCounterVec("raknet_proxy_socket_errors_total", "Errors reading or writing proxy connection sockets.", "route", "class"),
+		pingsAnswered:   r.NewCounterVec("raknet_proxy_pings_answered_total", "Unconnected pings answered from the pong cache.", "route"),
+		cookiesSent:     r.NewCounterVec("raknet_proxy_handshake_cookies_total", "OpenConnectionRequest1s answered with a cookie.", "route"),
+		invalid:         r.NewCounterVec("raknet_proxy_invalid_payloads_total", "Payloads from clients that are not valid RakNet, by what is wrong with them, whether or not they were dropped.", "route", "reason"),
+		rtt: r.NewHistogramVec("raknet_proxy_session_rtt_seconds", "Round trip times between the proxy and each side of its connections, timed from connected pings.",
+			metrics.ExponentialBuckets(0.001, 2, 12), "route", "peer"),
+		routes: map[int]*routeMetrics{},
+	}
+
+	r.NewGaugeFunc("raknet_proxy_sessions_active", "Proxy connections open.", []string{"route"}, p.collectSessions)
+	r.NewGaugeFunc("raknet_proxy_channel_backlog", "Payloads queued in proxy connections, by the side they came from.", []string{"route", "direction"}, p.collectBacklog)
+	r.NewGaugeFunc("raknet_proxy_upstream_healthy", "Whether an upstream is taking new sessions.", []string{"route", "upstream"}, p.collectUpstreams(func(u UpstreamStatus) float64 {
+		if u.Healthy {
+			return 1
+		}
+		return 0
+	}))
+	r.NewGaugeFunc("raknet_proxy_upstream_sessions", "Proxy connections to an upstream.", []string{"route", "upstream"}, p.collectUpstreams(func(u UpstreamStatus) float64 {
+		return float64(u.Sessions)
+	}))
+	r.NewGaugeFunc("raknet_proxy_upstream_ping_rtt_seconds", "Average round trip time of health check pings to an upstream.", []string{"route", "upstream"}, p.collectUpstreams(func(u UpstreamStatus) float64 {
+		return u.AvgRTT.Seconds()
+	}))
+	return m
+}
+
+// route returns the metrics for the route listening on port
+func (m *proxyMetrics) route(port int) *routeMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rm, ok := m.routes[port]; ok {
+		return rm
+	}
+
+	route := strconv.Itoa(port)
+	rm := &routeMetrics{
+		m:               m,
+		route:           route,
+		sessionsCreated: m.sessionsCreated.With(route),
+		sessionsClosed:  m.sessionsClosed.With(route),
+		pingsAnswered:   m.pingsAnswered.With(route),
+		cookiesSent:     m.cookiesSent.With(route),
+	}
+	for _, d := range []Direction{FromClient, FromServer} {
+		rm.packets[d] = m.packets.With(route, d.String())
+		rm.bytes[d] = m.bytes.With(route, d.String())
+		rm.rtt[d] = m.rtt.With(route, d.String())
+	}
+	m.routes[port] = rm
+	return rm
+}
+
+// received counts a payload from one side of a connection
+func (rm *routeMetrics) received(direction Direction, payload UDPPayload) {
+	rm.packets[direction].Inc()
+	rm.bytes[direction].Add(uint64(len(payload)))
+	if len(payload) == 0 {
+		return
+	}
+
+	id := payload[0]
+	counter := rm.packetIDs[direction][id].Load()
+	if counter == nil {
+		counter = rm.m.packetIDs.With(rm.route, direction.String(), fmt.Sprintf("0x%02x", id))
+		rm.packetIDs[direction][id].Store(counter)
+	}
+	counter.Inc()
+}
+
+func (rm *routeMetrics) drop(reason string) {
+	rm.m.dropped.With(rm.route, reason).Inc()
+}
+
+func (rm *routeMetrics) invalid(reason string) {
+	rm.m.invalid.With(rm.route, reason).Inc()
+}
+
+func (rm *routeMetrics) dialError(u *upstream) {
+	rm.m.dialErrors.With(rm.route, u.name).Inc()
+}
+
+func (rm *routeMetrics) socketError(class errorClass) {
+	rm.m.socketErrors.With(rm.route, class.String()).Inc()
+}
+
+func (p *Proxy) collectSessions() []metrics.Sample {
+	samples := []metrics.Sample{}
+	if !p.running.Load() {
+		return samples
+	}
+	for _, l := range p.activeListeners() {
+		samples = append(samples, metrics.Sample{Labels: []string{strconv.Itoa(l.route.ListenPort)}, Value: float64(l.sessions.len())})
+	}
+	return samples
+}
+
+func (p *Proxy) collectBacklog() []metrics.Sample {
+	samples := []metrics.Sample{}
+	if !p.running.Load() {
+		return samples
+	}
+	for _, l := range p.activeListeners() {
+		backlog := [2]int{}
+		for _, pConn := range l.sessions.all() {
+			backlog[FromClient] += len(pConn.payloadsFromClientChan)
+			backlog[FromServer] += len(pConn.payloadsFromServerChan)
+		}
+		route := strconv.Itoa(l.route.ListenPort)
+		for _, d := range []Direction{FromClient, FromServer} {
+			samples = append(samples, metrics.Sample{Labels: []string{route, d.String()}, Value: float64(backlog[d])})
+		}
+	}
+	return samples
+}
+
+func (p *Proxy) collectUpstreams(value func(UpstreamStatus) float64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		for _, u := range p.Upstreams() {
+			samples = append(samples, metrics.Sample{Labels: []string{strconv.Itoa(u.ListenPort), u.Name}, Value: value(u)})
+		}
+		return samples
+	}
+}
+
+// pendingPing is a connected ping seen passing through, awaiting its pong
+type pendingPing struct {
+	pingTime uint64
+	seen     time.Time
+}
+
+// measureRTT times connected pings against the pongs answering them. A ping
+// from the server is answered by the client, timing the proxy's leg to the
+// client, and the other way around for pings from the client.
+func (pConn *proxyConnection) measureRTT(direction Direction, message []byte) {
+	if len(message) < 9 {
+		return
+	}
+	pingTime := binary.BigEndian.Uint64(message[1:9])
+
+	switch message[0] {
+	case raknet.IDConnectedPing:
+		pConn.pings[direction].Store(&pendingPing{pingTime: pingTime, seen: time.Now()})
+	case raknet.IDConnectedPong:
+		pending := &pConn.pings[direction.other()]
+		ping := pending.Load()
+		if ping == nil || ping.pingTime != pingTime || !pending.CompareAndSwap(ping, nil) {
+			return
+		}
+		rtt := time.Since(ping.seen)
+		pConn.rtt[direction].Store(int64(rtt))
+		pConn.opts.metrics.rtt[direction].Observe(rtt.Seconds())
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// PongCache makes a route answer unconnected pings itself, from a pong
+// fetched from an upstream in the background, rather than proxying every ping
+// through a new proxy connection.
+type PongCache struct {
+	// RefreshInterval is how often the pong is fetched from an upstream.
+	// Zero disables the cache.
+	RefreshInterval time.Duration
+
+	// Rewrite changes what the route advertises in its pongs
+	Rewrite PongRewrite
+}
+
+// PongRewrite changes a pong before it is sent to clients. Zero values leave
+// the upstream's pong as it is.
+//
+// ServerName, IPv4Port and IPv6Port replace fields of advertisements in the
+// semicolon-separated format used by Minecraft: Bedrock Edition servers,
+// "<edition>;<name>;<protocol>;<version>;<players>;<max players>;<guid>;
+// <sub name>;<game mode>;<game mode ID>;<IPv4 port>;<IPv6 port>;". Data
+// replaces the whole advertisement, whatever its format.
+type PongRewrite struct {
+	Data       string
+	ServerName string
+	IPv4Port   int
+	IPv6Port   int
+	// ServerGUID replaces the upstream's GUID, in the pong itself and in the
+	// advertisement
+	ServerGUID uint64
+}
+
+// Fields of a Bedrock-style pong advertisement
+const (
+	advertisementName     = 1
+	advertisementGUID     = 6
+	advertisementIPv4Port = 10
+	advertisementIPv6Port = 11
+)
+
+// pongMaxAgeIntervals is how many refresh intervals a cached pong is served
+// for without being refreshed. Past that, the upstreams are taken to be down
+// and pings go unanswered.
+const pongMaxAgeIntervals = 3
+
+type cachedPong struct {
+	pong    *raknet.UnconnectedPong
+	fetched time.Time
+}
+
+// refreshPong fetches a pong from one of the route's healthy upstreams each
+// refresh interval, until ctx is cancelled.
+func (l *listener) refreshPong(ctx context.Context, timeout time.Duration) {
+	interval := l.route.PongCache.RefreshInterval
+	ticker := newTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		l.refreshPongOnce(timeout)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *listener) refreshPongOnce(timeout time.Duration) {
+	settings := l.settings.Load()
+	upstream := settings.upstreams.firstHealthy()
+	if upstream == nil {
+		log.Debugf("no healthy upstream to refresh the pong on %v from", l.listenAddr)
+		return
+	}
+
+	pong, _, err := pingUpstream(upstream.addr, settings.opts.proxyProtocol.localHeader(), timeout)
+	if err != nil {
+		log.Debugf("unable to refresh the pong on %v: %v", l.listenAddr, err)
+		return
+	}
+	log.Tracef("refreshed the pong on %v from %v: %q", l.listenAddr, upstream, pong.Data)
+	l.pong.Store(&cachedPong{pong: pong, fetched: time.Now()})
+}
+
+// answerPing replies to an unconnected ping with the cached pong, if the
+// route caches pongs. It reports whether the payload was a ping that has been
+// dealt with, in which case no proxy connection is needed.
+func (l *listener) answerPing(clientAddr *net.UDPAddr, payload UDPPayload) bool {
+	if len(payload) == 0 || (payload[0] != raknet.IDUnconnectedPing && payload[0] != raknet.IDUnconnectedPingOpenConnections) {
+		return false
+	}
+	interval := l.route.PongCache.RefreshInterval
+	if interval == 0 {
+		return false
+	}
+
+	// Pings answered from the cache count against the same per-IP rate as
+	// new proxy connections, which they would otherwise have started
+	settings := l.settings.Load()
+	clientAddrPort := unmapAddrPort(clientAddr.AddrPort())
+	if !l.proxy.newSessions.allow(clientAddrPort.Addr(), settings.opts.limits, time.Now()) {
+		l.limitHit(clientAddrPort, settings.opts, dropNewSessionRate)
+		return true
+	}
+	msg, err := raknet.DecodeOfflineMessage(payload)
+	if err != nil {
+		log.Tracef("dropping invalid ping from %v: %v", clientAddr, err)
+		settings.opts.metrics.drop(dropInvalidPing)
+		return true
+	}
+	cached := l.pong.Load()
+	if cached == nil || time.Since(cached.fetched) > pongMaxAgeIntervals*interval {
+		log.Tracef("no fresh pong cached on %v, dropping ping from %v", l.listenAddr, clientAddr)
+		settings.opts.metrics.drop(dropNoPongCached)
+		return true
+	}
+
+	pong := *cached.pong
+	pong.SendTimestamp = msg.(*raknet.UnconnectedPing).SendTimestamp
+	settings.route.PongCache.Rewrite.apply(&pong)
+	if _, err := l.conn.WriteToUDP(pong.Append(nil), clientAddr); err != nil {
+		log.Debugf("unable to answer ping from %v: %v", clientAddr, err)
+		return true
+	}
+	settings.opts.metrics.pingsAnswered.Inc()
+	return true
+}
+
+func (r PongRewrite) apply(pong *raknet.UnconnectedPong) {
+	if r.ServerGUID != 0 {
+		pong.ServerGUID = r.ServerGUID
+	}
+	if r.Data != "" {
+		pong.Data = []byte(r.Data)
+		return
+	}
+
+	fields := strings.Split(string(pong.Data), ";")
+	setField := func(i int, value string) {
+		if value != "" && i < len(fields) {
+			fields[i] = value
+		}
+	}
+	setField(advertisementName, r.ServerName)
+	if r.ServerGUID != 0 {
+		setField(advertisementGUID, strconv.FormatUint(r.ServerGUID, 10))
+	}
+	if r.IPv4Port != 0 {
+		setField(advertisementIPv4Port, strconv.Itoa(r.IPv4Port))
+	}
+	if r.IPv6Port != 0 {
+		setField(advertisementIPv6Port, strconv.Itoa(r.IPv6Port))
+	}
+	pong.Data = []byte(strings.Join(fields, ";"))
+}
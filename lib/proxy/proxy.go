@@ -1,82 +1,493 @@
 package proxy
 
 import (
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/metrics"
 )
 
 type Proxy struct {
-	ListenPort       int
-	listenAddr       *net.UDPAddr
-	ProxyHostname    string
-	ServerHostname   string
-	ServerPort       int
-	serverAddr       *net.UDPAddr
-	clientListenConn *net.UDPConn
+	// ListenPort, ServerHostname and ServerPort describe a single route, used
+	// when Routes is empty
+	ListenPort     int
+	ServerHostname string
+	ServerPort     int
+
+	// Routes are the ports the proxy listens on, each with its own upstream
+	// server and proxy connections
+	Routes []Route
+
+	// ProxyHostname is the public address of the proxy, substituted for the
+	// server's address in the handshake. Routes may override it.
+	ProxyHostname string
+
+	// IdleTimeout is how long a proxy connection may go without traffic from
+	// either the client or the server before it is closed. Zero disables idle
+	// reaping.
+	IdleTimeout time.Duration
+
+	// ShutdownTimeout bounds how long Run waits for connections to drain
+	// their in-flight payloads once its context is cancelled. Zero uses the
+	// default.
+	ShutdownTimeout time.Duration
+
+	// Limits on split message reassembly, per connection and direction: the
+	// number of fragments in a message, the number of incomplete messages and
+	// the total size of buffered fragments. Zero values use the defaults.
+	MaxSplitCount   uint32
+	MaxSplitPending int
+	MaxSplitBytes   int
+
+	// RateLimits protect the proxy from floods of sessions and payloads
+	RateLimits RateLimits
+
+	// ACL restricts which clients may open a proxy connection. Payloads from
+	// other clients are dropped before any upstream socket is created. Routes
+	// may override it.
+	ACL ACL
+
+	// Validation is what happens to payloads from clients that are not valid
+	// RakNet. The empty policy forwards them.
+	Validation ValidationPolicy
+
+	// DisableAddressRewriting forwards the handshake messages carrying system
+	// addresses as they are, instead of substituting the proxy's and the
+	// client's addresses for one another.
+	DisableAddressRewriting bool
+
+	// HealthCheck configures pinging of the upstreams, so that new sessions
+	// are only proxied to upstreams that answer
+	HealthCheck HealthCheck
+
+	// ResolveInterval is how often the upstreams' hostnames are resolved
+	// again, for new proxy connections to follow DNS changes. Zero resolves
+	// them only at startup and on Reconfigure.
+	ResolveInterval time.Duration
+
+	// Metrics is the registry the proxy's metrics are registered on when it
+	// starts. If nil, metrics are kept but not exposed.
+	Metrics *metrics.Registry
+
+	// CaptureDir is the directory StartCapture writes capture files to.
+	// Captures are disabled if it is empty.
+	CaptureDir string
+
+	// RecordDir is the directory the payloads of every new proxy connection
+	// are recorded to, one file per connection. Sessions are not recorded if
+	// it is empty.
+	RecordDir string
+
+	// MessageHooks are called with every complete message passing through
+	// the proxy. They are called from the connections' goroutines, so must be
+	// safe for concurrent use.
+	MessageHooks []MessageHook
+
+	// listeners are those of the running proxy, and are cleared when Run
+	// returns
+	listeners   atomic.Pointer[[]*listener]
+	metrics     *proxyMetrics
+	bans        *banList
+	newSessions *ipLimiter
+	captures    *captureSet
+	cookies     *cookieJar
+	// running is set while the listeners are started
+	running atomic.Bool
+}
+
+// Route is a port the proxy listens on for clients, and the upstream servers
+// they are proxied to.
+type Route struct {
+	ListenPort int
+
+	// ServerHostname and ServerPort describe a single upstream, used when
+	// Upstreams is empty
+	ServerHostname string
+	ServerPort     int
+
+	// Upstreams are the servers that new sessions are balanced across. Each
+	// session stays with the upstream it started on.
+	Upstreams []Upstream
+	Balance   BalancePolicy
+
+	// ProxyHostname overrides the proxy's public address for this route
+	ProxyHostname string
+
+	// ACL overrides the proxy's ACL for this route
+	ACL *ACL
+
+	// DisableAddressRewriting disables address rewriting for this route only
+	DisableAddressRewriting bool
+
+	// PongCache answers unconnected pings on this route without proxying
+	// them. Its refresh interval is only read when the proxy starts.
+	PongCache PongCache
+
+	// ProxyProtocol makes the route prepend PROXY protocol headers, with the
+	// client's address, to datagrams sent upstream
+	ProxyProtocol ProxyProtocol
+
+	// HandshakeCookies makes the route answer OpenConnectionRequest1s itself,
+	// with a cookie, and only open an upstream socket for clients that return
+	// the cookie. This stops clients with spoofed addresses from making the
+	// proxy open sockets, and from using it to send traffic to others. Clients
+	// must support the cookies of RakNet's secure handshake.
+	HandshakeCookies bool
+}
+
+// settings are the resolved parts of a route's configuration that are used
+// to create a proxy connection
+type settings struct {
+	route     Route
+	upstreams *upstreamPool
+	proxyAddr *net.UDPAddr
+	acl       ACL
+	opts      sessionOptions
 }
 
 type UDPPayload []byte
 
 const (
 	MaxUDPSize int = 65535
-)
 
-var proxyConns = make(map[int]*proxyConnection)
+	DefaultShutdownTimeout = 5 * time.Second
 
-func (p *Proxy) Run() error {
-	serverAddrString := fmt.Sprintf("%s:%d", p.ServerHostname, p.ServerPort)
-	serverAddr, err := net.ResolveUDPAddr("udp", serverAddrString)
+	// minTickInterval bounds how often the background tasks run, however
+	// short the intervals they are configured with
+	minTickInterval = 100 * time.Millisecond
+)
+
+// Run proxies payloads between clients and the upstream servers until ctx is
+// cancelled or one of the listeners fails. On cancellation, every connection
+// is drained, its client and server are sent a disconnect notification and
+// its upstream socket is closed before Run returns. Once it has returned, Run
+// may be called again.
+func (p *Proxy) Run(ctx context.Context) error {
+	if p.metrics == nil {
+		registry := p.Metrics
+		if registry == nil {
+			registry = metrics.NewRegistry()
+		}
+		p.metrics = newProxyMetrics(registry, p)
+	}
+	p.bans = newBanList()
+	p.newSessions = newIPLimiter()
+	p.captures = &captureSet{}
+	cookies, err := newCookieJar()
 	if err != nil {
-		return fmt.Errorf("unable to resolve server %v: %w", serverAddrString, err)
+		return err
 	}
+	p.cookies = cookies
 
-	listenAddrString := fmt.Sprintf(":%d", p.ListenPort)
-	listenAddr, err := net.ResolveUDPAddr("udp", listenAddrString)
+	listeners, err := p.listen()
 	if err != nil {
-		return fmt.Errorf("unable to resolve listen address %v: %w", listenAddrString, err)
+		return err
 	}
+	defer p.stop(listeners)
 
-	proxyAddrString := fmt.Sprintf("%s:%d", p.ProxyHostname, p.ListenPort)
-	proxyAddr, err := net.ResolveUDPAddr("udp", proxyAddrString)
+	// A listener failing stops the others and the background tasks
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
-	clientListenConn, err := net.ListenUDP("udp", listenAddr)
-	if err != nil {
-		return fmt.Errorf("unable to start client listener: %w", err)
+	tasks := p.startTasks(ctx, listeners)
+	errs := serve(ctx, cancel, listeners)
+	cancel(nil)
+	tasks.Wait()
+
+	p.shutdown(listeners)
+	p.stopCaptures()
+	return errors.Join(errs...)
+}
+
+// startTasks starts the background tasks of the proxy, which run until ctx
+// is cancelled.
+func (p *Proxy) startTasks(ctx context.Context, listeners []*listener) *sync.WaitGroup {
+	tasks := &sync.WaitGroup{}
+	start := func(task func()) {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			task()
+		}()
 	}
-	defer clientListenConn.Close()
 
-	log.Infof("Listening on %v, proxying to %v", listenAddr, serverAddr)
-	p.listenAddr = listenAddr
-	p.serverAddr = serverAddr
-	p.clientListenConn = clientListenConn
+	if p.IdleTimeout > 0 {
+		start(func() { p.reapIdleConnections(ctx) })
+	}
+	start(func() { p.cleanupLimits(ctx) })
+	if p.HealthCheck.Interval > 0 {
+		start(func() { p.checkUpstreams(ctx) })
+	}
+	if p.ResolveInterval > 0 {
+		start(func() { p.reresolveUpstreams(ctx) })
+	}
+	for _, l := range listeners {
+		if l.route.PongCache.RefreshInterval > 0 {
+			l := l
+			start(func() { l.refreshPong(ctx, p.healthCheckTimeout()) })
+		}
+	}
+	return tasks
+}
 
-	b := make([]byte, MaxUDPSize)
-	for {
-		n, clientAddr, err := p.clientListenConn.ReadFromUDP(b)
+// serve runs the listeners until ctx is cancelled, cancelling it with the
+// error of the first one to fail.
+func serve(ctx context.Context, cancel context.CancelCauseFunc, listeners []*listener) []error {
+	errs := make([]error, len(listeners))
+	wg := sync.WaitGroup{}
+	for i, l := range listeners {
+		wg.Add(1)
+		go func(i int, l *listener) {
+			defer wg.Done()
+			if errs[i] = l.serve(ctx); errs[i] != nil {
+				cancel(errs[i])
+			}
+		}(i, l)
+	}
+	wg.Wait()
+	return errs
+}
+
+// routes returns the configured routes, or the single route described by the
+// proxy's own fields.
+func (p *Proxy) routes() []Route {
+	if len(p.Routes) > 0 {
+		return p.Routes
+	}
+	return []Route{{ListenPort: p.ListenPort, ServerHostname: p.ServerHostname, ServerPort: p.ServerPort}}
+}
+
+// upstreams returns the route's upstreams, or the single upstream described
+// by its own fields.
+func (r Route) upstreams() []Upstream {
+	if len(r.Upstreams) > 0 {
+		return r.Upstreams
+	}
+	return []Upstream{{Hostname: r.ServerHostname, Port: r.ServerPort}}
+}
+
+func (p *Proxy) listen() (listeners []*listener, err error) {
+	defer func() {
+		if err != nil {
+			closeListeners(listeners)
+		}
+	}()
+
+	ports := map[int]bool{}
+	for _, route := range p.routes() {
+		if ports[route.ListenPort] {
+			return listeners, fmt.Errorf("more than one route listens on port %d", route.ListenPort)
+		}
+		ports[route.ListenPort] = true
+
+		settings, err := p.resolveSettings(p, route, nil)
 		if err != nil {
-			log.Debugf("error reading from UDP: %v", err)
+			return listeners, err
+		}
+		l, err := newListener(p, route, settings)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, l)
+	}
+	p.listeners.Store(&listeners)
+	p.running.Store(true)
+	return listeners, nil
+}
+
+// activeListeners returns the listeners of the running proxy, or none if it
+// is not running
+func (p *Proxy) activeListeners() []*listener {
+	if listeners := p.listeners.Load(); listeners != nil {
+		return *listeners
+	}
+	return nil
+}
+
+// stop marks the proxy as no longer running and closes its listeners.
+func (p *Proxy) stop(listeners []*listener) {
+	p.running.Store(false)
+	p.listeners.Store(nil)
+	closeListeners(listeners)
+}
+
+func closeListeners(listeners []*listener) {
+	for _, l := range listeners {
+		l.conn.Close()
+	}
+}
+
+// shutdown drains and closes every proxy connection in parallel, giving up
+// on draining after the shutdown timeout. It must only be called once the
+// read loops have stopped, as no more payloads may be handed to connections.
+func (p *Proxy) shutdown(listeners []*listener) {
+	timeout := p.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conns := []*proxyConnection{}
+	for _, l := range listeners {
+		conns = append(conns, l.sessions.all()...)
+	}
+	log.Infof("shutting down %d proxy connections...", len(conns))
+
+	wg := sync.WaitGroup{}
+	for _, pConn := range conns {
+		wg.Add(1)
+		go func(pConn *proxyConnection) {
+			defer wg.Done()
+			pConn.shutdown(ctx)
+		}(pConn)
+	}
+	wg.Wait()
+}
+
+// Reconfigure applies the routes' upstream servers, proxy hostnames, ACLs,
+// address rewriting, handshake cookies, PROXY protocol, validation policy,
+// split and rate limits and recording directory of next to the proxy
+// connections created from now on. Existing connections keep the settings
+// they were created with. Routes are matched by listen port; routes for ports
+// the proxy is not listening on are ignored, as are next's timeouts and
+// hooks. If any of next's addresses do not resolve, the proxy is left
+// unchanged.
+func (p *Proxy) Reconfigure(next *Proxy) error {
+	if !p.running.Load() {
+		return fmt.Errorf("unable to reconfigure proxy: not running")
+	}
+
+	resolved := map[*listener]*settings{}
+	for _, route := range next.routes() {
+		l := p.listener(route.ListenPort)
+		if l == nil {
+			log.Warnf("not listening on port %d, ignoring its route until restart", route.ListenPort)
 			continue
 		}
-		payload := b[0:n]
-		log.Tracef(`read %v->%v: (%d)"%s"`, clientAddr, serverAddr, n, hex.EncodeToString(payload))
-
-		// Check if existing conn exists for client
-		pConn, ok := proxyConns[clientAddr.Port]
-		if !ok {
-			log.Debugf("no proxy connection found for %v, starting...", clientAddr)
-
-			// Must be `=` and not `:=` to ensure that `pConn` is not reinitialized
-			pConn, err = newProxyConnection(p.clientListenConn, clientAddr, p.serverAddr, proxyAddr)
-			if err != nil {
-				return fmt.Errorf(`unable to start new proxy connection for %v: %w`, clientAddr, err)
-			}
+		settings, err := p.resolveSettings(next, route, l.settings.Load().upstreams)
+		if err != nil {
+			return err
+		}
+		resolved[l] = settings
+	}
+
+	for l, settings := range resolved {
+		l.settings.Store(settings)
+		log.Infof("proxying new connections on %v to %v (%s)", l.listenAddr, settings.upstreams.upstreams, settings.upstreams.policy)
+	}
+	return nil
+}
 
-			proxyConns[clientAddr.Port] = pConn
+func (p *Proxy) listener(port int) *listener {
+	for _, l := range p.activeListeners() {
+		if l.route.ListenPort == port {
+			return l
+		}
+	}
+	return nil
+}
+
+// resolveSettings resolves the settings for new proxy connections on a route
+// of c, which is either the proxy itself or the next configuration passed to
+// Reconfigure. Upstreams in the route's previous pool are carried over.
+func (p *Proxy) resolveSettings(c *Proxy, route Route, previous *upstreamPool) (*settings, error) {
+	upstreams, err := newUpstreamPool(route, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyHostname := c.ProxyHostname
+	if route.ProxyHostname != "" {
+		proxyHostname = route.ProxyHostname
+	}
+	proxyAddrString := net.JoinHostPort(proxyHostname, strconv.Itoa(route.ListenPort))
+	proxyAddr, err := net.ResolveUDPAddr("udp", proxyAddrString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve proxy address %v: %w", proxyAddrString, err)
+	}
+
+	acl := c.ACL
+	if route.ACL != nil {
+		acl = *route.ACL
+	}
+
+	opts := c.sessionOptions()
+	opts.messageHooks = p.MessageHooks
+	opts.metrics = p.metrics.route(route.ListenPort)
+	opts.listenPort = route.ListenPort
+	opts.captures = p.captures
+	opts.rewriteAddresses = opts.rewriteAddresses && !route.DisableAddressRewriting
+	if route.HandshakeCookies {
+		opts.cookies = p.cookies
+	}
+	opts.proxyProtocol = route.ProxyProtocol
+	return &settings{
+		route:     route,
+		upstreams: upstreams,
+		proxyAddr: proxyAddr,
+		acl:       acl,
+		opts:      opts,
+	}, nil
+}
+
+func (p *Proxy) sessionOptions() sessionOptions {
+	opts := sessionOptions{
+		maxSplitCount:    p.MaxSplitCount,
+		maxSplitPending:  p.MaxSplitPending,
+		maxSplitBytes:    p.MaxSplitBytes,
+		rewriteAddresses: !p.DisableAddressRewriting,
+		recordDir:        p.RecordDir,
+		limits:           p.RateLimits,
+		validation:       p.Validation,
+	}
+	if opts.maxSplitCount == 0 {
+		opts.maxSplitCount = DefaultMaxSplitCount
+	}
+	if opts.maxSplitPending == 0 {
+		opts.maxSplitPending = DefaultMaxSplitPending
+	}
+	if opts.maxSplitBytes == 0 {
+		opts.maxSplitBytes = DefaultMaxSplitBytes
+	}
+	if opts.validation == "" {
+		opts.validation = DefaultValidationPolicy
+	}
+	if opts.limits.Action == "" {
+		opts.limits.Action = DefaultLimitAction
+	}
+	return opts
+}
+
+// newTicker returns a ticker for a background task, which ticks no more often
+// than minTickInterval
+func newTicker(interval time.Duration) *time.Ticker {
+	return time.NewTicker(max(interval, minTickInterval))
+}
+
+// reapIdleConnections periodically closes every proxy connection where one
+// side has been silent for longer than the idle timeout, until ctx is
+// cancelled.
+func (p *Proxy) reapIdleConnections(ctx context.Context) {
+	ticker := newTicker(p.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, l := range p.activeListeners() {
+				l.reapIdleConnections(now, p.IdleTimeout)
+			}
+		case <-ctx.Done():
+			return
 		}
-		log.Tracef(`writing payload from client %v to chan <- "%s"`, clientAddr, hex.EncodeToString(payload))
-		pConn.payloadsFromClientChan <- payload
 	}
 }
@@ -1,25 +1,41 @@
 package proxy
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
-)
 
-const (
-	packetOpenConnectionRequest2    byte = 7
-	packetOpenConnectionReply2      byte = 8
-	packetConnectionRequestAccepted byte = 10
-	packetNewIncomingConnection     byte = 13
-	ipv4                            byte = 4
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+	"github.com/percygrunwald/raknet-proxy/lib/recording"
 )
 
+// sessionOptions are the settings a Proxy passes down to each of its
+// connections
+type sessionOptions struct {
+	listenPort       int
+	maxSplitCount    uint32
+	maxSplitPending  int
+	maxSplitBytes    int
+	messageHooks     []MessageHook
+	rewriteAddresses bool
+	metrics          *routeMetrics
+	captures         *captureSet
+	recordDir        string
+	limits           RateLimits
+	validation       ValidationPolicy
+	proxyProtocol    ProxyProtocol
+	// cookies is set on routes with handshake cookies
+	cookies *cookieJar
+}
+
 type proxyConnection struct {
 	payloadsFromServerChan chan UDPPayload
 	payloadsFromClientChan chan UDPPayload
@@ -27,39 +43,116 @@ type proxyConnection struct {
 	clientListenConn *net.UDPConn
 	serverConn       *net.UDPConn
 
-	clientAddr        *net.UDPAddr
-	serverAddr        *net.UDPAddr
+	clientAddr     *net.UDPAddr
+	clientAddrPort netip.AddrPort
+	upstream       *upstream
+	serverAddr     *net.UDPAddr
+	// proxyAsServerAddr is the route's proxy hostname and listen port, the
+	// address clients reach the proxy at, rather than the listener's
+	// unspecified address
 	proxyAsServerAddr *net.UDPAddr
 	proxyAsClientAddr net.Addr
-
-	clientAddrBytes        []byte
-	serverAddrBytes        []byte
-	proxyAsServerAddrBytes []byte
-	proxyAsClientAddrBytes []byte
+	started           time.Time
+	// proxyHeader is the PROXY protocol header sent upstream, if the route
+	// sends one
+	proxyHeader []byte
+
+	// Unix nanosecond timestamps of the last payload seen in each direction
+	lastActivityFromClient atomic.Int64
+	lastActivityFromServer atomic.Int64
+	// Payloads and bytes received from each side, indexed by Direction
+	payloads [2]atomic.Uint64
+	bytes    [2]atomic.Uint64
+	// Rate limits of the payloads from the client, only used by the
+	// listener's goroutine
+	packetBucket tokenBucket
+	byteBucket   tokenBucket
+
+	opts sessionOptions
+	// Split message reassembly state, indexed by Direction. Each one is only
+	// used by the goroutine handling payloads in that direction.
+	reassemblers [2]*raknet.Reassembler
+	// Datagram sequence number translation, indexed by the Direction of the
+	// side sending the datagrams
+	sequences [2]*sequenceTranslator
+	// Reliable index translation, indexed by the Direction of the side
+	// sending the frames. Each one is only used by the goroutine handling
+	// payloads in that direction.
+	reliables [2]*reliableTranslator
+	// MTU negotiated during the offline handshake, zero until known
+	mtu atomic.Uint32
+	// headerRoom is how much the OpenConnectionRequest1 probes were trimmed
+	// by to make room for the PROXY protocol header, which the negotiated
+	// MTU leaves free
+	headerRoom atomic.Uint32
+
+	// Connected pings awaiting a pong, by the Direction they came from, and
+	// the latest round trip time to each side, by the Direction of the side
+	pings [2]atomic.Pointer[pendingPing]
+	rtt   [2]atomic.Int64
+
+	// handshake is the proxy's own handshake with the upstream, on routes
+	// with handshake cookies
+	handshake upstreamHandshake
+
+	// recording is the recording of the session, if sessions are recorded
+	recording *recording.Writer
+
+	// Socket errors seen, by errorClass, and the number of errors since the
+	// last successful write
+	errorCounts       [errorClassCount]atomic.Uint64
+	consecutiveErrors atomic.Uint32
+
+	// handlers tracks the goroutines handling payloads in each direction
+	handlers  sync.WaitGroup
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   func(*proxyConnection)
 }
 
 func newProxyConnection(clientListenConn *net.UDPConn, clientAddr *net.UDPAddr,
-	serverAddr *net.UDPAddr, proxyAsServerAddr *net.UDPAddr) (*proxyConnection, error) {
+	upstream *upstream, proxyAsServerAddr *net.UDPAddr, opts sessionOptions,
+	onClose func(*proxyConnection)) (*proxyConnection, error) {
 
 	log.Debugf("starting proxy connection for client %v...", clientAddr)
 
-	clientAddrBytes := getUDPAddrBytes(clientAddr)
-	serverAddrBytes := getUDPAddrBytes(serverAddr)
-	proxyAsServerAddrBytes := getUDPAddrBytes(proxyAsServerAddr)
-
 	pConn := &proxyConnection{
 		payloadsFromServerChan: make(chan UDPPayload, 1),
 		payloadsFromClientChan: make(chan UDPPayload, 1),
 		clientListenConn:       clientListenConn,
 		clientAddr:             clientAddr,
-		serverAddr:             serverAddr,
+		clientAddrPort:         unmapAddrPort(clientAddr.AddrPort()),
+		upstream:               upstream,
+		serverAddr:             upstream.addr,
 		proxyAsServerAddr:      proxyAsServerAddr,
-		clientAddrBytes:        clientAddrBytes,
-		serverAddrBytes:        serverAddrBytes,
-		proxyAsServerAddrBytes: proxyAsServerAddrBytes,
+		started:                time.Now(),
+		opts:                   opts,
+		done:                   make(chan struct{}),
+		onClose:                onClose,
+	}
+	for i := range pConn.reassemblers {
+		pConn.reassemblers[i] = raknet.NewReassembler(opts.maxSplitCount, opts.maxSplitPending, opts.maxSplitBytes)
+		pConn.sequences[i] = newSequenceTranslator()
+		pConn.reliables[i] = newReliableTranslator()
 	}
+	pConn.proxyHeader = pConn.proxyProtocolHeader()
+	now := pConn.started.UnixNano()
+	pConn.lastActivityFromClient.Store(now)
+	pConn.lastActivityFromServer.Store(now)
 
-	pConn.log(log.Debug, `connecting to server...`)
+	pConn.logf(log.Debugf, "connecting to server %v...", upstream)
+	pConn.logf(log.Tracef, "dialing %v...", pConn.serverAddr)
+	serverConn, err := net.DialUDP("udp", nil, pConn.serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial upstream server UDP: %w", err)
+	}
+	pConn.logf(log.Tracef, "got connection to server %v->%v", serverConn.LocalAddr(), serverConn.RemoteAddr())
+	pConn.serverConn = serverConn
+	pConn.proxyAsClientAddr = serverConn.LocalAddr()
+	upstream.sessions.Add(1)
+	pConn.startRecording()
+
+	pConn.handlers.Add(2)
 	go pConn.run()
 
 	return pConn, nil
@@ -75,113 +168,430 @@ func (pConn *proxyConnection) log(fn func(...interface{}), msg string) {
 	fn(msg)
 }
 
-func (pConn *proxyConnection) run() {
-	pConn.logf(log.Tracef, "dialing %v...", pConn.serverAddr)
+// idleSince returns the time of the last payload in whichever direction has
+// been quiet the longest. RakNet peers ping each other regularly, so a healthy
+// connection sees traffic both ways; one silent side means the session is dead
+// even if the other keeps retransmitting.
+func (pConn *proxyConnection) idleSince() time.Time {
+	last := pConn.lastActivityFromClient.Load()
+	if fromServer := pConn.lastActivityFromServer.Load(); fromServer < last {
+		last = fromServer
+	}
+	return time.Unix(0, last)
+}
 
-	serverConn, err := net.DialUDP("udp", nil, pConn.serverAddr)
-	if err != nil {
-		pConn.logf(log.Fatalf, "unable to dial upstream server UDP: %v", err)
+// close shuts down the proxy connection, releasing the upstream socket and
+// stopping its goroutines. It is safe to call more than once.
+func (pConn *proxyConnection) close(reason string) {
+	pConn.closeOnce.Do(func() {
+		pConn.logf(log.Debugf, "closing proxy connection: %s", reason)
+		close(pConn.done)
+		pConn.serverConn.Close()
+		pConn.upstream.sessions.Add(-1)
+		pConn.opts.metrics.sessionsClosed.Inc()
+		pConn.stopRecording()
+		if pConn.onClose != nil {
+			pConn.onClose(pConn)
+		}
+	})
+}
+
+// shutdown gracefully closes the proxy connection: it stops accepting
+// payloads, waits for those in flight to be proxied (or for ctx to expire),
+// notifies both sides of the disconnection and closes. It must only be called
+// once the proxy has stopped handing payloads to the connection.
+func (pConn *proxyConnection) shutdown(ctx context.Context) {
+	close(pConn.payloadsFromClientChan)
+	pConn.serverConn.SetReadDeadline(time.Now())
+
+	drained := make(chan struct{})
+	go func() {
+		pConn.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		pConn.log(log.Warn, "timed out draining payloads")
+	}
+
+	pConn.sendDisconnectNotifications()
+	pConn.close("proxy shutting down")
+}
+
+// sendDisconnectNotifications tells the client and the server that the
+// connection is over, so that neither waits for its own timeout. The
+// notification goes in an unreliable frame, which needs no reliable index
+// from either side's numbering, in a datagram injected into each flow.
+// Nothing is sent before the offline handshake has completed.
+func (pConn *proxyConnection) sendDisconnectNotifications() {
+	if pConn.mtu.Load() == 0 {
+		return
 	}
-	defer serverConn.Close()
-	pConn.logf(log.Tracef, "got connection to server %v->%v", serverConn.LocalAddr(), serverConn.RemoteAddr())
-	pConn.serverConn = serverConn
-	pConn.proxyAsClientAddr = serverConn.LocalAddr()
-	pConn.proxyAsClientAddrBytes = getProxyAsClientAddrBytes(pConn.proxyAsServerAddr, pConn.proxyAsClientAddr)
 
+	pConn.sendDisconnectNotification(FromServer)
+	pConn.sendDisconnectNotification(FromClient)
+}
+
+// sendDisconnectNotification sends a disconnect notification as though it
+// came from the given side: FromServer notifies the client, FromClient
+// notifies the server.
+func (pConn *proxyConnection) sendDisconnectNotification(from Direction) {
+	if pConn.mtu.Load() == 0 {
+		return
+	}
+
+	notification := &raknet.Datagram{
+		Flags: raknet.FlagValid,
+		Frames: []*raknet.Frame{{
+			Reliability: raknet.Unreliable,
+			Body:        []byte{raknet.IDDisconnectNotification},
+		}},
+	}
+	payload := pConn.sequences[from].inject(notification.Append(nil))
+
+	write := pConn.writeToClient
+	if from == FromClient {
+		write = pConn.writeToServer
+	}
+	pConn.logf(log.Debugf, "sending disconnect notification to %v", from.other())
+	if _, err := write(payload); err != nil {
+		pConn.logf(log.Debugf, "unable to send disconnect notification to %v: %v", from.other(), err)
+	}
+}
+
+// enqueuePayloadFromClient hands a payload read from the client listener to
+// the connection, dropping it if the connection has already been closed.
+func (pConn *proxyConnection) enqueuePayloadFromClient(payload UDPPayload) {
+	select {
+	case pConn.payloadsFromClientChan <- payload:
+	case <-pConn.done:
+		pConn.log(log.Debug, "dropping payload from client, connection closed")
+		pConn.opts.metrics.drop(dropClosed)
+	}
+}
+
+func (pConn *proxyConnection) run() {
 	pConn.log(log.Debug, `starting client payload listener...`)
 	go pConn.handlePayloadsFromClient()
 
 	pConn.log(log.Debug, `starting server payload listener...`)
 	go pConn.handlePayloadsFromServer()
 
+	// This is the only sender on the channel, so closing it once reading stops
+	// lets the handler drain what is left
+	defer close(pConn.payloadsFromServerChan)
+
+	serverConn := pConn.serverConn
 	b := make([]byte, MaxUDPSize)
 	for {
 		n, _, err := serverConn.ReadFromUDP(b)
 		if err != nil {
-			pConn.logf(log.Debugf, "error reading %v->%v: %v", serverConn.RemoteAddr(), serverConn.LocalAddr(), err)
+			if isShutdownError(err) {
+				pConn.logf(log.Debugf, "stopping server reader: %v", err)
+				return
+			}
+			if !pConn.handleError(fmt.Sprintf("error reading %v->%v", serverConn.RemoteAddr(), serverConn.LocalAddr()), err) {
+				return
+			}
 			continue
 		}
-		payload := b[0:n]
+		payload := make(UDPPayload, n)
+		copy(payload, b[0:n])
 		pConn.logf(log.Tracef, `read %v->%v: (%d)"%s"`, serverConn.RemoteAddr(), serverConn.LocalAddr(), n, hex.EncodeToString(payload))
 		pConn.logf(log.Tracef, `writing payload from server to chan <- "%s"`, hex.EncodeToString(payload))
-		pConn.payloadsFromServerChan <- payload
+		select {
+		case pConn.payloadsFromServerChan <- payload:
+		case <-pConn.done:
+			return
+		}
 	}
 }
 
-func getUDPAddrBytes(addr *net.UDPAddr) []byte {
-	return getIPPortBytes(addr.IP, addr.Port)
-}
-
-// Gets the byteslice representation of the address, with the port coming from
-// the address, but the IP coming from the first argument
-func getProxyAsClientAddrBytes(udpAddr *net.UDPAddr, addr net.Addr) []byte {
-	split := strings.Split(addr.String(), ":")
-	port, _ := strconv.Atoi(split[1])
-	ip := udpAddr.IP
-
-	return getIPPortBytes(ip, port)
-}
-
-// Get the byte sequence of the IP and port in the RakNet form, including the IP
-// version byte (set to 4 by default)
-func getIPPortBytes(ip net.IP, port int) []byte {
-	// Initialize ipv4 byteslice
-	addrBytes := []byte{}
-	portBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(portBytes, uint16(port))
-	for _, b := range ip.To4() {
-		addrBytes = append(addrBytes, ^b)
-	}
-	addrBytes = append(addrBytes, portBytes...)
-
-	return addrBytes
+// unmapAddrPort normalizes IPv4-mapped IPv6 addresses, as seen on dual-stack
+// sockets, to plain IPv4 so that the same client or server always compares
+// and prints the same way.
+func unmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
 }
 
 func (pConn *proxyConnection) handlePayloadsFromClient() {
+	defer pConn.handlers.Done()
 	pConn.log(log.Debug, "listening for payloads from client...")
 
-	for payload := range pConn.payloadsFromClientChan {
-		pConn.logf(log.Tracef, `proxying payload from client: "%s"`, hex.EncodeToString(payload))
-		pConn.proxyPayloadFromClient(payload)
+	for {
+		select {
+		case payload, ok := <-pConn.payloadsFromClientChan:
+			if !ok {
+				return
+			}
+			pConn.lastActivityFromClient.Store(time.Now().UnixNano())
+			pConn.countReceived(FromClient, payload)
+			pConn.logf(log.Tracef, `proxying payload from client: "%s"`, hex.EncodeToString(payload))
+			if !pConn.handleWriteResult(pConn.proxyPayloadFromClient(payload)) {
+				return
+			}
+			if isDisconnectNotification(payload) {
+				pConn.close("client sent disconnect notification")
+			}
+		case <-pConn.done:
+			return
+		}
 	}
 }
 
 func (pConn *proxyConnection) handlePayloadsFromServer() {
+	defer pConn.handlers.Done()
 	pConn.log(log.Debug, "listening for payloads from server...")
 
-	for payload := range pConn.payloadsFromServerChan {
-		pConn.logf(log.Tracef, `proxying payload from server: "%s"`, hex.EncodeToString(payload))
-		pConn.proxyPayloadFromServer(payload)
+	for {
+		select {
+		case payload, ok := <-pConn.payloadsFromServerChan:
+			if !ok {
+				return
+			}
+			pConn.lastActivityFromServer.Store(time.Now().UnixNano())
+			pConn.countReceived(FromServer, payload)
+			pConn.logf(log.Tracef, `proxying payload from server: "%s"`, hex.EncodeToString(payload))
+			if !pConn.handleWriteResult(pConn.proxyPayloadFromServer(payload)) {
+				return
+			}
+			if isDisconnectNotification(payload) {
+				pConn.close("server sent disconnect notification")
+			}
+		case <-pConn.done:
+			return
+		}
 	}
 }
 
 func (pConn *proxyConnection) proxyPayloadFromClient(payload UDPPayload) (int, error) {
-	payload, _ = pConn.updatePayloadFromClient(payload)
+	if pConn.opts.cookies != nil && len(payload) > 0 && payload[0] == raknet.IDOpenConnectionRequest2 {
+		return pConn.forwardRequest2(payload)
+	}
+	payload, err := pConn.updatePayloadFromClient(payload)
+	if err != nil {
+		pConn.logf(log.Debugf, "unable to update payload from client, forwarding unchanged: %v", err)
+	}
+
+	forward, back := pConn.sequencePayload(FromClient, payload)
+	_, backErr := writeAll(pConn.writeToClient, back)
+	n, err := writeAll(pConn.writeToServer, forward)
+	return n, errors.Join(err, backErr)
+}
+
+func (pConn *proxyConnection) proxyPayloadFromServer(payload UDPPayload) (int, error) {
+	if pConn.opts.cookies != nil && len(payload) > 0 && payload[0] == raknet.IDOpenConnectionReply1 {
+		return pConn.completeRequest1(payload)
+	}
+	payload, err := pConn.updatePayloadFromServer(payload)
+	if err != nil {
+		pConn.logf(log.Debugf, "unable to update payload from server, forwarding unchanged: %v", err)
+	}
+
+	forward, back := pConn.sequencePayload(FromServer, payload)
+	_, backErr := writeAll(pConn.writeToServer, back)
+	n, err := writeAll(pConn.writeToClient, forward)
+	return n, errors.Join(err, backErr)
+}
+
+// handleWriteResult handles the result of proxying a payload, reporting
+// whether the connection is still usable.
+func (pConn *proxyConnection) handleWriteResult(n int, err error) bool {
+	if err != nil {
+		return pConn.handleError(fmt.Sprintf("error proxying payload (%d bytes written)", n), err)
+	}
+	pConn.consecutiveErrors.Store(0)
+	return true
+}
+
+func (pConn *proxyConnection) writeToServer(payload UDPPayload) (int, error) {
+	// Captures leave out the PROXY protocol header, so that Wireshark can
+	// dissect the RakNet payload
+	pConn.capture(captureInterfaceUpstream, pConn.serverAddr, pConn.proxyAsClientAddr, false, payload)
+	payload = pConn.withProxyProtocolHeader(payload)
 	pConn.logf(log.Tracef, `write %v->%v: "%s"`, pConn.clientAddr, pConn.serverAddr, hex.EncodeToString(payload))
 	return pConn.serverConn.Write(payload)
 }
 
-func (pConn *proxyConnection) proxyPayloadFromServer(payload UDPPayload) (int, error) {
-	payload, _ = pConn.updatePayloadFromServer(payload)
+func (pConn *proxyConnection) writeToClient(payload UDPPayload) (int, error) {
 	pConn.logf(log.Tracef, `write %v->%v: "%s"`, pConn.serverAddr, pConn.clientAddr, hex.EncodeToString(payload))
+	pConn.record(FromServer, payload)
+	pConn.capture(captureInterfaceClient, pConn.clientAddr, pConn.proxyAsServerAddr, false, payload)
 	n, _, err := pConn.clientListenConn.WriteMsgUDP(payload, []byte{}, pConn.clientAddr)
 	return n, err
 }
 
+// writeAll writes every payload, returning the total number of bytes written
+// and the first error.
+func writeAll(write func(UDPPayload) (int, error), payloads []UDPPayload) (int, error) {
+	total := 0
+	var firstErr error
+	for _, payload := range payloads {
+		n, err := write(payload)
+		total += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return total, firstErr
+}
+
 func (pConn *proxyConnection) updatePayloadFromServer(payload UDPPayload) (UDPPayload, error) {
-	// Attempt the bare minimum changes to packets
-	// payload = bytes.ReplaceAll(payload, pConn.serverAddrBytes, pConn.proxyAsServerAddrBytes)
-	// payload = bytes.ReplaceAll(payload, pConn.proxyAsClientAddrBytes, pConn.clientAddrBytes)
+	switch {
+	case len(payload) == 0:
+		return payload, nil
+	case payload[0] == raknet.IDOpenConnectionReply2:
+		// The server sees the proxy as the client, tell the client its own
+		// address instead
+		return rewriteOfflineMessage(payload, func(m raknet.OfflineMessage) bool {
+			reply := m.(*raknet.OpenConnectionReply2)
+			pConn.mtu.Store(uint32(reply.MTU))
+			if !pConn.opts.rewriteAddresses {
+				return false
+			}
+			pConn.logf(log.Tracef, "rewriting client address %v->%v", reply.ClientAddress, pConn.clientAddrPort)
+			reply.ClientAddress = pConn.clientAddrPort
+			return true
+		})
+	case raknet.IsDatagram(payload):
+		return rewriteDatagram(payload, pConn.updateFrameFromServer)
+	}
 
 	return payload, nil
 }
 
 func (pConn *proxyConnection) updatePayloadFromClient(payload UDPPayload) (UDPPayload, error) {
-	// Attempt the bare minimum changes to packets
-	// payload = bytes.ReplaceAll(payload, pConn.clientAddrBytes, pConn.proxyAsClientAddrBytes)
-	if payload[0] == packetOpenConnectionRequest2 {
-		payload = bytes.ReplaceAll(payload, pConn.proxyAsServerAddrBytes, pConn.serverAddrBytes)
+	switch {
+	case len(payload) == 0:
+		return payload, nil
+	case payload[0] == raknet.IDOpenConnectionRequest1:
+		if pConn.proxyHeaderSize(FromClient) == 0 {
+			return payload, nil
+		}
+		return rewriteOfflineMessage(payload, func(m raknet.OfflineMessage) bool {
+			pConn.trimRequest1(m.(*raknet.OpenConnectionRequest1))
+			return true
+		})
+	case payload[0] == raknet.IDOpenConnectionRequest2:
+		// The client addresses the proxy, the server expects its own address
+		if !pConn.opts.rewriteAddresses {
+			return payload, nil
+		}
+		return rewriteOfflineMessage(payload, func(m raknet.OfflineMessage) bool {
+			request := m.(*raknet.OpenConnectionRequest2)
+			serverAddrPort := unmapAddrPort(pConn.serverAddr.AddrPort())
+			pConn.logf(log.Tracef, "rewriting server address %v->%v", request.ServerAddress, serverAddrPort)
+			request.ServerAddress = serverAddrPort
+			return true
+		})
+	case raknet.IsDatagram(payload):
+		return rewriteDatagram(payload, pConn.updateFrameFromClient)
 	}
 
 	return payload, nil
 }
+
+// updateFrameFromServer rewrites the client address in the server's
+// ConnectionRequestAccepted, which is the proxy's address as seen by the
+// server, to the client's own address. It reports whether the frame changed.
+func (pConn *proxyConnection) updateFrameFromServer(f *raknet.Frame) (bool, error) {
+	pConn.inspectFrame(FromServer, f)
+	if !pConn.opts.rewriteAddresses {
+		return false, nil
+	}
+	if id, ok := f.MessageID(); !ok || f.Split || id != raknet.IDConnectionRequestAccepted {
+		return false, nil
+	}
+
+	m, err := raknet.DecodeConnectedMessage(f.Body)
+	if err != nil {
+		return false, err
+	}
+	accepted := m.(*raknet.ConnectionRequestAccepted)
+	pConn.logf(log.Tracef, "rewriting client address %v->%v", accepted.ClientAddress, pConn.clientAddrPort)
+	accepted.ClientAddress = pConn.clientAddrPort
+	f.Body = accepted.Append(nil)
+	return true, nil
+}
+
+// updateFrameFromClient rewrites the server address in the client's
+// NewIncomingConnection, which is the proxy's address as seen by the client,
+// to the upstream server's address. It reports whether the frame changed.
+func (pConn *proxyConnection) updateFrameFromClient(f *raknet.Frame) (bool, error) {
+	pConn.inspectFrame(FromClient, f)
+	if !pConn.opts.rewriteAddresses {
+		return false, nil
+	}
+	if id, ok := f.MessageID(); !ok || f.Split || id != raknet.IDNewIncomingConnection {
+		return false, nil
+	}
+
+	m, err := raknet.DecodeConnectedMessage(f.Body)
+	if err != nil {
+		return false, err
+	}
+	incoming := m.(*raknet.NewIncomingConnection)
+	serverAddrPort := unmapAddrPort(pConn.serverAddr.AddrPort())
+	pConn.logf(log.Tracef, "rewriting server address %v->%v", incoming.ServerAddress, serverAddrPort)
+	incoming.ServerAddress = serverAddrPort
+	f.Body = incoming.Append(nil)
+	return true, nil
+}
+
+// rewriteDatagram decodes payload as a connected datagram and passes each of
+// its frames to rewrite. If any frame changed, the re-encoded datagram is
+// returned, otherwise the payload is returned as is.
+func rewriteDatagram(payload UDPPayload, rewrite func(*raknet.Frame) (bool, error)) (UDPPayload, error) {
+	d, err := raknet.DecodeDatagram(payload)
+	if err != nil {
+		return payload, err
+	}
+
+	changed := false
+	for _, f := range d.Frames {
+		frameChanged, err := rewrite(f)
+		if err != nil {
+			return payload, err
+		}
+		changed = changed || frameChanged
+	}
+	if !changed {
+		return payload, nil
+	}
+	return d.Append(nil), nil
+}
+
+// isDisconnectNotification reports whether payload is a connected datagram
+// carrying a disconnect notification.
+func isDisconnectNotification(payload UDPPayload) bool {
+	if !raknet.IsDatagram(payload) {
+		return false
+	}
+	d, err := raknet.DecodeDatagram(payload)
+	if err != nil {
+		return false
+	}
+	for _, f := range d.Frames {
+		if id, ok := f.MessageID(); ok && !f.Split && id == raknet.IDDisconnectNotification {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteOfflineMessage decodes payload as an offline message and passes it
+// to rewrite to be modified in place. If rewrite reports a change, the
+// re-encoded message is returned, otherwise the payload is returned as is. If
+// the payload cannot be decoded, it is returned unchanged along with the
+// error.
+func rewriteOfflineMessage(payload UDPPayload, rewrite func(raknet.OfflineMessage) bool) (UDPPayload, error) {
+	m, err := raknet.DecodeOfflineMessage(payload)
+	if err != nil {
+		return payload, err
+	}
+	if !rewrite(m) {
+		return payload, nil
+	}
+	return m.Append(nil), nil
+}
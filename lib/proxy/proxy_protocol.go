@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxyproto"
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// ProxyProtocol is when a route prepends a PROXY protocol v2 header, with
+// the client's address, to the datagrams it sends upstream
+type ProxyProtocol string
+
+const (
+	// ProxyProtocolOff sends no headers
+	ProxyProtocolOff ProxyProtocol = ""
+	// ProxyProtocolFirst sends a header on each datagram until the upstream
+	// first replies, which is normally just the first one, so that the
+	// header is not lost with a dropped datagram
+	ProxyProtocolFirst ProxyProtocol = "first"
+	// ProxyProtocolEvery sends a header on every datagram
+	ProxyProtocolEvery ProxyProtocol = "every"
+)
+
+var ProxyProtocols = []ProxyProtocol{ProxyProtocolFirst, ProxyProtocolEvery}
+
+// proxyProtocolHeader returns the header the connection sends upstream, or
+// nil if it sends none. The destination is the route's proxy address, which
+// the client sent its datagrams to.
+func (pConn *proxyConnection) proxyProtocolHeader() []byte {
+	if pConn.opts.proxyProtocol == ProxyProtocolOff {
+		return nil
+	}
+	return proxyproto.Header{
+		Source:      pConn.clientAddrPort,
+		Destination: unmapAddrPort(pConn.proxyAsServerAddr.AddrPort()),
+	}.Append(nil)
+}
+
+// localHeader returns the header for datagrams the proxy sends upstream on its
+// own behalf, such as health check pings, or nil if the route sends none. It
+// carries the LOCAL command, so that the upstream takes the datagrams as
+// coming from the proxy itself.
+func (p ProxyProtocol) localHeader() []byte {
+	if p == ProxyProtocolOff {
+		return nil
+	}
+	return proxyproto.Header{}.Append(nil)
+}
+
+// withProxyProtocolHeader prepends the header to a datagram for the upstream,
+// if one is due
+func (pConn *proxyConnection) withProxyProtocolHeader(payload UDPPayload) UDPPayload {
+	if !pConn.proxyHeaderDue() {
+		return payload
+	}
+	return append(append(make(UDPPayload, 0, len(pConn.proxyHeader)+len(payload)), pConn.proxyHeader...), payload...)
+}
+
+func (pConn *proxyConnection) proxyHeaderDue() bool {
+	switch {
+	case pConn.proxyHeader == nil:
+		return false
+	case pConn.opts.proxyProtocol == ProxyProtocolFirst && pConn.payloads[FromServer].Load() > 0:
+		return false
+	}
+	return true
+}
+
+// proxyHeaderSize returns the size of the header that the next datagram from
+// the given side gets on its way through the proxy, if any
+func (pConn *proxyConnection) proxyHeaderSize(from Direction) int {
+	if from != FromClient || !pConn.proxyHeaderDue() {
+		return 0
+	}
+	return len(pConn.proxyHeader)
+}
+
+// trimRequest1 shrinks an OpenConnectionRequest1 for the upstream by the size
+// of the header prepended to it, so that the probe is no larger on the wire
+// than the MTU being tested. The MTU the upstream measures then leaves room
+// for the header.
+func (pConn *proxyConnection) trimRequest1(request *raknet.OpenConnectionRequest1) {
+	room := min(pConn.proxyHeaderSize(FromClient), int(request.MTU))
+	if room == 0 {
+		return
+	}
+	pConn.logf(log.Tracef, "trimming MTU probe %d by %d bytes for the PROXY protocol header", request.MTU, room)
+	request.MTU -= uint16(room)
+	pConn.headerRoom.Store(uint32(room))
+}
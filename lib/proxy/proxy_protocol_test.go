@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/percygrunwald/raknet-proxy/lib/proxyproto"
+)
+
+func TestProxyProtocolHeaderAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    string
+		proxyAddr string
+	}{
+		{"IPv4", "198.51.100.7:51234", "203.0.113.1:19132"},
+		{"IPv4-mapped client", "[::ffff:198.51.100.7]:51234", "203.0.113.1:19132"},
+		{"IPv6", "[2001:db8::7]:51234", "[2001:db8::1]:19132"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := netip.MustParseAddrPort(tt.client)
+			pConn := &proxyConnection{
+				clientAddrPort:    unmapAddrPort(client),
+				proxyAsServerAddr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(tt.proxyAddr)),
+				opts:              sessionOptions{proxyProtocol: ProxyProtocolEvery},
+			}
+			h, _, err := proxyproto.Decode(pConn.proxyProtocolHeader())
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if want := unmapAddrPort(client); h.Source != want {
+				t.Errorf("source = %v, want %v", h.Source, want)
+			}
+			if want := netip.MustParseAddrPort(tt.proxyAddr); h.Destination != want {
+				t.Errorf("destination = %v, want the proxy address %v", h.Destination, want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderOff(t *testing.T) {
+	pConn := &proxyConnection{
+		clientAddrPort:    netip.MustParseAddrPort("198.51.100.7:51234"),
+		proxyAsServerAddr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("203.0.113.1:19132")),
+	}
+	if h := pConn.proxyProtocolHeader(); h != nil {
+		t.Errorf("proxyProtocolHeader() = % x with PROXY protocol off", h)
+	}
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// raknetServer answers the offline handshake on a local UDP socket and
+// passes on the bodies of the frames it receives
+type raknetServer struct {
+	conn   *net.UDPConn
+	frames chan []byte
+}
+
+func newRaknetServer(t *testing.T) *raknetServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	s := &raknetServer{conn: conn, frames: make(chan []byte, 64)}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *raknetServer) serve() {
+	b := make([]byte, MaxUDPSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		if reply := s.answer(b[:n], addr); reply != nil {
+			s.conn.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+func (s *raknetServer) answer(payload []byte, addr *net.UDPAddr) []byte {
+	if raknet.IsDatagram(payload) {
+		if d, err := raknet.DecodeDatagram(payload); err == nil {
+			for _, f := range d.Frames {
+				s.frames <- append([]byte{}, f.Body...)
+			}
+		}
+		return nil
+	}
+	m, err := raknet.DecodeOfflineMessage(payload)
+	if err != nil {
+		return nil
+	}
+	switch m := m.(type) {
+	case *raknet.OpenConnectionRequest1:
+		return (&raknet.OpenConnectionReply1{ServerGUID: 42, MTU: m.MTU}).Append(nil)
+	case *raknet.OpenConnectionRequest2:
+		return (&raknet.OpenConnectionReply2{ServerGUID: 42, ClientAddress: addr.AddrPort(), MTU: m.MTU}).Append(nil)
+	}
+	return nil
+}
+
+func (s *raknetServer) addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// runProxy runs p on a free port until the test ends, returning the address
+// to reach it at, a function stopping it and the channel Run's error is sent
+// on
+func runProxy(t *testing.T, p *Proxy) (*net.UDPAddr, context.CancelFunc, chan error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+	t.Cleanup(cancel)
+
+	deadline := time.Now().Add(time.Second)
+	for !p.running.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	port := p.activeListeners()[0].conn.LocalAddr().(*net.UDPAddr).Port
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, cancel, done
+}
+
+// testClient completes the offline handshake through the proxy, reading
+// from a socket of its own
+type testClient struct {
+	conn  *net.UDPConn
+	proxy *net.UDPAddr
+}
+
+func newTestClient(t *testing.T, proxy *net.UDPAddr) *testClient {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{conn: conn, proxy: proxy}
+}
+
+func (c *testClient) handshake(t *testing.T) {
+	t.Helper()
+	c.exchange(t, &raknet.OpenConnectionRequest1{Protocol: 11, MTU: 1400}, raknet.IDOpenConnectionReply1)
+	c.exchange(t, &raknet.OpenConnectionRequest2{ServerAddress: c.proxy.AddrPort(), MTU: 1400, ClientGUID: 7}, raknet.IDOpenConnectionReply2)
+}
+
+func (c *testClient) exchange(t *testing.T, request raknet.OfflineMessage, replyID byte) {
+	t.Helper()
+	if _, err := c.conn.WriteToUDP(request.Append(nil), c.proxy); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, MaxUDPSize)
+	n, _, err := c.conn.ReadFromUDP(b)
+	if err != nil {
+		t.Fatalf("no reply to 0x%02x: %v", request.ID(), err)
+	}
+	if n == 0 || b[0] != replyID {
+		t.Fatalf("reply to 0x%02x is 0x%02x, want 0x%02x", request.ID(), b[0], replyID)
+	}
+}
+
+// readFrame returns the body of the next frame the client receives
+func (c *testClient) readFrame(t *testing.T, timeout time.Duration) []byte {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	b := make([]byte, MaxUDPSize)
+	for {
+		n, _, err := c.conn.ReadFromUDP(b)
+		if err != nil {
+			t.Fatalf("no frame received: %v", err)
+		}
+		if d, err := raknet.DecodeDatagram(b[:n]); err == nil && len(d.Frames) > 0 {
+			return d.Frames[0].Body
+		}
+	}
+}
+
+func expectDisconnect(t *testing.T, side string, body []byte) {
+	t.Helper()
+	if len(body) != 1 || body[0] != raknet.IDDisconnectNotification {
+		t.Errorf("%s received % x, want a disconnect notification", side, body)
+	}
+}
+
+func expectServerFrame(t *testing.T, s *raknetServer, timeout time.Duration) []byte {
+	t.Helper()
+	select {
+	case body := <-s.frames:
+		return body
+	case <-time.After(timeout):
+		t.Fatalf("server received no frame")
+		return nil
+	}
+}
+
+// expectReleased checks that a proxy connection's upstream socket is closed
+func expectReleased(t *testing.T, pConn *proxyConnection) {
+	t.Helper()
+	if _, err := pConn.serverConn.Write([]byte{0}); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("upstream socket still open: write returned %v", err)
+	}
+	if n := pConn.upstream.sessions.Load(); n != 0 {
+		t.Errorf("upstream has %d sessions, want 0", n)
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	server := newRaknetServer(t)
+	p := &Proxy{ServerHostname: "127.0.0.1", ServerPort: server.addr().Port, ShutdownTimeout: time.Second}
+
+	// Run may be called again once it has returned
+	for run := 0; run < 2; run++ {
+		proxyAddr, cancel, done := runProxy(t, p)
+		client := newTestClient(t, proxyAddr)
+		client.handshake(t)
+		conns := p.sessions(0, netip.Addr{})
+		if len(conns) != 1 {
+			t.Fatalf("run %d: %d sessions, want 1", run, len(conns))
+		}
+
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("run %d: Run: %v", run, err)
+			}
+		case <-time.After(p.ShutdownTimeout):
+			t.Fatalf("run %d: Run did not return within the shutdown timeout", run)
+		}
+
+		expectDisconnect(t, "client", client.readFrame(t, time.Second))
+		expectDisconnect(t, "server", expectServerFrame(t, server, time.Second))
+		expectReleased(t, conns[0])
+		if p.running.Load() || p.activeListeners() != nil {
+			t.Errorf("run %d: proxy still running after Run returned", run)
+		}
+		if err := p.Reconfigure(p); err == nil {
+			t.Errorf("run %d: Reconfigure succeeded after Run returned", run)
+		}
+	}
+}
+
+func TestRunStopsOnListenerFailure(t *testing.T) {
+	server := newRaknetServer(t)
+	p := &Proxy{ServerHostname: "127.0.0.1", ServerPort: server.addr().Port, IdleTimeout: time.Minute, ShutdownTimeout: time.Second}
+	_, _, done := runProxy(t, p)
+
+	p.activeListeners()[0].conn.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Run returned no error after its listener failed")
+		}
+	case <-time.After(p.ShutdownTimeout):
+		t.Fatalf("Run did not return after its listener failed")
+	}
+	if p.running.Load() || p.activeListeners() != nil {
+		t.Errorf("proxy still running after Run returned")
+	}
+}
+
+func TestReapIdleConnections(t *testing.T) {
+	server := newRaknetServer(t)
+	// Half the idle timeout is below minTickInterval, so the reaper ticks
+	// every minTickInterval
+	p := &Proxy{ServerHostname: "127.0.0.1", ServerPort: server.addr().Port, IdleTimeout: 150 * time.Millisecond, ShutdownTimeout: time.Second}
+	proxyAddr, _, _ := runProxy(t, p)
+	client := newTestClient(t, proxyAddr)
+	client.handshake(t)
+	conns := p.sessions(0, netip.Addr{})
+	if len(conns) != 1 {
+		t.Fatalf("%d sessions, want 1", len(conns))
+	}
+
+	// A session active within the timeout is kept
+	p.activeListeners()[0].reapIdleConnections(time.Now(), time.Minute)
+	if n := len(p.sessions(0, netip.Addr{})); n != 1 {
+		t.Fatalf("%d sessions after reaping with a long timeout, want 1", n)
+	}
+
+	start := time.Now()
+	expectDisconnect(t, "client", client.readFrame(t, time.Second))
+	expectDisconnect(t, "server", expectServerFrame(t, server, time.Second))
+	if elapsed := time.Since(start); elapsed < p.IdleTimeout-50*time.Millisecond {
+		t.Errorf("session closed after %v, before the idle timeout", elapsed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(p.sessions(0, netip.Addr{})) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle session still listed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expectReleased(t, conns[0])
+}
+
+func TestNewTickerClamp(t *testing.T) {
+	for _, interval := range []time.Duration{-time.Second, 0, time.Nanosecond} {
+		start := time.Now()
+		ticker := newTicker(interval)
+		<-ticker.C
+		ticker.Stop()
+		if elapsed := time.Since(start); elapsed < minTickInterval {
+			t.Errorf("newTicker(%v) ticked after %v, want at least %v", interval, elapsed, minTickInterval)
+		}
+	}
+}
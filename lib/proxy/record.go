@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/recording"
+)
+
+// startRecording creates the recording of the connection, if the proxy
+// records sessions. Failing to create it does not stop the connection.
+func (pConn *proxyConnection) startRecording() {
+	if pConn.opts.recordDir == "" {
+		return
+	}
+
+	// Colons are not allowed in file names everywhere
+	client := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(pConn.clientAddrPort.String())
+	name := fmt.Sprintf("raknet-proxy-%s-%d-%s.jsonl", pConn.started.Format("20060102-150405.000"), pConn.opts.listenPort, client)
+	path := filepath.Join(pConn.opts.recordDir, name)
+	rec, err := recording.Create(path, recording.Header{
+		ListenPort: pConn.opts.listenPort,
+		Client:     pConn.clientAddrPort.String(),
+		Upstream:   pConn.upstream.name,
+		Started:    pConn.started,
+	})
+	if err != nil {
+		pConn.logf(log.Errorf, "unable to record session: %v", err)
+		return
+	}
+	pConn.logf(log.Debugf, "recording session to %v", path)
+	pConn.recording = rec
+}
+
+// record adds a payload to the recording, if any. Payloads from the client are
+// recorded as received, and those from the server as sent to the client,
+// after rewriting, as a replay through the proxy receives them.
+func (pConn *proxyConnection) record(direction Direction, payload UDPPayload) {
+	if pConn.recording == nil {
+		return
+	}
+	if err := pConn.recording.Write(direction.String(), time.Now(), payload); err != nil {
+		pConn.logf(log.Debugf, "unable to record payload: %v", err)
+	}
+}
+
+func (pConn *proxyConnection) stopRecording() {
+	if pConn.recording == nil {
+		return
+	}
+	if err := pConn.recording.Close(); err != nil {
+		pConn.logf(log.Errorf, "unable to close recording: %v", err)
+	}
+}
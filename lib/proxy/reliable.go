@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"math"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// maxTrackedSplits bounds the number of frames split by the proxy, and of
+// index shifts, remembered per flow
+const maxTrackedSplits int = 1024
+
+// reliableTranslator maps the reliable message indices of one flow, i.e. of
+// the frames sent by one side of the proxy, like sequenceTranslator does for
+// datagram sequence numbers. The mapping is the identity until the proxy
+// splits a frame that no longer fits in the MTU: every fragment needs an
+// index of its own, so the fragments get fresh indices following the latest
+// one the sender used, and the sender's later indices are shifted past them.
+// It is only used by the goroutine handling the flow.
+type reliableTranslator struct {
+	// Latest reliable index used by the sender
+	lastIn uint32
+	// Shifts of the sender's indices, oldest first. The indices after each
+	// entry's are shifted by its amount, up to the next entry.
+	shifts []reliableShift
+	// Shift of the indices older than every entry in shifts
+	base uint32
+
+	// Reliable frames split by the proxy, by the sender's index, so that
+	// retransmissions are split the same way and the receiver drops them as
+	// duplicates
+	splits     map[uint32]*proxySplit
+	splitOrder []uint32
+	// Split IDs of the proxy count down from the top, away from those of the
+	// sender, which count up from zero
+	nextSplitID uint16
+}
+
+type reliableShift struct {
+	after uint32
+	shift uint32
+}
+
+type proxySplit struct {
+	splitID uint16
+	outs    []uint32
+}
+
+func newReliableTranslator() *reliableTranslator {
+	return &reliableTranslator{
+		// The sender's first index is zero
+		lastIn:      raknet.SequenceNumberMask,
+		splits:      make(map[uint32]*proxySplit),
+		nextSplitID: math.MaxUint16,
+	}
+}
+
+// translate returns the index to present to the receiver for a frame the
+// sender gave reliable index in.
+func (t *reliableTranslator) translate(in uint32) uint32 {
+	if raknet.SequenceAfter(in, t.lastIn) {
+		t.lastIn = in
+	}
+	shift := t.base
+	for i := len(t.shifts) - 1; i >= 0; i-- {
+		if raknet.SequenceAfter(in, t.shifts[i].after) {
+			shift = t.shifts[i].shift
+			break
+		}
+	}
+	return (in + shift) & raknet.SequenceNumberMask
+}
+
+// reserve hands out n fresh indices following the latest one the sender
+// used, and shifts the sender's later indices past them.
+func (t *reliableTranslator) reserve(n int) []uint32 {
+	shift := t.base
+	if len(t.shifts) > 0 {
+		shift = t.shifts[len(t.shifts)-1].shift
+	}
+	outs := make([]uint32, n)
+	for i := range outs {
+		outs[i] = (t.lastIn + shift + 1 + uint32(i)) & raknet.SequenceNumberMask
+	}
+
+	shift += uint32(n)
+	if last := len(t.shifts) - 1; last >= 0 && t.shifts[last].after == t.lastIn {
+		t.shifts[last].shift = shift
+		return outs
+	}
+	t.shifts = append(t.shifts, reliableShift{after: t.lastIn, shift: shift})
+	if len(t.shifts) > maxTrackedSplits {
+		t.base = t.shifts[0].shift
+		t.shifts = t.shifts[1:]
+	}
+	return outs
+}
+
+// frames numbers the frames of a datagram for the receiver, splitting those
+// larger than maxFrameSize. It reports whether any frame changed.
+func (t *reliableTranslator) frames(frames []*raknet.Frame, maxFrameSize int) ([]*raknet.Frame, bool, error) {
+	out := make([]*raknet.Frame, 0, len(frames))
+	changed := false
+	for _, f := range frames {
+		if f.Size() > maxFrameSize && !f.Split {
+			fragments, err := t.split(f, maxFrameSize)
+			if err != nil {
+				return nil, false, err
+			}
+			out = append(out, fragments...)
+			changed = true
+			continue
+		}
+		if f.Reliability.IsReliable() {
+			index := t.translate(f.ReliableIndex)
+			changed = changed || index != f.ReliableIndex
+			f.ReliableIndex = index
+		}
+		out = append(out, f)
+	}
+	return out, changed, nil
+}
+
+// split splits a frame that does not fit in maxFrameSize, with a split ID of
+// the proxy's, numbering each fragment for the receiver.
+func (t *reliableTranslator) split(f *raknet.Frame, maxFrameSize int) ([]*raknet.Frame, error) {
+	fragments, err := raknet.SplitFrame(f, maxFrameSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := t.splitFor(f, len(fragments))
+	for i, fragment := range fragments {
+		fragment.SplitID = s.splitID
+		fragment.ReliableIndex = s.outs[i]
+	}
+	return fragments, nil
+}
+
+// splitFor returns the split ID and indices of the fragments of a frame. The
+// first fragment of a reliable frame takes the frame's own index.
+func (t *reliableTranslator) splitFor(f *raknet.Frame, count int) *proxySplit {
+	if !f.Reliability.IsReliable() {
+		return t.newSplit(t.reserve(count))
+	}
+	if s, ok := t.splits[f.ReliableIndex]; ok && len(s.outs) == count {
+		return s
+	}
+
+	first := t.translate(f.ReliableIndex)
+	s := t.newSplit(append([]uint32{first}, t.reserve(count-1)...))
+	if _, ok := t.splits[f.ReliableIndex]; !ok {
+		t.splitOrder = append(t.splitOrder, f.ReliableIndex)
+	}
+	t.splits[f.ReliableIndex] = s
+	if len(t.splitOrder) > maxTrackedSplits {
+		delete(t.splits, t.splitOrder[0])
+		t.splitOrder = t.splitOrder[1:]
+	}
+	return s
+}
+
+func (t *reliableTranslator) newSplit(outs []uint32) *proxySplit {
+	s := &proxySplit{splitID: t.nextSplitID, outs: outs}
+	t.nextSplitID--
+	return s
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+func TestSequenceDatagramSplitsOversizedFrame(t *testing.T) {
+	pConn := &proxyConnection{}
+	for i := range pConn.sequences {
+		pConn.sequences[i] = newSequenceTranslator()
+		pConn.reliables[i] = newReliableTranslator()
+	}
+	const mtu = 576
+	pConn.mtu.Store(mtu)
+	maxSize := raknet.MaxDatagramSize(mtu)
+
+	send := func(seq uint32, frames ...*raknet.Frame) []*raknet.Datagram {
+		t.Helper()
+		payload := (&raknet.Datagram{SequenceNumber: seq, Frames: frames}).Append(nil)
+		datagrams := []*raknet.Datagram{}
+		for _, part := range pConn.sequenceDatagram(FromServer, payload) {
+			if len(part) > maxSize {
+				t.Errorf("datagram of %d bytes exceeds %d", len(part), maxSize)
+			}
+			d, err := raknet.DecodeDatagram(part)
+			if err != nil {
+				t.Fatalf("DecodeDatagram: %v", err)
+			}
+			datagrams = append(datagrams, d)
+		}
+		return datagrams
+	}
+	frames := func(datagrams []*raknet.Datagram) []*raknet.Frame {
+		frames := []*raknet.Frame{}
+		for _, d := range datagrams {
+			frames = append(frames, d.Frames...)
+		}
+		return frames
+	}
+
+	small := send(0, &raknet.Frame{Reliability: raknet.ReliableOrdered, ReliableIndex: 0, Body: []byte{0x01}})
+	if got := frames(small); len(got) != 1 || got[0].ReliableIndex != 0 || got[0].Split {
+		t.Fatalf("small frame changed: %+v", got[0])
+	}
+
+	body := bytes.Repeat([]byte{0xfe}, 3*maxSize/2)
+	big := &raknet.Frame{Reliability: raknet.ReliableOrdered, ReliableIndex: 1, Body: body}
+	fragments := frames(send(1, big))
+	if len(fragments) != 2 {
+		t.Fatalf("got %d fragments, want 2", len(fragments))
+	}
+	reassembler := raknet.NewReassembler(16, 4, 1<<16)
+	for i, f := range fragments {
+		if !f.Split || f.SplitCount != 2 || f.SplitID != fragments[0].SplitID {
+			t.Errorf("fragment %d is not part of the split: %+v", i, f)
+		}
+		if want := uint32(1 + i); f.ReliableIndex != want {
+			t.Errorf("fragment %d has reliable index %d, want %d", i, f.ReliableIndex, want)
+		}
+		if message, err := reassembler.Add(f); err != nil {
+			t.Fatalf("Add: %v", err)
+		} else if message != nil && !bytes.Equal(message.Body, body) {
+			t.Errorf("reassembled body differs from the original")
+		}
+	}
+
+	// The sender's next index moves past the fragments, a retransmission is
+	// split the same way and a late frame keeps its index
+	next := frames(send(2, &raknet.Frame{Reliability: raknet.Reliable, ReliableIndex: 2, Body: []byte{0x02}}))
+	if next[0].ReliableIndex != 3 {
+		t.Errorf("next frame has reliable index %d, want 3", next[0].ReliableIndex)
+	}
+	resent := frames(send(3, &raknet.Frame{Reliability: raknet.ReliableOrdered, ReliableIndex: 1, Body: body}))
+	for i, f := range resent {
+		if f.SplitID != fragments[i].SplitID || f.ReliableIndex != fragments[i].ReliableIndex {
+			t.Errorf("retransmitted fragment %d is %d/%d, want %d/%d", i, f.SplitID, f.ReliableIndex, fragments[i].SplitID, fragments[i].ReliableIndex)
+		}
+	}
+	late := frames(send(4, &raknet.Frame{Reliability: raknet.Reliable, ReliableIndex: 0, Body: []byte{0x01}}))
+	if late[0].ReliableIndex != 0 {
+		t.Errorf("late frame has reliable index %d, want 0", late[0].ReliableIndex)
+	}
+}
+
+func TestReliableTranslatorUpgradesUnreliableSplits(t *testing.T) {
+	r := newReliableTranslator()
+	r.translate(4)
+
+	f := &raknet.Frame{Reliability: raknet.Unreliable, Body: make([]byte, 100)}
+	fragments, changed, err := r.frames([]*raknet.Frame{f}, 60)
+	if err != nil || !changed {
+		t.Fatalf("frames = %v, %v", changed, err)
+	}
+	for i, fragment := range fragments {
+		if fragment.Reliability != raknet.Reliable {
+			t.Errorf("fragment %d has reliability %d, want %d", i, fragment.Reliability, raknet.Reliable)
+		}
+		if want := uint32(5 + i); fragment.ReliableIndex != want {
+			t.Errorf("fragment %d has reliable index %d, want %d", i, fragment.ReliableIndex, want)
+		}
+	}
+	if got, want := r.translate(5), uint32(5+len(fragments)); got != want {
+		t.Errorf("translate(5) = %d, want %d", got, want)
+	}
+	if got := r.translate(4); got != 4 {
+		t.Errorf("translate(4) = %d, want 4", got)
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reresolveUpstreams re-resolves the hostnames of every route's upstreams
+// each interval, until ctx is cancelled. The standard resolver does not
+// expose record TTLs, so the interval stands in for them.
+func (p *Proxy) reresolveUpstreams(ctx context.Context) {
+	ticker := newTicker(p.ResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, l := range p.activeListeners() {
+				l.reresolveUpstreams()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reresolveUpstreams resolves the route's upstreams again, so that new proxy
+// connections go to the current addresses. Existing connections keep the
+// address they dialled. If any hostname fails to resolve, the current
+// addresses are kept.
+func (l *listener) reresolveUpstreams() {
+	current := l.settings.Load()
+	upstreams, err := newUpstreamPool(current.route, current.upstreams)
+	if err != nil {
+		log.Warnf("unable to re-resolve upstreams on %v, keeping current addresses: %v", l.listenAddr, err)
+		return
+	}
+	if !upstreams.changedFrom(current.upstreams) {
+		return
+	}
+
+	next := *current
+	next.upstreams = upstreams
+	// Reconfiguring in the meantime resolved the upstreams afresh anyway
+	if !l.settings.CompareAndSwap(current, &next) {
+		return
+	}
+	for _, u := range upstreams.upstreams {
+		if previous := current.upstreams.find(u.name); previous != nil && previous != u {
+			log.Infof("upstream %v resolved to %v, was %v", u, u.addr, previous.addr)
+		}
+	}
+}
+
+// changedFrom reports whether any of the pool's upstreams differ from those
+// of previous.
+func (pool *upstreamPool) changedFrom(previous *upstreamPool) bool {
+	if len(pool.upstreams) != len(previous.upstreams) {
+		return true
+	}
+	for i, u := range pool.upstreams {
+		if u != previous.upstreams[i] {
+			return true
+		}
+	}
+	return false
+}
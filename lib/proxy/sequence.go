@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+const (
+	// maxTrackedSequences bounds the number of unacknowledged sequence
+	// numbers remembered per flow. Older entries are forgotten, and ACKs or
+	// NACKs for them are dropped.
+	maxTrackedSequences int = 1 << 16
+	// maxSequenceGap bounds the number of sequence numbers reserved for
+	// datagrams that were skipped by the sender's numbering
+	maxSequenceGap uint32 = 1024
+	// injectedResendTimeout is how long a datagram injected by the proxy may
+	// go unacknowledged before the proxy sends it again
+	injectedResendTimeout = time.Second
+)
+
+// sequenceTranslator maps the datagram sequence numbers of one flow, i.e.
+// the datagrams sent by one side of the proxy, between the sender's
+// numbering and the numbering presented to the receiver. As long as the
+// proxy only forwards datagrams, the mapping is the identity. Once the proxy
+// injects datagrams of its own, later datagrams are shifted so that the
+// receiver still sees a contiguous sequence, and ACKs and NACKs coming back
+// are mapped to the sender's numbering.
+//
+// Gaps in the sender's numbering, i.e. datagrams lost before reaching the
+// proxy, are preserved so that the receiver NACKs them as usual, and a late
+// datagram takes the slot reserved for it.
+type sequenceTranslator struct {
+	mu sync.Mutex
+
+	started bool
+	lastIn  uint32
+	nextOut uint32
+
+	// Sender sequence number of every unacknowledged forwarded datagram,
+	// keyed by the sequence number the receiver saw
+	outToIn map[uint32]uint32
+	// Receiver sequence number reserved for datagrams skipped by the sender
+	reserved map[uint32]uint32
+	// Datagrams created by the proxy, which it is responsible for resending
+	injected map[uint32]*injectedDatagram
+	// Receiver sequence numbers in the order they were handed out, for
+	// forgetting the oldest entries
+	order []uint32
+}
+
+type injectedDatagram struct {
+	payload UDPPayload
+	sentAt  time.Time
+}
+
+func newSequenceTranslator() *sequenceTranslator {
+	return &sequenceTranslator{
+		outToIn:  make(map[uint32]uint32),
+		reserved: make(map[uint32]uint32),
+		injected: make(map[uint32]*injectedDatagram),
+	}
+}
+
+// forward returns the sequence number to present to the receiver for a
+// datagram the sender numbered in.
+func (t *sequenceTranslator) forward(in uint32) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if out, ok := t.reserved[in]; ok {
+		delete(t.reserved, in)
+		return out
+	}
+
+	switch {
+	case !t.started:
+		t.started = true
+		t.nextOut = in
+	case raknet.SequenceAfter(in, t.lastIn):
+		t.reserveGap(in)
+	default:
+		// A duplicate or a datagram older than anything still reserved. Give
+		// it a fresh number so the receiver does not drop it as a duplicate.
+		return t.assign(in)
+	}
+	t.lastIn = in
+	return t.assign(in)
+}
+
+// reserveGap reserves receiver sequence numbers for every sender sequence
+// number skipped between the last forwarded datagram and in.
+func (t *sequenceTranslator) reserveGap(in uint32) {
+	gap := (in - t.lastIn - 1) & raknet.SequenceNumberMask
+	if gap > maxSequenceGap {
+		gap = maxSequenceGap
+	}
+	for i := uint32(1); i <= gap; i++ {
+		skipped := (in - gap - 1 + i) & raknet.SequenceNumberMask
+		t.reserved[skipped] = t.assign(skipped)
+	}
+}
+
+func (t *sequenceTranslator) assign(in uint32) uint32 {
+	out := t.next()
+	t.outToIn[out] = in
+	return out
+}
+
+func (t *sequenceTranslator) next() uint32 {
+	out := t.nextOut
+	t.nextOut = (t.nextOut + 1) & raknet.SequenceNumberMask
+	t.order = append(t.order, out)
+	if len(t.order) > maxTrackedSequences {
+		t.forget(t.order[0])
+		t.order = t.order[1:]
+	}
+	return out
+}
+
+func (t *sequenceTranslator) forget(out uint32) {
+	if in, ok := t.outToIn[out]; ok {
+		delete(t.outToIn, out)
+		if t.reserved[in] == out {
+			delete(t.reserved, in)
+		}
+	}
+	delete(t.injected, out)
+}
+
+// inject numbers a datagram created by the proxy and remembers it until the
+// receiver acknowledges it. The payload is numbered in place.
+func (t *sequenceTranslator) inject(payload UDPPayload) UDPPayload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started {
+		t.started = true
+	}
+	out := t.next()
+	raknet.PutSequenceNumber(payload, out)
+	t.injected[out] = &injectedDatagram{payload: payload, sentAt: time.Now()}
+	return payload
+}
+
+// acknowledge maps sequence numbers the receiver ACKed back to the sender's
+// numbering. Datagrams injected by the proxy are acknowledged to the proxy
+// alone and do not appear in the result.
+func (t *sequenceTranslator) acknowledge(outs []uint32) []uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ins := []uint32{}
+	for _, out := range outs {
+		if in, ok := t.outToIn[out]; ok {
+			ins = append(ins, in)
+		}
+		t.forget(out)
+	}
+	return ins
+}
+
+// negativeAcknowledge maps sequence numbers the receiver NACKed back to the
+// sender's numbering, so the sender resends their frames. Datagrams injected
+// by the proxy are renumbered and returned for the proxy to resend itself.
+func (t *sequenceTranslator) negativeAcknowledge(outs []uint32) ([]uint32, []UDPPayload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ins := []uint32{}
+	resend := []UDPPayload{}
+	for _, out := range outs {
+		if injected, ok := t.injected[out]; ok {
+			resend = append(resend, t.reinject(out, injected))
+			continue
+		}
+		if in, ok := t.outToIn[out]; ok {
+			ins = append(ins, in)
+		}
+		t.forget(out)
+	}
+	return ins, resend
+}
+
+// expired renumbers and returns the injected datagrams that have gone
+// unacknowledged for too long.
+func (t *sequenceTranslator) expired(now time.Time) []UDPPayload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	resend := []UDPPayload{}
+	for out, injected := range t.injected {
+		if now.Sub(injected.sentAt) > injectedResendTimeout {
+			resend = append(resend, t.reinject(out, injected))
+		}
+	}
+	return resend
+}
+
+// reinject renumbers an injected datagram for resending. The payload is
+// copied, as the previous copy may still be in the middle of being written.
+func (t *sequenceTranslator) reinject(out uint32, injected *injectedDatagram) UDPPayload {
+	delete(t.injected, out)
+	next := t.next()
+	payload := append(UDPPayload{}, injected.payload...)
+	raknet.PutSequenceNumber(payload, next)
+	t.injected[next] = &injectedDatagram{payload: payload, sentAt: time.Now()}
+	return payload
+}
+
+// sequencePayload translates the datagram sequence numbers in a payload from
+// the given direction. It returns the payloads to forward to the other side,
+// and the payloads to send back to the sender: datagrams injected by the
+// proxy that the sender NACKed.
+func (pConn *proxyConnection) sequencePayload(from Direction, payload UDPPayload) ([]UDPPayload, []UDPPayload) {
+	forward := []UDPPayload{payload}
+	back := []UDPPayload{}
+	switch {
+	case raknet.IsDatagram(payload):
+		forward = pConn.sequenceDatagram(from, payload)
+	case raknet.IsAcknowledgement(payload):
+		forward, back = pConn.sequenceAcknowledgement(from, payload)
+	}
+
+	// Injected datagrams travel the same way as the sender's own, so resend
+	// the expired ones along with this payload
+	forward = append(forward, pConn.sequences[from].expired(time.Now())...)
+	return forward, back
+}
+
+// sequenceDatagram numbers a datagram for the receiver. A datagram that no
+// longer fits in the MTU, because a rewrite grew it or because of the PROXY
+// protocol header prepended to it, is split in several: the first takes the
+// original's place, the others are injected.
+func (pConn *proxyConnection) sequenceDatagram(from Direction, payload UDPPayload) []UDPPayload {
+	t := pConn.sequences[from]
+	maxSize := len(payload)
+	if mtu := pConn.mtu.Load(); mtu > 0 {
+		// The room left for the PROXY protocol header is taken back, less the
+		// header this datagram gets on its way to the upstream
+		maxSize = raknet.MaxDatagramSize(uint16(mtu+pConn.headerRoom.Load())) - pConn.proxyHeaderSize(from)
+	}
+	parts := pConn.fitDatagram(from, payload, maxSize)
+	if len(parts) > 1 {
+		pConn.logf(log.Tracef, "split %d byte datagram from %v in %d to fit in %d bytes", len(payload), from, len(parts), maxSize)
+	}
+
+	raknet.PutSequenceNumber(parts[0], t.forward(raknet.SequenceNumber(parts[0])))
+	for _, part := range parts[1:] {
+		t.inject(part)
+	}
+	return parts
+}
+
+// fitDatagram numbers the reliable frames of a datagram for the receiver,
+// splitting a frame that no longer fits in maxSize on its own, then packs
+// the frames in as many datagrams of at most maxSize as they need.
+func (pConn *proxyConnection) fitDatagram(from Direction, payload UDPPayload, maxSize int) []UDPPayload {
+	d, err := raknet.DecodeDatagram(payload)
+	if err != nil {
+		return []UDPPayload{payload}
+	}
+	frames, changed, err := pConn.reliables[from].frames(d.Frames, maxSize-raknet.DatagramHeaderSize)
+	if err != nil {
+		pConn.logf(log.Debugf, "unable to split frames from %v, forwarding unchanged: %v", from, err)
+		return []UDPPayload{payload}
+	}
+	if !changed && len(payload) <= maxSize {
+		return []UDPPayload{payload}
+	}
+
+	d.Frames = frames
+	parts := []UDPPayload{}
+	for _, part := range raknet.SplitDatagram(d, maxSize) {
+		parts = append(parts, part.Append(nil))
+	}
+	return parts
+}
+
+// sequenceAcknowledgement maps an ACK or NACK to the numbering of the side
+// that sent the acknowledged datagrams, which is the other side of the proxy.
+// Acknowledgements that only concern datagrams injected by the proxy are not
+// forwarded.
+func (pConn *proxyConnection) sequenceAcknowledgement(from Direction, payload UDPPayload) ([]UDPPayload, []UDPPayload) {
+	t := pConn.sequences[from.other()]
+	ack, err := raknet.DecodeAcknowledgement(payload)
+	if err == nil {
+		var outs []uint32
+		if outs, err = ack.Sequences(); err == nil {
+			return pConn.translateAcknowledgement(t, ack.NACK, outs)
+		}
+	}
+
+	pConn.logf(log.Debugf, "unable to translate acknowledgement from %v, forwarding unchanged: %v", from, err)
+	return []UDPPayload{payload}, []UDPPayload{}
+}
+
+func (pConn *proxyConnection) translateAcknowledgement(t *sequenceTranslator, nack bool, outs []uint32) ([]UDPPayload, []UDPPayload) {
+	var ins []uint32
+	back := []UDPPayload{}
+	if nack {
+		ins, back = t.negativeAcknowledge(outs)
+	} else {
+		ins = t.acknowledge(outs)
+	}
+	if len(ins) == 0 {
+		return []UDPPayload{}, back
+	}
+
+	sort.Slice(ins, func(i, j int) bool { return ins[i] < ins[j] })
+	return []UDPPayload{raknet.NewAcknowledgement(nack, ins).Append(nil)}, back
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+func TestSequenceTranslatorForward(t *testing.T) {
+	tests := []struct {
+		name string
+		ins  []uint32
+		want []uint32
+	}{
+		{"identity", []uint32{0, 1, 2, 3}, []uint32{0, 1, 2, 3}},
+		{"identity from any start", []uint32{100, 101, 102}, []uint32{100, 101, 102}},
+		{"gap filled late", []uint32{0, 3, 4, 2, 1}, []uint32{0, 3, 4, 2, 1}},
+		{"duplicate", []uint32{0, 1, 1, 2}, []uint32{0, 1, 2, 3}},
+		{"older than anything reserved", []uint32{10, 11, 5}, []uint32{10, 11, 12}},
+		{"wraparound", []uint32{0xfffffe, 0xffffff, 0, 1}, []uint32{0xfffffe, 0xffffff, 0, 1}},
+		{"gap across wraparound", []uint32{0xfffffe, 1, 0, 0xffffff}, []uint32{0xfffffe, 1, 0, 0xffffff}},
+		// Only the latest maxSequenceGap skipped numbers are reserved
+		{"gap over the limit", []uint32{0, 2000, 1999, 976, 975}, []uint32{0, 1025, 1024, 1, 1026}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newSequenceTranslator()
+			got := []uint32{}
+			for _, in := range tt.ins {
+				got = append(got, tr.forward(in))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("forward(%v) = %v, want %v", tt.ins, got, tt.want)
+			}
+		})
+	}
+}
+
+// newInjectedPayload returns an encoded datagram for the proxy to inject
+func newInjectedPayload(body byte) UDPPayload {
+	return (&raknet.Datagram{Frames: []*raknet.Frame{{Reliability: raknet.Unreliable, Body: []byte{body}}}}).Append(nil)
+}
+
+func TestSequenceTranslatorInjected(t *testing.T) {
+	tests := []struct {
+		name string
+		// First sender sequence number, and whether each datagram came from
+		// the sender rather than being injected by the proxy
+		start uint32
+		sent  []bool
+		acks  []uint32
+		nack  bool
+		// Sequence numbers passed on to the sender, and those the proxy
+		// resends itself
+		wantIns    []uint32
+		wantResent []uint32
+	}{
+		{
+			name:    "injected hidden from ACKs",
+			start:   0,
+			sent:    []bool{true, false, true},
+			acks:    []uint32{0, 1, 2},
+			wantIns: []uint32{0, 1},
+		},
+		{
+			name:    "ACK of injected only",
+			start:   0,
+			sent:    []bool{true, false},
+			acks:    []uint32{1},
+			wantIns: []uint32{},
+		},
+		{
+			name:       "NACK of injected re-injects it",
+			start:      0,
+			sent:       []bool{true, false, true},
+			acks:       []uint32{1, 2},
+			nack:       true,
+			wantIns:    []uint32{1},
+			wantResent: []uint32{3},
+		},
+		{
+			name:    "wraparound",
+			start:   0xfffffe,
+			sent:    []bool{true, false, true, true},
+			acks:    []uint32{0xfffffe, 0xffffff, 0, 1},
+			wantIns: []uint32{0xfffffe, 0xffffff, 0},
+		},
+		{
+			name:       "NACK across wraparound",
+			start:      0xfffffe,
+			sent:       []bool{true, false, true},
+			acks:       []uint32{0xffffff, 0},
+			nack:       true,
+			wantIns:    []uint32{0xffffff},
+			wantResent: []uint32{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newSequenceTranslator()
+			in := tt.start
+			for i, fromSender := range tt.sent {
+				if fromSender {
+					tr.forward(in)
+					in = (in + 1) & raknet.SequenceNumberMask
+					continue
+				}
+				tr.inject(newInjectedPayload(byte(i)))
+			}
+
+			var ins []uint32
+			resent := []uint32{}
+			if tt.nack {
+				var payloads []UDPPayload
+				ins, payloads = tr.negativeAcknowledge(tt.acks)
+				for _, payload := range payloads {
+					resent = append(resent, raknet.SequenceNumber(payload))
+				}
+			} else {
+				ins = tr.acknowledge(tt.acks)
+			}
+			if !reflect.DeepEqual(ins, tt.wantIns) {
+				t.Errorf("sender sequences = %v, want %v", ins, tt.wantIns)
+			}
+			if tt.wantResent == nil {
+				tt.wantResent = []uint32{}
+			}
+			if !reflect.DeepEqual(resent, tt.wantResent) {
+				t.Errorf("resent sequences = %v, want %v", resent, tt.wantResent)
+			}
+		})
+	}
+}
+
+func TestSequenceTranslatorExpiry(t *testing.T) {
+	tr := newSequenceTranslator()
+	tr.forward(0)
+	payload := tr.inject(newInjectedPayload(0x15))
+	now := time.Now()
+
+	if resent := tr.expired(now); len(resent) != 0 {
+		t.Errorf("expired before the timeout = %d payloads", len(resent))
+	}
+	resent := tr.expired(now.Add(2 * injectedResendTimeout))
+	if len(resent) != 1 {
+		t.Fatalf("expired after the timeout = %d payloads, want 1", len(resent))
+	}
+	if seq := raknet.SequenceNumber(resent[0]); seq != 2 {
+		t.Errorf("resent with sequence number %d, want 2", seq)
+	}
+	if raknet.SequenceNumber(payload) != 1 {
+		t.Errorf("resending changed the payload in flight")
+	}
+	if string(resent[0][raknet.DatagramHeaderSize:]) != string(payload[raknet.DatagramHeaderSize:]) {
+		t.Errorf("resent frames % x, want % x", resent[0], payload)
+	}
+
+	// Once acknowledged, it is not resent again
+	if ins := tr.acknowledge([]uint32{2}); len(ins) != 0 {
+		t.Errorf("ACK of the resent datagram passed on as %v", ins)
+	}
+	if resent := tr.expired(now.Add(4 * injectedResendTimeout)); len(resent) != 0 {
+		t.Errorf("expired after its ACK = %d payloads", len(resent))
+	}
+}
+
+func TestSequencePayload(t *testing.T) {
+	pConn := &proxyConnection{}
+	for i := range pConn.sequences {
+		pConn.sequences[i] = newSequenceTranslator()
+		pConn.reliables[i] = newReliableTranslator()
+	}
+	datagram := func(seq uint32) UDPPayload {
+		return (&raknet.Datagram{SequenceNumber: seq, Frames: []*raknet.Frame{{Reliability: raknet.Unreliable, Body: []byte{0xfe}}}}).Append(nil)
+	}
+	forward := func(seq uint32) uint32 {
+		t.Helper()
+		payloads, back := pConn.sequencePayload(FromServer, datagram(seq))
+		if len(payloads) != 1 || len(back) != 0 {
+			t.Fatalf("sequencePayload = %d, %d payloads", len(payloads), len(back))
+		}
+		return raknet.SequenceNumber(payloads[0])
+	}
+
+	if got := forward(5); got != 5 {
+		t.Errorf("first datagram numbered %d, want 5", got)
+	}
+	pConn.sequences[FromServer].inject(newInjectedPayload(0x15))
+	if got := forward(6); got != 7 {
+		t.Errorf("datagram after an injected one numbered %d, want 7", got)
+	}
+
+	// The client's ACK reaches the server in its own numbering, without the
+	// injected datagram
+	ack := raknet.NewAcknowledgement(false, []uint32{5, 6, 7}).Append(nil)
+	payloads, back := pConn.sequencePayload(FromClient, ack)
+	if len(payloads) != 1 || len(back) != 0 {
+		t.Fatalf("sequencePayload of an ACK = %d, %d payloads", len(payloads), len(back))
+	}
+	translated, err := raknet.DecodeAcknowledgement(payloads[0])
+	if err != nil {
+		t.Fatalf("DecodeAcknowledgement: %v", err)
+	}
+	if want := []raknet.SequenceRange{{Start: 5, End: 6}}; translated.NACK || !reflect.DeepEqual(translated.Ranges, want) {
+		t.Errorf("translated ACK = %+v, want ranges %v", translated, want)
+	}
+
+	// A NACK of an injected datagram goes back to the client, not on to the
+	// server
+	pConn.sequences[FromServer].inject(newInjectedPayload(0x15))
+	nack := raknet.NewAcknowledgement(true, []uint32{8}).Append(nil)
+	payloads, back = pConn.sequencePayload(FromClient, nack)
+	if len(payloads) != 0 || len(back) != 1 {
+		t.Fatalf("sequencePayload of a NACK = %d, %d payloads, want 0, 1", len(payloads), len(back))
+	}
+	if seq := raknet.SequenceNumber(back[0]); seq != 9 {
+		t.Errorf("re-injected datagram numbered %d, want 9", seq)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// sessionTable holds the active proxy connections keyed by the full client
+// address (IP and port), so that clients behind different IPs that happen to
+// share a source port are kept apart. It is safe for concurrent use.
+type sessionTable struct {
+	mu    sync.RWMutex
+	conns map[netip.AddrPort]*proxyConnection
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		conns: make(map[netip.AddrPort]*proxyConnection),
+	}
+}
+
+func (t *sessionTable) get(addr netip.AddrPort) (*proxyConnection, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	pConn, ok := t.conns[unmapAddrPort(addr)]
+	return pConn, ok
+}
+
+func (t *sessionTable) add(addr netip.AddrPort, pConn *proxyConnection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conns[unmapAddrPort(addr)] = pConn
+}
+
+// remove deletes the connection from the table, but only if it is still the
+// connection registered for its client address. A newer connection for the
+// same client is left alone.
+func (t *sessionTable) remove(pConn *proxyConnection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := unmapAddrPort(pConn.clientAddrPort)
+	if t.conns[key] == pConn {
+		delete(t.conns, key)
+	}
+}
+
+// all returns a snapshot of every connection in the table.
+func (t *sessionTable) all() []*proxyConnection {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	conns := make([]*proxyConnection, 0, len(t.conns))
+	for _, pConn := range t.conns {
+		conns = append(conns, pConn)
+	}
+	return conns
+}
+
+func (t *sessionTable) len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.conns)
+}
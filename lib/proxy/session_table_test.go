@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSessionTableIsolatesClientsSharingAPort(t *testing.T) {
+	table := newSessionTable()
+	a := &proxyConnection{clientAddrPort: netip.MustParseAddrPort("198.51.100.1:19132")}
+	b := &proxyConnection{clientAddrPort: netip.MustParseAddrPort("198.51.100.2:19132")}
+	table.add(a.clientAddrPort, a)
+	table.add(b.clientAddrPort, b)
+
+	if got, ok := table.get(a.clientAddrPort); !ok || got != a {
+		t.Fatalf("get(%v) = %p, %v, want %p", a.clientAddrPort, got, ok, a)
+	}
+	if got, ok := table.get(b.clientAddrPort); !ok || got != b {
+		t.Fatalf("get(%v) = %p, %v, want %p", b.clientAddrPort, got, ok, b)
+	}
+	if n := table.len(); n != 2 {
+		t.Fatalf("len() = %d, want 2", n)
+	}
+
+	table.remove(a)
+	if _, ok := table.get(a.clientAddrPort); ok {
+		t.Errorf("get(%v) found a removed session", a.clientAddrPort)
+	}
+	if got, ok := table.get(b.clientAddrPort); !ok || got != b {
+		t.Errorf("get(%v) = %p, %v after removing %v, want %p", b.clientAddrPort, got, ok, a.clientAddrPort, b)
+	}
+}
+
+func TestSessionTableUnmapsIPv4MappedAddresses(t *testing.T) {
+	table := newSessionTable()
+	plain := netip.MustParseAddrPort("198.51.100.1:19132")
+	mapped := netip.MustParseAddrPort("[::ffff:198.51.100.1]:19132")
+	other := netip.MustParseAddrPort("[2001:db8::1]:19132")
+	a := &proxyConnection{clientAddrPort: plain}
+	b := &proxyConnection{clientAddrPort: other}
+	table.add(mapped, a)
+	table.add(other, b)
+
+	for _, addr := range []netip.AddrPort{plain, mapped} {
+		if got, ok := table.get(addr); !ok || got != a {
+			t.Errorf("get(%v) = %p, %v, want %p", addr, got, ok, a)
+		}
+	}
+	if n := table.len(); n != 2 {
+		t.Fatalf("len() = %d, want 2", n)
+	}
+
+	table.remove(a)
+	if _, ok := table.get(mapped); ok {
+		t.Errorf("get(%v) found a removed session", mapped)
+	}
+	if got, ok := table.get(other); !ok || got != b {
+		t.Errorf("get(%v) = %p, %v, want %p", other, got, ok, b)
+	}
+}
+
+func TestSessionTableRemoveKeepsNewerSession(t *testing.T) {
+	table := newSessionTable()
+	addr := netip.MustParseAddrPort("198.51.100.1:19132")
+	old := &proxyConnection{clientAddrPort: addr}
+	newer := &proxyConnection{clientAddrPort: addr}
+	table.add(addr, old)
+	table.add(addr, newer)
+
+	table.remove(old)
+	if got, ok := table.get(addr); !ok || got != newer {
+		t.Errorf("get(%v) = %p, %v after removing the old session, want %p", addr, got, ok, newer)
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// SessionStatus is a snapshot of a proxy connection's state.
+type SessionStatus struct {
+	ListenPort        int
+	ClientAddr        netip.AddrPort
+	Upstream          string
+	ServerAddr        string
+	ProxyAsClientAddr string
+	Started           time.Time
+
+	// Traffic received from each side, indexed by Direction
+	LastActivity [2]time.Time
+	Payloads     [2]uint64
+	Bytes        [2]uint64
+	// Backlog is the number of payloads from each side waiting to be proxied
+	Backlog [2]int
+	// RTT is the latest round trip time from the proxy to each side, zero
+	// until a connected ping has been answered
+	RTT [2]time.Duration
+	// MTU is zero until the offline handshake has completed
+	MTU uint32
+	// Errors counts socket errors by class
+	Errors map[string]uint64
+}
+
+// Sessions returns the state of every proxy connection, ordered by listen
+// port and client address.
+func (p *Proxy) Sessions() []SessionStatus {
+	statuses := []SessionStatus{}
+	for _, pConn := range p.sessions(0, netip.Addr{}) {
+		statuses = append(statuses, pConn.status())
+	}
+	return statuses
+}
+
+// Session returns the state of the proxy connection for a client. A listen
+// port of zero matches any route; if the client has connections on several,
+// the one with the lowest port is returned.
+func (p *Proxy) Session(listenPort int, client netip.AddrPort) (SessionStatus, bool) {
+	pConn := p.session(listenPort, client)
+	if pConn == nil {
+		return SessionStatus{}, false
+	}
+	return pConn.status(), true
+}
+
+// Disconnect tells both sides of a client's proxy connection that it is over
+// and closes it, reporting whether there was one. A listen port of zero
+// matches any route, as in Session.
+func (p *Proxy) Disconnect(listenPort int, client netip.AddrPort) bool {
+	pConn := p.session(listenPort, client)
+	if pConn == nil {
+		return false
+	}
+	pConn.disconnect("disconnected by admin")
+	return true
+}
+
+func (p *Proxy) session(listenPort int, client netip.AddrPort) *proxyConnection {
+	if !p.running.Load() {
+		return nil
+	}
+	client = unmapAddrPort(client)
+	for _, l := range p.activeListeners() {
+		if listenPort != 0 && l.route.ListenPort != listenPort {
+			continue
+		}
+		if pConn, ok := l.sessions.get(client); ok {
+			return pConn
+		}
+	}
+	return nil
+}
+
+// sessions returns the proxy connections on a route, or on every route if
+// listenPort is zero, from a client IP, or from any client if addr is
+// invalid
+func (p *Proxy) sessions(listenPort int, addr netip.Addr) []*proxyConnection {
+	if !p.running.Load() {
+		return nil
+	}
+	conns := []*proxyConnection{}
+	for _, l := range p.activeListeners() {
+		if listenPort != 0 && l.route.ListenPort != listenPort {
+			continue
+		}
+		for _, pConn := range l.sessions.all() {
+			if !addr.IsValid() || pConn.clientAddrPort.Addr() == addr.Unmap() {
+				conns = append(conns, pConn)
+			}
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		a, b := conns[i], conns[j]
+		if a.opts.listenPort != b.opts.listenPort {
+			return a.opts.listenPort < b.opts.listenPort
+		}
+		if a.clientAddrPort.Addr() != b.clientAddrPort.Addr() {
+			return a.clientAddrPort.Addr().Less(b.clientAddrPort.Addr())
+		}
+		return a.clientAddrPort.Port() < b.clientAddrPort.Port()
+	})
+	return conns
+}
+
+func (pConn *proxyConnection) status() SessionStatus {
+	status := SessionStatus{
+		ListenPort:        pConn.opts.listenPort,
+		ClientAddr:        pConn.clientAddrPort,
+		Upstream:          pConn.upstream.name,
+		ServerAddr:        pConn.serverAddr.String(),
+		ProxyAsClientAddr: pConn.proxyAsClientAddr.String(),
+		Started:           pConn.started,
+		LastActivity: [2]time.Time{
+			FromClient: time.Unix(0, pConn.lastActivityFromClient.Load()),
+			FromServer: time.Unix(0, pConn.lastActivityFromServer.Load()),
+		},
+		Backlog: [2]int{
+			FromClient: len(pConn.payloadsFromClientChan),
+			FromServer: len(pConn.payloadsFromServerChan),
+		},
+		MTU:    pConn.mtu.Load(),
+		Errors: map[string]uint64{},
+	}
+	for _, d := range []Direction{FromClient, FromServer} {
+		status.Payloads[d] = pConn.payloads[d].Load()
+		status.Bytes[d] = pConn.bytes[d].Load()
+		status.RTT[d] = time.Duration(pConn.rtt[d].Load())
+	}
+	for class := errorClass(0); class < errorClassCount; class++ {
+		if n := pConn.errorCounts[class].Load(); n > 0 {
+			status.Errors[class.String()] = n
+		}
+	}
+	return status
+}
+
+// countReceived records a payload from one side of the connection
+func (pConn *proxyConnection) countReceived(direction Direction, payload UDPPayload) {
+	pConn.payloads[direction].Add(1)
+	pConn.bytes[direction].Add(uint64(len(payload)))
+	pConn.opts.metrics.received(direction, payload)
+	if direction == FromClient {
+		pConn.record(FromClient, payload)
+		pConn.capture(captureInterfaceClient, pConn.clientAddr, pConn.proxyAsServerAddr, true, payload)
+	} else {
+		pConn.capture(captureInterfaceUpstream, pConn.serverAddr, pConn.proxyAsClientAddr, true, payload)
+	}
+}
+
+// disconnect notifies both sides that the connection is over and closes it
+// straight away, without draining payloads in flight.
+func (pConn *proxyConnection) disconnect(reason string) {
+	pConn.sendDisconnectNotifications()
+	pConn.close(reason)
+}
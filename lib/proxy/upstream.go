@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Upstream is a RakNet server that a route can proxy clients to.
+type Upstream struct {
+	Hostname string
+	Port     int
+
+	// Weight is the upstream's relative share of new sessions under the
+	// weighted and hash policies. Zero counts as 1.
+	Weight int
+}
+
+// BalancePolicy chooses which of a route's upstreams a new session is
+// proxied to.
+type BalancePolicy string
+
+const (
+	// BalanceRoundRobin takes the upstreams in turn
+	BalanceRoundRobin BalancePolicy = "round-robin"
+	// BalanceLeastSessions takes the upstream with the fewest sessions
+	BalanceLeastSessions BalancePolicy = "least-sessions"
+	// BalanceWeighted takes the upstreams in turn, in proportion to their
+	// weights
+	BalanceWeighted BalancePolicy = "weighted"
+	// BalanceHash takes an upstream by consistent hashing of the client's
+	// IP, so a client keeps returning to the same upstream
+	BalanceHash BalancePolicy = "hash"
+
+	DefaultBalancePolicy = BalanceRoundRobin
+)
+
+var BalancePolicies = []BalancePolicy{BalanceRoundRobin, BalanceLeastSessions, BalanceWeighted, BalanceHash}
+
+// hashReplicas is the number of points each unit of weight has on the
+// consistent hash ring
+const hashReplicas = 64
+
+// upstream is a resolved Upstream. It outlives reconfiguration, as long as
+// the upstream stays in the route.
+type upstream struct {
+	name   string
+	addr   *net.UDPAddr
+	weight int
+
+	*upstreamState
+}
+
+// upstreamState is the state shared by the sessions proxied to an upstream.
+// It is keyed by the upstream's name, and is carried over when the upstream
+// resolves to a new address or changes weight, so that DNS rotation does not
+// reset its session count or health history.
+type upstreamState struct {
+	healthy  atomic.Bool
+	sessions atomic.Int64
+	health   upstreamHealth
+}
+
+func newUpstreamState() *upstreamState {
+	state := &upstreamState{}
+	state.healthy.Store(true)
+	return state
+}
+
+func (u *upstream) String() string {
+	return u.name
+}
+
+// upstreamPool picks the upstream for each new session on a route
+type upstreamPool struct {
+	policy    BalancePolicy
+	upstreams []*upstream
+
+	next atomic.Uint64
+
+	// Smooth weighted round-robin state, indexed like upstreams
+	mu            sync.Mutex
+	currentWeight []int
+
+	// Consistent hash ring, sorted by hash
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream *upstream
+}
+
+// newUpstreamPool resolves the route's upstreams. Upstreams that were already
+// in previous keep their health and session counts, even if their address
+// changed.
+func newUpstreamPool(route Route, previous *upstreamPool) (*upstreamPool, error) {
+	policy := route.Balance
+	if policy == "" {
+		policy = DefaultBalancePolicy
+	}
+	if !policy.valid() {
+		return nil, fmt.Errorf("unknown balance policy %q, valid policies: %v", policy, BalancePolicies)
+	}
+
+	pool := &upstreamPool{policy: policy}
+	for _, u := range route.upstreams() {
+		resolved, err := resolveUpstream(u, previous)
+		if err != nil {
+			return nil, err
+		}
+		pool.upstreams = append(pool.upstreams, resolved)
+	}
+	pool.currentWeight = make([]int, len(pool.upstreams))
+	if policy == BalanceHash {
+		pool.buildRing()
+	}
+	return pool, nil
+}
+
+func resolveUpstream(u Upstream, previous *upstreamPool) (*upstream, error) {
+	name := net.JoinHostPort(u.Hostname, strconv.Itoa(u.Port))
+	addr, err := net.ResolveUDPAddr("udp", name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve server %v: %w", name, err)
+	}
+
+	weight := u.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	existing := previous.find(name)
+	if existing == nil {
+		return &upstream{name: name, addr: addr, weight: weight, upstreamState: newUpstreamState()}, nil
+	}
+	if existing.addr.String() == addr.String() && existing.weight == weight {
+		return existing, nil
+	}
+	return &upstream{name: name, addr: addr, weight: weight, upstreamState: existing.upstreamState}, nil
+}
+
+func (p BalancePolicy) valid() bool {
+	for _, policy := range BalancePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *upstreamPool) find(name string) *upstream {
+	if pool == nil {
+		return nil
+	}
+	for _, u := range pool.upstreams {
+		if u.name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// pick chooses the upstream for a new session from client, skipping
+// unhealthy upstreams.
+func (pool *upstreamPool) pick(client netip.Addr) (*upstream, error) {
+	var u *upstream
+	switch pool.policy {
+	case BalanceLeastSessions:
+		u = pool.pickLeastSessions()
+	case BalanceWeighted:
+		u = pool.pickWeighted()
+	case BalanceHash:
+		u = pool.pickHash(client)
+	default:
+		u = pool.pickRoundRobin()
+	}
+	if u == nil {
+		return nil, fmt.Errorf("no healthy upstream among %v", pool.upstreams)
+	}
+	return u, nil
+}
+
+// firstHealthy returns the first of the pool's upstreams that is healthy,
+// or nil if none are.
+func (pool *upstreamPool) firstHealthy() *upstream {
+	for _, u := range pool.upstreams {
+		if u.healthy.Load() {
+			return u
+		}
+	}
+	return nil
+}
+
+func (pool *upstreamPool) pickRoundRobin() *upstream {
+	start := pool.next.Add(1) - 1
+	for i := range pool.upstreams {
+		u := pool.upstreams[(start+uint64(i))%uint64(len(pool.upstreams))]
+		if u.healthy.Load() {
+			return u
+		}
+	}
+	return nil
+}
+
+func (pool *upstreamPool) pickLeastSessions() *upstream {
+	var least *upstream
+	for _, u := range pool.upstreams {
+		if u.healthy.Load() && (least == nil || u.sessions.Load() < least.sessions.Load()) {
+			least = u
+		}
+	}
+	return least
+}
+
+// pickWeighted is nginx's smooth weighted round-robin, which spreads each
+// upstream's turns out rather than giving them in bursts.
+func (pool *upstreamPool) pickWeighted() *upstream {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	best, total := -1, 0
+	for i, u := range pool.upstreams {
+		if !u.healthy.Load() {
+			continue
+		}
+		pool.currentWeight[i] += u.weight
+		total += u.weight
+		if best < 0 || pool.currentWeight[i] > pool.currentWeight[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	pool.currentWeight[best] -= total
+	return pool.upstreams[best]
+}
+
+func (pool *upstreamPool) buildRing() {
+	for _, u := range pool.upstreams {
+		for i := 0; i < u.weight*hashReplicas; i++ {
+			pool.ring = append(pool.ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", u.name, i)), upstream: u})
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+}
+
+// pickHash takes the first healthy upstream clockwise from the client's IP on
+// the ring. Only clients of an unhealthy upstream move elsewhere.
+func (pool *upstreamPool) pickHash(client netip.Addr) *upstream {
+	h := hashString(client.Unmap().String())
+	start := sort.Search(len(pool.ring), func(i int) bool { return pool.ring[i].hash >= h })
+	for i := range pool.ring {
+		point := pool.ring[(start+i)%len(pool.ring)]
+		if point.upstream.healthy.Load() {
+			return point.upstream
+		}
+	}
+	return nil
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestNewUpstreamPoolKeepsStateWhenAddressesChange(t *testing.T) {
+	route := Route{
+		Upstreams: []Upstream{{Hostname: "127.0.0.1", Port: 19132}, {Hostname: "127.0.0.1", Port: 19133}},
+		Balance:   BalanceLeastSessions,
+	}
+	first, err := newUpstreamPool(route, nil)
+	if err != nil {
+		t.Fatalf("newUpstreamPool: %v", err)
+	}
+	a, b := first.upstreams[0], first.upstreams[1]
+	a.sessions.Store(3)
+	b.sessions.Store(1)
+	a.health.pings = 5
+	a.health.failures = 2
+
+	// As if the first upstream's hostname had rotated to another address
+	rotated := *a
+	rotated.addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 19132}
+	first.upstreams[0] = &rotated
+
+	second, err := newUpstreamPool(route, first)
+	if err != nil {
+		t.Fatalf("newUpstreamPool: %v", err)
+	}
+	if !second.changedFrom(first) {
+		t.Errorf("pool with a new address not reported as changed")
+	}
+	u := second.upstreams[0]
+	if u == &rotated || u.addr.String() != "127.0.0.1:19132" {
+		t.Fatalf("upstream not re-resolved: %v", u.addr)
+	}
+	if u.upstreamState != a.upstreamState {
+		t.Fatalf("re-resolved upstream lost its state")
+	}
+	if second.upstreams[1] != b {
+		t.Errorf("unchanged upstream was replaced")
+	}
+	if u.sessions.Load() != 3 || u.health.pings != 5 || u.health.failures != 2 {
+		t.Errorf("re-resolved upstream has %d sessions, %d pings, %d failures, want 3, 5, 2", u.sessions.Load(), u.health.pings, u.health.failures)
+	}
+
+	// Least sessions still counts the sessions on the old address, and their
+	// closing is seen through the new one
+	if picked, _ := second.pick(netip.Addr{}); picked != b {
+		t.Errorf("picked %v, want the upstream with fewer sessions", picked.addr)
+	}
+	rotated.sessions.Add(-3)
+	if picked, _ := second.pick(netip.Addr{}); picked != u {
+		t.Errorf("picked %v after the old sessions closed, want the re-resolved upstream", picked.addr)
+	}
+}
+
+func TestNewUpstreamPoolKeepsUnchangedUpstreams(t *testing.T) {
+	route := Route{ServerHostname: "127.0.0.1", ServerPort: 19132}
+	first, err := newUpstreamPool(route, nil)
+	if err != nil {
+		t.Fatalf("newUpstreamPool: %v", err)
+	}
+	if !first.upstreams[0].healthy.Load() {
+		t.Errorf("new upstream is not healthy")
+	}
+	second, err := newUpstreamPool(route, first)
+	if err != nil {
+		t.Fatalf("newUpstreamPool: %v", err)
+	}
+	if second.changedFrom(first) {
+		t.Errorf("pool reported as changed when nothing was")
+	}
+
+	route.ServerPort = 19133
+	third, err := newUpstreamPool(route, second)
+	if err != nil {
+		t.Fatalf("newUpstreamPool: %v", err)
+	}
+	if third.upstreams[0].upstreamState == second.upstreams[0].upstreamState {
+		t.Errorf("a different upstream shares the state of the one it replaced")
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+// ValidationPolicy is what happens to payloads from clients that are not
+// valid RakNet
+type ValidationPolicy string
+
+const (
+	// ValidationForward forwards every payload without checking it
+	ValidationForward ValidationPolicy = "forward"
+	// ValidationLog forwards every payload, logging the invalid ones
+	ValidationLog ValidationPolicy = "log"
+	// ValidationDrop drops invalid payloads
+	ValidationDrop ValidationPolicy = "drop"
+)
+
+var ValidationPolicies = []ValidationPolicy{ValidationForward, ValidationLog, ValidationDrop}
+
+const DefaultValidationPolicy = ValidationForward
+
+// maxPayloadSize bounds the payloads RakNet peers send, which fit in the
+// largest MTU they negotiate
+const maxPayloadSize = 1500
+
+// Reasons a payload from a client is invalid, as counted in the metrics
+const (
+	invalidSize  = "invalid_size"
+	invalidID    = "unknown_id"
+	invalidMagic = "invalid_magic"
+	malformed    = "malformed"
+)
+
+// ParseValidationPolicy parses the name of a validation policy. The empty
+// string is the default policy.
+func ParseValidationPolicy(s string) (ValidationPolicy, error) {
+	if s == "" {
+		return DefaultValidationPolicy, nil
+	}
+	for _, policy := range ValidationPolicies {
+		if string(policy) == s {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown validation policy %q, valid policies: %v", s, ValidationPolicies)
+}
+
+// checkPayload validates a payload from a client under the route's policy,
+// reporting whether it should be proxied.
+func (l *listener) checkPayload(clientAddr *net.UDPAddr, payload UDPPayload, opts sessionOptions) bool {
+	if opts.validation == ValidationForward {
+		return true
+	}
+	reason, err := validatePayload(payload)
+	if err == nil {
+		return true
+	}
+
+	opts.metrics.invalid(reason)
+	if opts.validation == ValidationLog {
+		log.Infof("invalid payload from client %v: %v", clientAddr, err)
+		return true
+	}
+	log.Debugf("dropping invalid payload from client %v: %v", clientAddr, err)
+	opts.metrics.drop(reason)
+	return false
+}
+
+// validatePayload checks that a payload from a client is a RakNet message a
+// client would send: a connected datagram, an ACK or NACK, or a ping or
+// handshake request with the offline magic. It returns why it is not.
+func validatePayload(payload UDPPayload) (string, error) {
+	if len(payload) == 0 || len(payload) > maxPayloadSize {
+		return invalidSize, fmt.Errorf("size %d not between 1 and %d", len(payload), maxPayloadSize)
+	}
+
+	switch {
+	case raknet.IsDatagram(payload):
+		if _, err := raknet.DecodeDatagram(payload); err != nil {
+			return malformed, err
+		}
+		return "", nil
+	case raknet.IsAcknowledgement(payload):
+		if _, err := raknet.DecodeAcknowledgement(payload); err != nil {
+			return malformed, err
+		}
+		return "", nil
+	case payload[0]&raknet.FlagValid != 0:
+		return invalidSize, fmt.Errorf("datagram of %d bytes is too short", len(payload))
+	}
+	return validateOfflineMessage(payload)
+}
+
+func validateOfflineMessage(payload UDPPayload) (string, error) {
+	switch payload[0] {
+	case raknet.IDUnconnectedPing, raknet.IDUnconnectedPingOpenConnections,
+		raknet.IDOpenConnectionRequest1, raknet.IDOpenConnectionRequest2:
+	default:
+		return invalidID, fmt.Errorf("unknown ID 0x%02x", payload[0])
+	}
+	if !raknet.IsOfflineMessage(payload) {
+		return invalidMagic, fmt.Errorf("no offline message magic in message 0x%02x", payload[0])
+	}
+	if _, err := raknet.DecodeOfflineMessage(payload); err != nil {
+		return malformed, err
+	}
+	return "", nil
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/percygrunwald/raknet-proxy/lib/metrics"
+	"github.com/percygrunwald/raknet-proxy/lib/raknet"
+)
+
+func TestValidatePayload(t *testing.T) {
+	datagram := (&raknet.Datagram{SequenceNumber: 1, Frames: []*raknet.Frame{{Reliability: raknet.Reliable, Body: []byte{0x09, 0x01, 0x02}}}}).Append(nil)
+	ack := raknet.NewAcknowledgement(false, []uint32{1, 2, 3, 7}).Append(nil)
+	ocr1 := (&raknet.OpenConnectionRequest1{Protocol: 11, MTU: 1400}).Append(nil)
+	ocr2 := (&raknet.OpenConnectionRequest2{ServerAddress: netip.MustParseAddrPort("127.0.0.1:19132"), MTU: 1400, ClientGUID: 7}).Append(nil)
+	badMagic := append(UDPPayload{}, ocr1...)
+	badMagic[1] ^= 0xff
+
+	tests := []struct {
+		name       string
+		payload    UDPPayload
+		wantReason string
+	}{
+		{"ping", (&raknet.UnconnectedPing{SendTimestamp: 1, ClientGUID: 7}).Append(nil), ""},
+		{"ping open connections", (&raknet.UnconnectedPing{OpenConnections: true, SendTimestamp: 1, ClientGUID: 7}).Append(nil), ""},
+		{"open connection request 1", ocr1, ""},
+		{"open connection request 2", ocr2, ""},
+		{"datagram", datagram, ""},
+		{"ACK", ack, ""},
+		{"NACK", raknet.NewAcknowledgement(true, []uint32{4}).Append(nil), ""},
+		{"empty", UDPPayload{}, invalidSize},
+		{"too large", make(UDPPayload, maxPayloadSize+1), invalidSize},
+		{"datagram header only partly there", datagram[:2], invalidSize},
+		{"truncated datagram frame", datagram[:len(datagram)-1], malformed},
+		{"truncated ACK", ack[:len(ack)-1], malformed},
+		{"unknown ID", UDPPayload{0x42, 0x00}, invalidID},
+		{"server message", (&raknet.OpenConnectionReply1{ServerGUID: 42, MTU: 1400}).Append(nil), invalidID},
+		{"bad magic", badMagic, invalidMagic},
+		{"magic cut short", ocr1[:10], invalidMagic},
+		{"truncated open connection request 2", ocr2[:20], malformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, err := validatePayload(tt.payload)
+			if reason != tt.wantReason {
+				t.Errorf("validatePayload(% x) = %q, %v, want %q", tt.payload, reason, err, tt.wantReason)
+			}
+			if (err == nil) != (tt.wantReason == "") {
+				t.Errorf("validatePayload(% x) error = %v", tt.payload, err)
+			}
+		})
+	}
+}
+
+func TestCheckPayload(t *testing.T) {
+	payloads := map[string]UDPPayload{
+		"valid":   (&raknet.OpenConnectionRequest1{Protocol: 11, MTU: 1400}).Append(nil),
+		"invalid": {0x42},
+	}
+	tests := []struct {
+		policy      ValidationPolicy
+		payload     string
+		wantProxied bool
+		// Counter lines expected in the metrics, if any
+		wantMetrics []string
+	}{
+		{ValidationForward, "valid", true, nil},
+		{ValidationForward, "invalid", true, nil},
+		{ValidationLog, "valid", true, nil},
+		{ValidationLog, "invalid", true, []string{`raknet_proxy_invalid_payloads_total{route="19132",reason="unknown_id"} 1`}},
+		{ValidationDrop, "valid", true, nil},
+		{ValidationDrop, "invalid", false, []string{
+			`raknet_proxy_dropped_payloads_total{route="19132",reason="unknown_id"} 1`,
+			`raknet_proxy_invalid_payloads_total{route="19132",reason="unknown_id"} 1`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+" "+tt.payload, func(t *testing.T) {
+			r := metrics.NewRegistry()
+			opts := sessionOptions{validation: tt.policy, metrics: newProxyMetrics(r, &Proxy{}).route(19132)}
+			l := &listener{}
+			if got := l.checkPayload(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}, payloads[tt.payload], opts); got != tt.wantProxied {
+				t.Errorf("checkPayload = %v, want %v", got, tt.wantProxied)
+			}
+
+			buf := &bytes.Buffer{}
+			r.WriteTo(buf)
+			got := []string{}
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if strings.HasPrefix(line, "raknet_proxy_invalid_payloads_total") || strings.HasPrefix(line, "raknet_proxy_dropped_payloads_total") {
+					got = append(got, line)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.wantMetrics, "\n") {
+				t.Errorf("metrics:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.wantMetrics, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseValidationPolicy(t *testing.T) {
+	for _, s := range []string{"forward", "log", "drop"} {
+		if policy, err := ParseValidationPolicy(s); err != nil || string(policy) != s {
+			t.Errorf("ParseValidationPolicy(%q) = %q, %v", s, policy, err)
+		}
+	}
+	if policy, err := ParseValidationPolicy(""); err != nil || policy != DefaultValidationPolicy {
+		t.Errorf("ParseValidationPolicy(\"\") = %q, %v, want the default", policy, err)
+	}
+	if _, err := ParseValidationPolicy("reject"); err == nil {
+		t.Errorf("ParseValidationPolicy(\"reject\") succeeded")
+	}
+}
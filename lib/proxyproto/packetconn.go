@@ -0,0 +1,59 @@
+package proxyproto
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// PacketConn strips PROXY protocol headers from the datagrams read from a
+// server's socket, remembering the client address each peer sent last.
+// Datagrams keep their real source address, so that replies still go
+// through the proxy. Datagrams with invalid headers are dropped. It is safe
+// for concurrent use.
+type PacketConn struct {
+	net.PacketConn
+
+	mu      sync.Mutex
+	sources map[string]netip.AddrPort
+}
+
+func NewPacketConn(conn net.PacketConn) *PacketConn {
+	return &PacketConn{PacketConn: conn, sources: map[string]netip.AddrPort{}}
+}
+
+// ReadFrom reads the next datagram into b, without its header if it has one.
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !HasHeader(b[:n]) {
+			return n, addr, err
+		}
+
+		h, payload, err := Decode(b[:n])
+		if err != nil {
+			continue
+		}
+		if h.Source.IsValid() {
+			c.mu.Lock()
+			c.sources[addr.String()] = h.Source
+			c.mu.Unlock()
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// Source returns the client address given in the last header from a peer.
+func (c *PacketConn) Source(peer net.Addr) (netip.AddrPort, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	source, ok := c.sources[peer.String()]
+	return source, ok
+}
+
+// Forget forgets the client address of a peer, once it is done with.
+func (c *PacketConn) Forget(peer net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sources, peer.String())
+}
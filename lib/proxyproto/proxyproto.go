@@ -0,0 +1,131 @@
+// Package proxyproto encodes and decodes the headers of version 2 of the
+// PROXY protocol for datagrams, which tell a server behind a proxy the
+// address of the client a datagram came from, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// Signature starts every version 2 header
+var Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+const (
+	version2 byte = 0x20
+	// Commands, in the low bits of the version byte
+	commandLocal byte = 0x00
+	commandProxy byte = 0x01
+
+	// Address families, in the high bits of the family byte, and the
+	// datagram transport, in its low bits
+	familyUnspec   byte = 0x00
+	familyInet     byte = 0x10
+	familyInet6    byte = 0x20
+	transportDgram byte = 0x02
+
+	// headerSize is the size of the signature, version, family and length
+	headerSize     = 16
+	inetAddrsSize  = 4 + 4 + 2 + 2
+	inet6AddrsSize = 16 + 16 + 2 + 2
+)
+
+// Header is a PROXY protocol header. A header without a valid Source is
+// encoded with the LOCAL command, for datagrams sent on the proxy's own
+// behalf, and is what headers with no addresses decode to.
+type Header struct {
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// Append appends the encoded header to b. If either address is IPv6, both
+// are encoded as IPv6, as the header has a single address family.
+func (h Header) Append(b []byte) []byte {
+	b = append(b, Signature...)
+	if !h.Source.IsValid() {
+		b = append(b, version2|commandLocal, familyUnspec)
+		return binary.BigEndian.AppendUint16(b, 0)
+	}
+
+	src, dst := h.Source.Addr().Unmap(), h.Destination.Addr().Unmap()
+	b = append(b, version2|commandProxy)
+	if src.Is4() && dst.Is4() {
+		b = append(b, familyInet|transportDgram)
+		b = binary.BigEndian.AppendUint16(b, inetAddrsSize)
+		b = append(b, src.AsSlice()...)
+		b = append(b, dst.AsSlice()...)
+	} else {
+		b = append(b, familyInet6|transportDgram)
+		b = binary.BigEndian.AppendUint16(b, inet6AddrsSize)
+		src16, dst16 := src.As16(), dst.As16()
+		b = append(b, src16[:]...)
+		b = append(b, dst16[:]...)
+	}
+	b = binary.BigEndian.AppendUint16(b, h.Source.Port())
+	return binary.BigEndian.AppendUint16(b, h.Destination.Port())
+}
+
+// HasHeader reports whether b starts with the signature of a header.
+func HasHeader(b []byte) bool {
+	return bytes.HasPrefix(b, Signature)
+}
+
+// Decode decodes the header at the start of a datagram, returning it and the
+// payload that follows. Extensions (TLVs) after the addresses are skipped.
+func Decode(b []byte) (Header, []byte, error) {
+	if !HasHeader(b) {
+		return Header{}, nil, fmt.Errorf("unable to decode PROXY protocol header: no signature")
+	}
+	if len(b) < headerSize {
+		return Header{}, nil, fmt.Errorf("unable to decode PROXY protocol header: %d bytes is too short", len(b))
+	}
+	versionCommand, family := b[12], b[13]
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if versionCommand&0xf0 != version2 {
+		return Header{}, nil, fmt.Errorf("unable to decode PROXY protocol header: unsupported version 0x%02x", versionCommand>>4)
+	}
+	if len(b) < headerSize+length {
+		return Header{}, nil, fmt.Errorf("unable to decode PROXY protocol header: length %d exceeds the datagram", length)
+	}
+	addrs, payload := b[headerSize:headerSize+length], b[headerSize+length:]
+
+	switch {
+	case versionCommand&0x0f == commandLocal:
+		return Header{}, payload, nil
+	case versionCommand&0x0f != commandProxy:
+		return Header{}, nil, fmt.Errorf("unable to decode PROXY protocol header: unknown command 0x%02x", versionCommand&0x0f)
+	}
+	h, err := decodeAddrs(family, addrs)
+	if err != nil {
+		return Header{}, nil, fmt.Errorf("unable to decode PROXY protocol header: %w", err)
+	}
+	return h, payload, nil
+}
+
+func decodeAddrs(family byte, b []byte) (Header, error) {
+	size := 0
+	switch family & 0xf0 {
+	case familyInet:
+		size = 4
+	case familyInet6:
+		size = 16
+	case familyUnspec:
+		return Header{}, nil
+	default:
+		return Header{}, fmt.Errorf("unsupported address family 0x%02x", family>>4)
+	}
+	if len(b) < 2*size+4 {
+		return Header{}, fmt.Errorf("%d bytes of addresses is too short", len(b))
+	}
+
+	src, _ := netip.AddrFromSlice(b[:size])
+	dst, _ := netip.AddrFromSlice(b[size : 2*size])
+	ports := b[2*size:]
+	return Header{
+		Source:      netip.AddrPortFrom(src.Unmap(), binary.BigEndian.Uint16(ports[0:2])),
+		Destination: netip.AddrPortFrom(dst.Unmap(), binary.BigEndian.Uint16(ports[2:4])),
+	}, nil
+}
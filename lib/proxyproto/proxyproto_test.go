@@ -0,0 +1,144 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+var payload = []byte{0x01, 0x02, 0x03}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+		want   Header
+		size   int
+	}{
+		{
+			name:   "IPv4",
+			header: Header{Source: netip.MustParseAddrPort("198.51.100.7:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")},
+			want:   Header{Source: netip.MustParseAddrPort("198.51.100.7:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")},
+			size:   headerSize + inetAddrsSize,
+		},
+		{
+			name:   "IPv4-mapped",
+			header: Header{Source: netip.MustParseAddrPort("[::ffff:198.51.100.7]:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")},
+			want:   Header{Source: netip.MustParseAddrPort("198.51.100.7:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")},
+			size:   headerSize + inetAddrsSize,
+		},
+		{
+			name:   "IPv6",
+			header: Header{Source: netip.MustParseAddrPort("[2001:db8::7]:51234"), Destination: netip.MustParseAddrPort("[2001:db8::1]:19133")},
+			want:   Header{Source: netip.MustParseAddrPort("[2001:db8::7]:51234"), Destination: netip.MustParseAddrPort("[2001:db8::1]:19133")},
+			size:   headerSize + inet6AddrsSize,
+		},
+		{
+			name:   "mixed families",
+			header: Header{Source: netip.MustParseAddrPort("[2001:db8::7]:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")},
+			want:   Header{Source: netip.MustParseAddrPort("[2001:db8::7]:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")},
+			size:   headerSize + inet6AddrsSize,
+		},
+		{
+			name: "LOCAL",
+			size: headerSize,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.header.Append(nil)
+			if len(b) != tt.size {
+				t.Fatalf("Append is %d bytes, want %d", len(b), tt.size)
+			}
+			if !HasHeader(b) {
+				t.Fatalf("HasHeader(% x) = false", b)
+			}
+			h, rest, err := Decode(append(b, payload...))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if h != tt.want {
+				t.Errorf("Decode = %+v, want %+v", h, tt.want)
+			}
+			if !bytes.Equal(rest, payload) {
+				t.Errorf("payload = % x, want % x", rest, payload)
+			}
+		})
+	}
+}
+
+func TestAppendVectors(t *testing.T) {
+	h := Header{Source: netip.MustParseAddrPort("198.51.100.7:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")}
+	want := append(append([]byte{}, Signature...),
+		0x21, 0x12, 0x00, 0x0c,
+		198, 51, 100, 7,
+		203, 0, 113, 1,
+		0xc8, 0x22,
+		0x4a, 0xbc,
+	)
+	if got := h.Append(nil); !bytes.Equal(got, want) {
+		t.Errorf("Append = % x, want % x", got, want)
+	}
+
+	local := append(append([]byte{}, Signature...), 0x20, 0x00, 0x00, 0x00)
+	if got := (Header{}).Append(nil); !bytes.Equal(got, local) {
+		t.Errorf("Append LOCAL = % x, want % x", got, local)
+	}
+}
+
+func TestDecodeSkipsTLVs(t *testing.T) {
+	h := Header{Source: netip.MustParseAddrPort("198.51.100.7:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")}
+	// A PP2_TYPE_NOOP TLV and a PP2_TYPE_AUTHORITY TLV after the addresses
+	tlvs := []byte{0x04, 0x00, 0x02, 0x00, 0x00, 0x02, 0x00, 0x03, 'a', 'b', 'c'}
+	b := h.Append(nil)
+	binary.BigEndian.PutUint16(b[14:16], uint16(inetAddrsSize+len(tlvs)))
+	b = append(append(b, tlvs...), payload...)
+
+	got, rest, err := Decode(b)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got != h {
+		t.Errorf("Decode = %+v, want %+v", got, h)
+	}
+	if !bytes.Equal(rest, payload) {
+		t.Errorf("payload = % x, want % x", rest, payload)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	ipv4 := Header{Source: netip.MustParseAddrPort("198.51.100.7:51234"), Destination: netip.MustParseAddrPort("203.0.113.1:19132")}.Append(nil)
+	ipv6 := Header{Source: netip.MustParseAddrPort("[2001:db8::7]:51234"), Destination: netip.MustParseAddrPort("[2001:db8::1]:19133")}.Append(nil)
+	with := func(b []byte, i int, v byte) []byte {
+		b = append([]byte{}, b...)
+		b[i] = v
+		return b
+	}
+	shortAddrs := append([]byte{}, ipv4...)
+	binary.BigEndian.PutUint16(shortAddrs[14:16], inetAddrsSize-1)
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"no signature", []byte{0x01, 0x00, 0x00}},
+		{"truncated signature", Signature[:8]},
+		{"truncated before length", ipv4[:headerSize-1]},
+		{"truncated IPv4 addresses", ipv4[:len(ipv4)-1]},
+		{"truncated IPv6 addresses", ipv6[:headerSize+16]},
+		{"addresses shorter than the family", shortAddrs[:len(shortAddrs)-1]},
+		{"version 1", with(ipv4, 12, 0x11)},
+		{"version 3", with(ipv4, 12, 0x31)},
+		{"unknown command", with(ipv4, 12, 0x22)},
+		{"unknown family", with(ipv4, 13, 0x32)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if h, _, err := Decode(tt.b); err == nil {
+				t.Errorf("Decode(% x) = %+v, want an error", tt.b, h)
+			}
+		})
+	}
+}
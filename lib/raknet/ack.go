@@ -0,0 +1,133 @@
+package raknet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// SequenceNumberMask bounds datagram sequence numbers, which are 24-bit
+	// and wrap around
+	SequenceNumberMask uint32 = 0xffffff
+
+	// maxAcknowledgementSequences bounds the number of sequence numbers an
+	// acknowledgement may expand to, so a single record cannot claim millions
+	maxAcknowledgementSequences int = 8192
+
+	recordTypeRange  byte = 0
+	recordTypeSingle byte = 1
+)
+
+// Acknowledgement is an ACK (0xc0) or NACK (0xa0) datagram: a list of
+// datagram sequence number ranges that were received or found missing.
+type Acknowledgement struct {
+	NACK   bool
+	Ranges []SequenceRange
+}
+
+// SequenceRange is an inclusive range of datagram sequence numbers. A single
+// sequence number has Start equal to End.
+type SequenceRange struct {
+	Start uint32
+	End   uint32
+}
+
+// IsAcknowledgement reports whether b is an ACK or a NACK.
+func IsAcknowledgement(b []byte) bool {
+	return len(b) > 0 && b[0]&FlagValid != 0 && b[0]&(FlagACK|FlagNACK) != 0
+}
+
+// DecodeAcknowledgement decodes an ACK or NACK.
+func DecodeAcknowledgement(b []byte) (*Acknowledgement, error) {
+	if !IsAcknowledgement(b) {
+		return nil, fmt.Errorf("unable to decode acknowledgement: not an ACK or NACK")
+	}
+
+	r := &reader{b: b}
+	a := &Acknowledgement{NACK: r.u8()&FlagNACK != 0}
+	count := int(r.u16())
+	for i := 0; i < count && r.err == nil; i++ {
+		rng := SequenceRange{}
+		single := r.u8() == recordTypeSingle
+		rng.Start = r.u24()
+		rng.End = rng.Start
+		if !single {
+			rng.End = r.u24()
+		}
+		a.Ranges = append(a.Ranges, rng)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("unable to decode acknowledgement: %w", r.err)
+	}
+	return a, nil
+}
+
+// Append appends the encoded ACK or NACK to b.
+func (a *Acknowledgement) Append(b []byte) []byte {
+	if a.NACK {
+		b = append(b, FlagValid|FlagNACK)
+	} else {
+		b = append(b, FlagValid|FlagACK)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(a.Ranges)))
+	for _, rng := range a.Ranges {
+		if rng.Start == rng.End {
+			b = append(b, recordTypeSingle)
+			b = appendU24(b, rng.Start)
+			continue
+		}
+		b = append(b, recordTypeRange)
+		b = appendU24(b, rng.Start)
+		b = appendU24(b, rng.End)
+	}
+	return b
+}
+
+// Sequences expands the ranges into the individual sequence numbers they
+// cover, taking wraparound into account.
+func (a *Acknowledgement) Sequences() ([]uint32, error) {
+	seqs := []uint32{}
+	for _, rng := range a.Ranges {
+		n := int((rng.End-rng.Start)&SequenceNumberMask) + 1
+		if len(seqs)+n > maxAcknowledgementSequences {
+			return nil, fmt.Errorf("acknowledgement covers more than %d sequence numbers", maxAcknowledgementSequences)
+		}
+		for i := 0; i < n; i++ {
+			seqs = append(seqs, (rng.Start+uint32(i))&SequenceNumberMask)
+		}
+	}
+	return seqs, nil
+}
+
+// NewAcknowledgement builds an ACK or NACK covering seqs, collapsing runs of
+// consecutive sequence numbers into ranges. The order of seqs is kept, so
+// callers should pass them sorted to get the most compact encoding.
+func NewAcknowledgement(nack bool, seqs []uint32) *Acknowledgement {
+	a := &Acknowledgement{NACK: nack}
+	for _, seq := range seqs {
+		last := len(a.Ranges) - 1
+		if last >= 0 && (a.Ranges[last].End+1)&SequenceNumberMask == seq {
+			a.Ranges[last].End = seq
+			continue
+		}
+		a.Ranges = append(a.Ranges, SequenceRange{Start: seq, End: seq})
+	}
+	return a
+}
+
+// SequenceNumber returns the sequence number of an encoded datagram.
+func SequenceNumber(b []byte) uint32 {
+	return uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16
+}
+
+// PutSequenceNumber overwrites the sequence number of an encoded datagram.
+func PutSequenceNumber(b []byte, seq uint32) {
+	b[1], b[2], b[3] = byte(seq), byte(seq>>8), byte(seq>>16)
+}
+
+// SequenceAfter reports whether sequence number a comes after b, taking
+// wraparound into account.
+func SequenceAfter(a uint32, b uint32) bool {
+	diff := (a - b) & SequenceNumberMask
+	return diff != 0 && diff < SequenceNumberMask/2
+}
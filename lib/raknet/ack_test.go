@@ -0,0 +1,108 @@
+package raknet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAcknowledgementRoundTrip(t *testing.T) {
+	for _, nack := range []bool{false, true} {
+		a := NewAcknowledgement(nack, []uint32{1, 2, 3, 5, 0xfffffe, 0xffffff, 0, 7})
+		want := []SequenceRange{{1, 3}, {5, 5}, {0xfffffe, 0}, {7, 7}}
+		if !reflect.DeepEqual(a.Ranges, want) {
+			t.Errorf("NewAcknowledgement ranges = %v, want %v", a.Ranges, want)
+		}
+
+		b := a.Append(nil)
+		if !IsAcknowledgement(b) || IsDatagram(b) {
+			t.Errorf("% x is not recognised as an acknowledgement", b)
+		}
+		got, err := DecodeAcknowledgement(b)
+		if err != nil {
+			t.Fatalf("DecodeAcknowledgement: %v", err)
+		}
+		if !reflect.DeepEqual(got, a) {
+			t.Errorf("DecodeAcknowledgement = %+v, want %+v", got, a)
+		}
+	}
+}
+
+func TestAcknowledgementEncoding(t *testing.T) {
+	a := &Acknowledgement{Ranges: []SequenceRange{{Start: 0x010203, End: 0x010203}, {Start: 4, End: 6}}}
+	want := []byte{
+		0xc0,       // ACK
+		0x00, 0x02, // record count
+		0x01, 0x03, 0x02, 0x01, // single
+		0x00, 0x04, 0x00, 0x00, 0x06, 0x00, 0x00, // range
+	}
+	if got := a.Append(nil); !bytes.Equal(got, want) {
+		t.Errorf("Append = % x, want % x", got, want)
+	}
+	if got := (&Acknowledgement{NACK: true}).Append(nil); !bytes.Equal(got, []byte{0xa0, 0x00, 0x00}) {
+		t.Errorf("empty NACK = % x", got)
+	}
+}
+
+func TestAcknowledgementSequences(t *testing.T) {
+	a := &Acknowledgement{Ranges: []SequenceRange{{Start: 0xfffffe, End: 1}, {Start: 9, End: 9}}}
+	seqs, err := a.Sequences()
+	if err != nil {
+		t.Fatalf("Sequences: %v", err)
+	}
+	if want := []uint32{0xfffffe, 0xffffff, 0, 1, 9}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("Sequences = %v, want %v", seqs, want)
+	}
+
+	limit := uint32(maxAcknowledgementSequences)
+	a = &Acknowledgement{Ranges: []SequenceRange{{Start: 0, End: limit - 1}}}
+	if seqs, err := a.Sequences(); err != nil || len(seqs) != maxAcknowledgementSequences {
+		t.Errorf("Sequences of %d numbers = %d, %v", limit, len(seqs), err)
+	}
+	a.Ranges = append(a.Ranges, SequenceRange{Start: limit, End: limit})
+	if _, err := a.Sequences(); err == nil {
+		t.Errorf("Sequences of %d numbers, want an error", limit+1)
+	}
+	// A range ending before its start wraps around the whole sequence space
+	a = &Acknowledgement{Ranges: []SequenceRange{{Start: 2, End: 1}}}
+	if _, err := a.Sequences(); err == nil {
+		t.Errorf("Sequences of a reversed range, want an error")
+	}
+}
+
+func TestDecodeAcknowledgementErrors(t *testing.T) {
+	b := NewAcknowledgement(false, []uint32{1, 2, 3, 5}).Append(nil)
+	for n := 0; n < len(b); n++ {
+		if a, err := DecodeAcknowledgement(b[:n]); err == nil {
+			t.Errorf("DecodeAcknowledgement(% x) = %+v, want an error", b[:n], a)
+		}
+	}
+	if a, err := DecodeAcknowledgement([]byte{0x84, 0x00, 0x00, 0x00}); err == nil {
+		t.Errorf("DecodeAcknowledgement of a datagram = %+v, want an error", a)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	b := make([]byte, DatagramHeaderSize)
+	PutSequenceNumber(b, 0x123456)
+	if !bytes.Equal(b[1:], []byte{0x56, 0x34, 0x12}) || SequenceNumber(b) != 0x123456 {
+		t.Errorf("PutSequenceNumber wrote % x", b)
+	}
+
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 0, true},
+		{0, 1, false},
+		{5, 5, false},
+		{0, 0xffffff, true},
+		{0xffffff, 0, false},
+		{0x10, 0xfffff0, true},
+	}
+	for _, tt := range tests {
+		if got := SequenceAfter(tt.a, tt.b); got != tt.want {
+			t.Errorf("SequenceAfter(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package raknet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	AddrFamilyIPv4 byte = 4
+	AddrFamilyIPv6 byte = 6
+
+	// IPv4AddrSize is the encoded size of an IPv4 system address: family,
+	// inverted address and port
+	IPv4AddrSize int = 1 + 4 + 2
+	// IPv6AddrSize is the encoded size of an IPv6 system address: family
+	// followed by a sockaddr_in6 (family, port, flow info, address, scope ID)
+	IPv6AddrSize int = 1 + 2 + 2 + 4 + 16 + 4
+
+	// sockaddrFamilyIPv6 is the value of AF_INET6 written into the
+	// sockaddr_in6. RakNet copies the platform's struct verbatim; 23 is the
+	// Windows value, which is what game servers and go-raknet send.
+	sockaddrFamilyIPv6 uint16 = 23
+)
+
+// EncodeAddr returns the RakNet system address encoding of addr. IPv4 and
+// IPv4-mapped IPv6 addresses are encoded as family 4, everything else as
+// family 6.
+func EncodeAddr(addr netip.AddrPort) []byte {
+	return AppendAddr(nil, addr)
+}
+
+// AppendAddr appends the RakNet system address encoding of addr to b.
+func AppendAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		ip4 := ip.As4()
+		b = append(b, AddrFamilyIPv4, ^ip4[0], ^ip4[1], ^ip4[2], ^ip4[3])
+		return binary.BigEndian.AppendUint16(b, addr.Port())
+	}
+
+	ip16 := ip.As16()
+	b = append(b, AddrFamilyIPv6)
+	b = binary.LittleEndian.AppendUint16(b, sockaddrFamilyIPv6)
+	b = binary.BigEndian.AppendUint16(b, addr.Port())
+	// Flow info
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, ip16[:]...)
+	// Scope ID
+	return binary.BigEndian.AppendUint32(b, 0)
+}
+
+// DecodeAddr decodes a RakNet system address from the start of b, returning
+// the address and the number of bytes consumed.
+func DecodeAddr(b []byte) (netip.AddrPort, int, error) {
+	if len(b) < 1 {
+		return netip.AddrPort{}, 0, fmt.Errorf("unable to decode address: empty buffer")
+	}
+
+	switch b[0] {
+	case AddrFamilyIPv4:
+		if len(b) < IPv4AddrSize {
+			return netip.AddrPort{}, 0, fmt.Errorf("unable to decode IPv4 address: need %d bytes, have %d", IPv4AddrSize, len(b))
+		}
+		ip := netip.AddrFrom4([4]byte{^b[1], ^b[2], ^b[3], ^b[4]})
+		port := binary.BigEndian.Uint16(b[5:7])
+		return netip.AddrPortFrom(ip, port), IPv4AddrSize, nil
+	case AddrFamilyIPv6:
+		if len(b) < IPv6AddrSize {
+			return netip.AddrPort{}, 0, fmt.Errorf("unable to decode IPv6 address: need %d bytes, have %d", IPv6AddrSize, len(b))
+		}
+		port := binary.BigEndian.Uint16(b[3:5])
+		ip := netip.AddrFrom16([16]byte(b[9:25]))
+		return netip.AddrPortFrom(ip, port), IPv6AddrSize, nil
+	default:
+		return netip.AddrPort{}, 0, fmt.Errorf("unable to decode address: unknown family %d", b[0])
+	}
+}
@@ -0,0 +1,120 @@
+package raknet
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestAddrRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		addr netip.AddrPort
+		want netip.AddrPort
+		size int
+	}{
+		{"IPv4", netip.MustParseAddrPort("192.168.1.20:19132"), netip.MustParseAddrPort("192.168.1.20:19132"), IPv4AddrSize},
+		{"IPv4 zero port", netip.MustParseAddrPort("0.0.0.0:0"), netip.MustParseAddrPort("0.0.0.0:0"), IPv4AddrSize},
+		{"IPv4-mapped IPv6", netip.MustParseAddrPort("[::ffff:10.0.0.1]:19133"), netip.MustParseAddrPort("10.0.0.1:19133"), IPv4AddrSize},
+		{"IPv6", netip.MustParseAddrPort("[2001:db8::1]:19133"), netip.MustParseAddrPort("[2001:db8::1]:19133"), IPv6AddrSize},
+		{"IPv6 loopback", netip.MustParseAddrPort("[::1]:65535"), netip.MustParseAddrPort("[::1]:65535"), IPv6AddrSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := EncodeAddr(tt.addr)
+			if len(b) != tt.size {
+				t.Fatalf("EncodeAddr(%v) is %d bytes, want %d", tt.addr, len(b), tt.size)
+			}
+			// Trailing bytes belong to whatever follows the address
+			got, n, err := DecodeAddr(append(b, 0xff))
+			if err != nil {
+				t.Fatalf("DecodeAddr: %v", err)
+			}
+			if got != tt.want || n != tt.size {
+				t.Errorf("DecodeAddr = %v, %d, want %v, %d", got, n, tt.want, tt.size)
+			}
+		})
+	}
+}
+
+func TestAppendAddrAppends(t *testing.T) {
+	prefix := []byte{0x01, 0x02}
+	addr := netip.MustParseAddrPort("127.0.0.1:1")
+	b := AppendAddr(prefix, addr)
+	if !bytes.Equal(b[:2], prefix) || !bytes.Equal(b[2:], EncodeAddr(addr)) {
+		t.Errorf("AppendAddr = % x", b)
+	}
+}
+
+func TestEncodeAddrVectors(t *testing.T) {
+	tests := []struct {
+		name string
+		addr netip.AddrPort
+		want []byte
+	}{
+		{
+			name: "IPv4 octets are inverted",
+			addr: netip.MustParseAddrPort("192.168.1.20:19132"),
+			want: []byte{
+				0x04,
+				0x3f, 0x57, 0xfe, 0xeb,
+				0x4a, 0xbc,
+			},
+		},
+		{
+			name: "IPv6 sockaddr_in6",
+			addr: netip.MustParseAddrPort("[2001:db8::1]:19133"),
+			want: []byte{
+				0x06,
+				// Family 23, little-endian
+				0x17, 0x00,
+				// Port
+				0x4a, 0xbd,
+				// Flow info
+				0x00, 0x00, 0x00, 0x00,
+				// Address
+				0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+				// Scope ID
+				0x00, 0x00, 0x00, 0x00,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EncodeAddr(tt.addr); !bytes.Equal(got, tt.want) {
+				t.Errorf("EncodeAddr(%v) = % x, want % x", tt.addr, got, tt.want)
+			}
+			got, n, err := DecodeAddr(tt.want)
+			if err != nil {
+				t.Fatalf("DecodeAddr: %v", err)
+			}
+			if got != tt.addr || n != len(tt.want) {
+				t.Errorf("DecodeAddr = %v, %d, want %v, %d", got, n, tt.addr, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestDecodeAddrErrors(t *testing.T) {
+	ipv4 := EncodeAddr(netip.MustParseAddrPort("192.168.1.20:19132"))
+	ipv6 := EncodeAddr(netip.MustParseAddrPort("[2001:db8::1]:19133"))
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"unknown family", []byte{0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"truncated IPv4 family only", ipv4[:1]},
+		{"truncated IPv4 port", ipv4[:IPv4AddrSize-1]},
+		{"truncated IPv6 sockaddr", ipv6[:9]},
+		{"truncated IPv6 scope ID", ipv6[:IPv6AddrSize-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if addr, n, err := DecodeAddr(tt.b); err == nil {
+				t.Errorf("DecodeAddr(% x) = %v, %d, want an error", tt.b, addr, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package raknet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// connectedTimestampsSize is the size of the request and accepted timestamps
+// that end both ConnectionRequestAccepted and NewIncomingConnection
+const connectedTimestampsSize int = 8 + 8
+
+// ConnectedMessage is a message carried in the body of a connected frame that
+// the proxy knows how to decode.
+type ConnectedMessage interface {
+	// ID returns the message ID written in the first byte of the frame body
+	ID() byte
+	// Append appends the encoded message, including its ID, to b
+	Append(b []byte) []byte
+
+	decode(r *reader)
+}
+
+// ConnectionRequestAccepted is sent by the server in reply to a
+// ConnectionRequest and carries the address the server sees the client at.
+type ConnectionRequestAccepted struct {
+	ClientAddress     netip.AddrPort
+	SystemIndex       uint16
+	SystemAddresses   []netip.AddrPort
+	RequestTimestamp  uint64
+	AcceptedTimestamp uint64
+}
+
+// NewIncomingConnection is the client's final handshake message and carries
+// the address the client believes the server is at.
+type NewIncomingConnection struct {
+	ServerAddress     netip.AddrPort
+	SystemAddresses   []netip.AddrPort
+	RequestTimestamp  uint64
+	AcceptedTimestamp uint64
+}
+
+// DecodeConnectedMessage decodes a connected message from a frame body.
+func DecodeConnectedMessage(b []byte) (ConnectedMessage, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("unable to decode connected message: empty body")
+	}
+
+	var m ConnectedMessage
+	switch b[0] {
+	case IDConnectionRequestAccepted:
+		m = &ConnectionRequestAccepted{}
+	case IDNewIncomingConnection:
+		m = &NewIncomingConnection{}
+	default:
+		return nil, fmt.Errorf("unable to decode connected message: unsupported ID 0x%02x", b[0])
+	}
+
+	r := &reader{b: b, off: 1}
+	m.decode(r)
+	if r.err != nil {
+		return nil, fmt.Errorf("unable to decode connected message 0x%02x: %w", b[0], r.err)
+	}
+	return m, nil
+}
+
+// readSystemAddresses reads the list of internal system addresses. Its length
+// differs between implementations (RakNet sends 10, go-raknet 20), so read
+// addresses until only the trailing timestamps remain.
+func readSystemAddresses(r *reader) []netip.AddrPort {
+	addrs := []netip.AddrPort{}
+	for r.err == nil && r.remaining() > connectedTimestampsSize {
+		addrs = append(addrs, r.addr())
+	}
+	return addrs
+}
+
+func appendSystemAddresses(b []byte, addrs []netip.AddrPort) []byte {
+	for _, addr := range addrs {
+		b = AppendAddr(b, addr)
+	}
+	return b
+}
+
+func (m *ConnectionRequestAccepted) ID() byte { return IDConnectionRequestAccepted }
+
+func (m *ConnectionRequestAccepted) Append(b []byte) []byte {
+	b = append(b, IDConnectionRequestAccepted)
+	b = AppendAddr(b, m.ClientAddress)
+	b = binary.BigEndian.AppendUint16(b, m.SystemIndex)
+	b = appendSystemAddresses(b, m.SystemAddresses)
+	b = binary.BigEndian.AppendUint64(b, m.RequestTimestamp)
+	return binary.BigEndian.AppendUint64(b, m.AcceptedTimestamp)
+}
+
+func (m *ConnectionRequestAccepted) decode(r *reader) {
+	m.ClientAddress = r.addr()
+	m.SystemIndex = r.u16()
+	m.SystemAddresses = readSystemAddresses(r)
+	m.RequestTimestamp = r.u64()
+	m.AcceptedTimestamp = r.u64()
+}
+
+func (m *NewIncomingConnection) ID() byte { return IDNewIncomingConnection }
+
+func (m *NewIncomingConnection) Append(b []byte) []byte {
+	b = append(b, IDNewIncomingConnection)
+	b = AppendAddr(b, m.ServerAddress)
+	b = appendSystemAddresses(b, m.SystemAddresses)
+	b = binary.BigEndian.AppendUint64(b, m.RequestTimestamp)
+	return binary.BigEndian.AppendUint64(b, m.AcceptedTimestamp)
+}
+
+func (m *NewIncomingConnection) decode(r *reader) {
+	m.ServerAddress = r.addr()
+	m.SystemAddresses = readSystemAddresses(r)
+	m.RequestTimestamp = r.u64()
+	m.AcceptedTimestamp = r.u64()
+}
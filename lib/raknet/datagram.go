@@ -0,0 +1,237 @@
+package raknet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Datagram header flags
+const (
+	FlagValid          byte = 0x80
+	FlagACK            byte = 0x40
+	FlagNACK           byte = 0x20
+	FlagPacketPair     byte = 0x10
+	FlagContinuousSend byte = 0x08
+	FlagNeedsBAndAS    byte = 0x04
+
+	frameFlagSplit byte = 0x10
+)
+
+// Reliability is the delivery guarantee of a frame, stored in the top three
+// bits of the frame header.
+type Reliability byte
+
+const (
+	Unreliable Reliability = iota
+	UnreliableSequenced
+	Reliable
+	ReliableOrdered
+	ReliableSequenced
+	UnreliableWithAckReceipt
+	ReliableWithAckReceipt
+	ReliableOrderedWithAckReceipt
+)
+
+// IsReliable reports whether frames of this reliability carry a reliable
+// message index.
+func (r Reliability) IsReliable() bool {
+	switch r {
+	case Reliable, ReliableOrdered, ReliableSequenced, ReliableWithAckReceipt, ReliableOrderedWithAckReceipt:
+		return true
+	}
+	return false
+}
+
+// IsSequenced reports whether frames of this reliability carry a sequenced
+// index.
+func (r Reliability) IsSequenced() bool {
+	return r == UnreliableSequenced || r == ReliableSequenced
+}
+
+// IsOrdered reports whether frames of this reliability carry an order index
+// and channel. Sequenced frames are ordered too.
+func (r Reliability) IsOrdered() bool {
+	switch r {
+	case UnreliableSequenced, ReliableOrdered, ReliableSequenced, ReliableOrderedWithAckReceipt:
+		return true
+	}
+	return false
+}
+
+// Datagram is a connected frame set: a sequence numbered datagram carrying
+// one or more frames. Its header byte is in the 0x80-0x8f range.
+type Datagram struct {
+	Flags          byte
+	SequenceNumber uint32
+	Frames         []*Frame
+}
+
+// Frame is a single encapsulated message within a datagram, or a fragment of
+// one if Split is set.
+type Frame struct {
+	Reliability    Reliability
+	ReliableIndex  uint32
+	SequencedIndex uint32
+	OrderIndex     uint32
+	OrderChannel   byte
+
+	Split      bool
+	SplitCount uint32
+	SplitID    uint16
+	SplitIndex uint32
+
+	Body []byte
+}
+
+// DatagramHeaderSize is the size of the flags and sequence number
+const DatagramHeaderSize int = 1 + 3
+
+// IsDatagram reports whether b is a connected frame set, as opposed to an
+// ACK, a NACK or an offline message.
+func IsDatagram(b []byte) bool {
+	return len(b) >= DatagramHeaderSize && b[0]&FlagValid != 0 && b[0]&(FlagACK|FlagNACK) == 0
+}
+
+// DecodeDatagram decodes a connected frame set. Frame bodies alias b.
+func DecodeDatagram(b []byte) (*Datagram, error) {
+	if !IsDatagram(b) {
+		return nil, fmt.Errorf("unable to decode datagram: not a frame set")
+	}
+
+	r := &reader{b: b}
+	d := &Datagram{Flags: r.u8(), SequenceNumber: r.u24()}
+	for r.err == nil && r.remaining() > 0 {
+		f := &Frame{}
+		f.decode(r)
+		d.Frames = append(d.Frames, f)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("unable to decode datagram %d: %w", d.SequenceNumber, r.err)
+	}
+	return d, nil
+}
+
+// Append appends the encoded datagram to b.
+func (d *Datagram) Append(b []byte) []byte {
+	b = append(b, d.Flags|FlagValid)
+	b = appendU24(b, d.SequenceNumber)
+	for _, f := range d.Frames {
+		b = f.Append(b)
+	}
+	return b
+}
+
+// Size returns the encoded size of the datagram.
+func (d *Datagram) Size() int {
+	size := DatagramHeaderSize
+	for _, f := range d.Frames {
+		size += f.Size()
+	}
+	return size
+}
+
+func (f *Frame) decode(r *reader) {
+	flags := r.u8()
+	f.Reliability = Reliability(flags >> 5)
+	f.Split = flags&frameFlagSplit != 0
+	length := (int(r.u16()) + 7) / 8
+	if r.err == nil && length == 0 {
+		r.err = fmt.Errorf("empty frame at offset %d", r.off)
+		return
+	}
+	if f.Reliability.IsReliable() {
+		f.ReliableIndex = r.u24()
+	}
+	if f.Reliability.IsSequenced() {
+		f.SequencedIndex = r.u24()
+	}
+	if f.Reliability.IsOrdered() {
+		f.OrderIndex = r.u24()
+		f.OrderChannel = r.u8()
+	}
+	if f.Split {
+		f.SplitCount = r.u32()
+		f.SplitID = r.u16()
+		f.SplitIndex = r.u32()
+	}
+	f.Body = r.take(length)
+}
+
+// Append appends the encoded frame to b.
+func (f *Frame) Append(b []byte) []byte {
+	flags := byte(f.Reliability) << 5
+	if f.Split {
+		flags |= frameFlagSplit
+	}
+	b = append(b, flags)
+	// The length is in bits
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.Body)*8))
+	if f.Reliability.IsReliable() {
+		b = appendU24(b, f.ReliableIndex)
+	}
+	if f.Reliability.IsSequenced() {
+		b = appendU24(b, f.SequencedIndex)
+	}
+	if f.Reliability.IsOrdered() {
+		b = appendU24(b, f.OrderIndex)
+		b = append(b, f.OrderChannel)
+	}
+	if f.Split {
+		b = binary.BigEndian.AppendUint32(b, f.SplitCount)
+		b = binary.BigEndian.AppendUint16(b, f.SplitID)
+		b = binary.BigEndian.AppendUint32(b, f.SplitIndex)
+	}
+	return append(b, f.Body...)
+}
+
+// HeaderSize returns the encoded size of the frame without its body.
+func (f *Frame) HeaderSize() int {
+	size := 1 + 2
+	if f.Reliability.IsReliable() {
+		size += 3
+	}
+	if f.Reliability.IsSequenced() {
+		size += 3
+	}
+	if f.Reliability.IsOrdered() {
+		size += 3 + 1
+	}
+	if f.Split {
+		size += 4 + 2 + 4
+	}
+	return size
+}
+
+// Size returns the encoded size of the frame.
+func (f *Frame) Size() int {
+	return f.HeaderSize() + len(f.Body)
+}
+
+// MessageID returns the ID of the message carried by the frame. For a split
+// frame, only the first fragment starts with the message ID.
+func (f *Frame) MessageID() (byte, bool) {
+	if len(f.Body) == 0 || (f.Split && f.SplitIndex != 0) {
+		return 0, false
+	}
+	return f.Body[0], true
+}
+
+// SplitDatagram packs the frames of d into as few datagrams of at most
+// maxSize bytes as possible, keeping their order. The first datagram keeps
+// d's sequence number; the others are left for the caller to number. A frame
+// that is too large on its own gets a datagram of its own.
+func SplitDatagram(d *Datagram, maxSize int) []*Datagram {
+	datagrams := []*Datagram{{Flags: d.Flags, SequenceNumber: d.SequenceNumber}}
+	size := DatagramHeaderSize
+	for _, f := range d.Frames {
+		current := datagrams[len(datagrams)-1]
+		if len(current.Frames) > 0 && size+f.Size() > maxSize {
+			current = &Datagram{Flags: d.Flags}
+			datagrams = append(datagrams, current)
+			size = DatagramHeaderSize
+		}
+		current.Frames = append(current.Frames, f)
+		size += f.Size()
+	}
+	return datagrams
+}
@@ -0,0 +1,124 @@
+package raknet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	d := &Datagram{
+		Flags:          FlagNeedsBAndAS,
+		SequenceNumber: 0xabcdef,
+		Frames: []*Frame{
+			{Reliability: Unreliable, Body: []byte{0x00, 0x01}},
+			{Reliability: UnreliableSequenced, SequencedIndex: 7, OrderIndex: 8, OrderChannel: 1, Body: []byte{0x02}},
+			{Reliability: Reliable, ReliableIndex: 0xffffff, Body: []byte{0x03}},
+			{Reliability: ReliableOrdered, ReliableIndex: 1, OrderIndex: 2, OrderChannel: 3, Body: []byte{0x04}},
+			{Reliability: ReliableSequenced, ReliableIndex: 4, SequencedIndex: 5, OrderIndex: 6, Body: []byte{0x05}},
+			{Reliability: ReliableOrdered, ReliableIndex: 9, OrderIndex: 10, Split: true, SplitCount: 3, SplitID: 0xfffe, SplitIndex: 2, Body: []byte{0x06, 0x07}},
+		},
+	}
+	b := d.Append(nil)
+	if len(b) != d.Size() {
+		t.Errorf("Size() = %d, encoded %d bytes", d.Size(), len(b))
+	}
+	if !IsDatagram(b) {
+		t.Fatalf("IsDatagram(% x) = false", b)
+	}
+	if SequenceNumber(b) != d.SequenceNumber {
+		t.Errorf("SequenceNumber = %d, want %d", SequenceNumber(b), d.SequenceNumber)
+	}
+
+	got, err := DecodeDatagram(b)
+	if err != nil {
+		t.Fatalf("DecodeDatagram: %v", err)
+	}
+	// The valid flag is added on encoding
+	d.Flags |= FlagValid
+	if !reflect.DeepEqual(got, d) {
+		t.Errorf("DecodeDatagram = %+v, want %+v", got, d)
+	}
+	for i, f := range got.Frames {
+		if f.Size() != d.Frames[i].Size() || len(f.Append(nil)) != f.Size() {
+			t.Errorf("frame %d: Size() = %d, encoded %d bytes", i, f.Size(), len(f.Append(nil)))
+		}
+	}
+}
+
+func TestFrameLengthInBits(t *testing.T) {
+	f := &Frame{Reliability: ReliableOrdered, ReliableIndex: 0x010203, OrderIndex: 0x040506, OrderChannel: 7, Body: []byte{0xaa, 0xbb, 0xcc}}
+	want := []byte{
+		0x60,       // reliable ordered, not split
+		0x00, 0x18, // 24 bits
+		0x03, 0x02, 0x01, // reliable index
+		0x06, 0x05, 0x04, // order index
+		0x07,             // order channel
+		0xaa, 0xbb, 0xcc, // body
+	}
+	if got := f.Append(nil); !bytes.Equal(got, want) {
+		t.Errorf("Append = % x, want % x", got, want)
+	}
+
+	// A length that is not a whole number of bytes is rounded up
+	b := []byte{0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x14, 0xaa, 0xbb, 0xcc}
+	d, err := DecodeDatagram(b)
+	if err != nil {
+		t.Fatalf("DecodeDatagram(% x): %v", b, err)
+	}
+	if len(d.Frames) != 1 || !bytes.Equal(d.Frames[0].Body, []byte{0xaa, 0xbb, 0xcc}) {
+		t.Errorf("DecodeDatagram(% x) = %+v", b, d.Frames)
+	}
+}
+
+func TestDecodeDatagramErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"header only partly", []byte{0x84, 0x00}},
+		{"offline message", []byte{IDUnconnectedPing, 0x00, 0x00, 0x00}},
+		{"ACK", []byte{0xc0, 0x00, 0x00, 0x00}},
+		{"NACK", []byte{0xa0, 0x00, 0x00, 0x00}},
+		{"empty frame", []byte{0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"truncated frame length", []byte{0x84, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"truncated reliable index", []byte{0x84, 0x00, 0x00, 0x00, 0x40, 0x00, 0x08, 0x00}},
+		{"truncated split header", []byte{0x84, 0x00, 0x00, 0x00, 0x10, 0x00, 0x08, 0x00, 0x00, 0x00, 0x02}},
+		{"body shorter than its length", []byte{0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, 0xaa, 0xbb}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d, err := DecodeDatagram(tt.b); err == nil {
+				t.Errorf("DecodeDatagram(% x) = %+v, want an error", tt.b, d)
+			}
+		})
+	}
+}
+
+func TestSplitDatagram(t *testing.T) {
+	frame := func(size int) *Frame {
+		return &Frame{Reliability: Unreliable, Body: make([]byte, size-3)}
+	}
+	d := &Datagram{Flags: FlagNeedsBAndAS, SequenceNumber: 5, Frames: []*Frame{frame(10), frame(10), frame(30), frame(5)}}
+
+	datagrams := SplitDatagram(d, DatagramHeaderSize+20)
+	sizes := [][]int{}
+	for _, part := range datagrams {
+		if part.Flags != d.Flags {
+			t.Errorf("datagram flags = 0x%02x, want 0x%02x", part.Flags, d.Flags)
+		}
+		frameSizes := []int{}
+		for _, f := range part.Frames {
+			frameSizes = append(frameSizes, f.Size())
+		}
+		sizes = append(sizes, frameSizes)
+	}
+	// The 30 byte frame does not fit, so it gets a datagram of its own
+	if want := [][]int{{10, 10}, {30}, {5}}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("SplitDatagram frame sizes = %v, want %v", sizes, want)
+	}
+	if datagrams[0].SequenceNumber != d.SequenceNumber {
+		t.Errorf("first datagram has sequence number %d, want %d", datagrams[0].SequenceNumber, d.SequenceNumber)
+	}
+}
@@ -0,0 +1,318 @@
+package raknet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// udpHeaderOverhead is the size of the IPv4 and UDP headers, which RakNet adds
+// to the datagram length when deriving the MTU from an OpenConnectionRequest1
+const udpHeaderOverhead int = 20 + 8
+
+// OfflineMessage is a message exchanged outside of a connection: pings, pongs
+// and the open connection handshake.
+type OfflineMessage interface {
+	// ID returns the message ID written in the first byte of the datagram
+	ID() byte
+	// Append appends the encoded message, including its ID, to b
+	Append(b []byte) []byte
+
+	decode(r *reader)
+}
+
+// UnconnectedPing is sent by clients to discover servers. Its ID is either
+// IDUnconnectedPing or IDUnconnectedPingOpenConnections.
+type UnconnectedPing struct {
+	OpenConnections bool
+	SendTimestamp   uint64
+	ClientGUID      uint64
+}
+
+// UnconnectedPong is the server's answer to an UnconnectedPing. Data usually
+// holds the server's advertisement (MOTD, player counts, ports...).
+type UnconnectedPong struct {
+	SendTimestamp uint64
+	ServerGUID    uint64
+	Data          []byte
+}
+
+// OpenConnectionRequest1 starts the handshake. The MTU is not encoded
+// directly, it is the size of the datagram, which the client pads out to the
+// MTU it is probing.
+type OpenConnectionRequest1 struct {
+	Protocol byte
+	MTU      uint16
+}
+
+// OpenConnectionReply1 answers an OpenConnectionRequest1. When Security is
+// set, the reply carries a cookie that the client must echo back in its
+// OpenConnectionRequest2.
+type OpenConnectionReply1 struct {
+	ServerGUID uint64
+	Security   bool
+	Cookie     uint32
+	MTU        uint16
+}
+
+// OpenConnectionRequest2 carries the address the client believes it is
+// talking to, which is what the proxy rewrites to the upstream's address.
+type OpenConnectionRequest2 struct {
+	HasCookie     bool
+	Cookie        uint32
+	ServerAddress netip.AddrPort
+	MTU           uint16
+	ClientGUID    uint64
+}
+
+// OpenConnectionReply2 completes the offline handshake and carries the
+// address the server sees the client at.
+type OpenConnectionReply2 struct {
+	ServerGUID    uint64
+	ClientAddress netip.AddrPort
+	MTU           uint16
+	Encryption    bool
+}
+
+// IncompatibleProtocolVersion is sent in place of an OpenConnectionReply1
+// when the client's protocol version is not supported.
+type IncompatibleProtocolVersion struct {
+	Protocol   byte
+	ServerGUID uint64
+}
+
+// IsOfflineMessage reports whether b looks like an offline message: a known
+// offline message ID with the offline magic at the expected offset.
+func IsOfflineMessage(b []byte) bool {
+	m := newOfflineMessage(b)
+	if m == nil {
+		return false
+	}
+	off := offlineMagicOffset(b[0])
+	return len(b) >= off+len(OfflineMessageMagic) &&
+		[16]byte(b[off:off+len(OfflineMessageMagic)]) == OfflineMessageMagic
+}
+
+// offlineMagicOffset returns the offset of the magic in an offline message
+// with the given ID. Most messages put it right after the ID, but pings and
+// pongs lead with their timestamps.
+func offlineMagicOffset(id byte) int {
+	switch id {
+	case IDUnconnectedPing, IDUnconnectedPingOpenConnections:
+		return 1 + 8
+	case IDUnconnectedPong:
+		return 1 + 8 + 8
+	case IDIncompatibleProtocolVersion:
+		return 1 + 1
+	default:
+		return 1
+	}
+}
+
+func newOfflineMessage(b []byte) OfflineMessage {
+	if len(b) == 0 {
+		return nil
+	}
+	switch b[0] {
+	case IDUnconnectedPing:
+		return &UnconnectedPing{}
+	case IDUnconnectedPingOpenConnections:
+		return &UnconnectedPing{OpenConnections: true}
+	case IDUnconnectedPong:
+		return &UnconnectedPong{}
+	case IDOpenConnectionRequest1:
+		return &OpenConnectionRequest1{}
+	case IDOpenConnectionReply1:
+		return &OpenConnectionReply1{}
+	case IDOpenConnectionRequest2:
+		return &OpenConnectionRequest2{}
+	case IDOpenConnectionReply2:
+		return &OpenConnectionReply2{}
+	case IDIncompatibleProtocolVersion:
+		return &IncompatibleProtocolVersion{}
+	}
+	return nil
+}
+
+// DecodeOfflineMessage decodes an offline message from a whole datagram.
+func DecodeOfflineMessage(b []byte) (OfflineMessage, error) {
+	m := newOfflineMessage(b)
+	if m == nil {
+		if len(b) == 0 {
+			return nil, fmt.Errorf("unable to decode offline message: empty datagram")
+		}
+		return nil, fmt.Errorf("unable to decode offline message: unknown ID 0x%02x", b[0])
+	}
+
+	r := &reader{b: b, off: 1}
+	m.decode(r)
+	if r.err != nil {
+		return nil, fmt.Errorf("unable to decode offline message 0x%02x: %w", b[0], r.err)
+	}
+	return m, nil
+}
+
+func (m *UnconnectedPing) ID() byte {
+	if m.OpenConnections {
+		return IDUnconnectedPingOpenConnections
+	}
+	return IDUnconnectedPing
+}
+
+func (m *UnconnectedPing) Append(b []byte) []byte {
+	b = append(b, m.ID())
+	b = binary.BigEndian.AppendUint64(b, m.SendTimestamp)
+	b = append(b, OfflineMessageMagic[:]...)
+	return binary.BigEndian.AppendUint64(b, m.ClientGUID)
+}
+
+func (m *UnconnectedPing) decode(r *reader) {
+	m.SendTimestamp = r.u64()
+	r.magic()
+	// Some clients omit the GUID
+	if r.remaining() >= 8 {
+		m.ClientGUID = r.u64()
+	}
+}
+
+func (m *UnconnectedPong) ID() byte { return IDUnconnectedPong }
+
+func (m *UnconnectedPong) Append(b []byte) []byte {
+	b = append(b, IDUnconnectedPong)
+	b = binary.BigEndian.AppendUint64(b, m.SendTimestamp)
+	b = binary.BigEndian.AppendUint64(b, m.ServerGUID)
+	b = append(b, OfflineMessageMagic[:]...)
+	return appendString(b, string(m.Data))
+}
+
+func (m *UnconnectedPong) decode(r *reader) {
+	m.SendTimestamp = r.u64()
+	m.ServerGUID = r.u64()
+	r.magic()
+	if r.remaining() > 0 {
+		m.Data = []byte(r.string())
+	}
+}
+
+func (m *OpenConnectionRequest1) ID() byte { return IDOpenConnectionRequest1 }
+
+func (m *OpenConnectionRequest1) Append(b []byte) []byte {
+	start := len(b)
+	b = append(b, IDOpenConnectionRequest1)
+	b = append(b, OfflineMessageMagic[:]...)
+	b = append(b, m.Protocol)
+	if padding := int(m.MTU) - udpHeaderOverhead - (len(b) - start); padding > 0 {
+		b = append(b, make([]byte, padding)...)
+	}
+	return b
+}
+
+func (m *OpenConnectionRequest1) decode(r *reader) {
+	m.MTU = uint16(len(r.b) + udpHeaderOverhead)
+	r.magic()
+	m.Protocol = r.u8()
+	r.rest()
+}
+
+func (m *OpenConnectionReply1) ID() byte { return IDOpenConnectionReply1 }
+
+func (m *OpenConnectionReply1) Append(b []byte) []byte {
+	b = append(b, IDOpenConnectionReply1)
+	b = append(b, OfflineMessageMagic[:]...)
+	b = binary.BigEndian.AppendUint64(b, m.ServerGUID)
+	b = appendBool(b, m.Security)
+	if m.Security {
+		b = binary.BigEndian.AppendUint32(b, m.Cookie)
+	}
+	return binary.BigEndian.AppendUint16(b, m.MTU)
+}
+
+func (m *OpenConnectionReply1) decode(r *reader) {
+	r.magic()
+	m.ServerGUID = r.u64()
+	m.Security = r.bool()
+	if m.Security {
+		m.Cookie = r.u32()
+	}
+	m.MTU = r.u16()
+}
+
+func (m *OpenConnectionRequest2) ID() byte { return IDOpenConnectionRequest2 }
+
+func (m *OpenConnectionRequest2) Append(b []byte) []byte {
+	b = append(b, IDOpenConnectionRequest2)
+	b = append(b, OfflineMessageMagic[:]...)
+	if m.HasCookie {
+		b = binary.BigEndian.AppendUint32(b, m.Cookie)
+		// The client did not write a security challenge
+		b = append(b, 0)
+	}
+	b = AppendAddr(b, m.ServerAddress)
+	b = binary.BigEndian.AppendUint16(b, m.MTU)
+	return binary.BigEndian.AppendUint64(b, m.ClientGUID)
+}
+
+func (m *OpenConnectionRequest2) decode(r *reader) {
+	r.magic()
+	// A cookie is only present if the server asked for one in its reply, so
+	// tell the layouts apart by whether an address, MTU and GUID exactly fill
+	// the rest of the message
+	if r.err == nil && !fitsOpenConnectionRequest2(r.b[r.off:]) {
+		m.HasCookie = true
+		m.Cookie = r.u32()
+		if r.bool() {
+			r.err = fmt.Errorf("security challenges are not supported")
+		}
+	}
+	m.ServerAddress = r.addr()
+	m.MTU = r.u16()
+	m.ClientGUID = r.u64()
+}
+
+func (m *OpenConnectionReply2) ID() byte { return IDOpenConnectionReply2 }
+
+func (m *OpenConnectionReply2) Append(b []byte) []byte {
+	b = append(b, IDOpenConnectionReply2)
+	b = append(b, OfflineMessageMagic[:]...)
+	b = binary.BigEndian.AppendUint64(b, m.ServerGUID)
+	b = AppendAddr(b, m.ClientAddress)
+	b = binary.BigEndian.AppendUint16(b, m.MTU)
+	return appendBool(b, m.Encryption)
+}
+
+func (m *OpenConnectionReply2) decode(r *reader) {
+	r.magic()
+	m.ServerGUID = r.u64()
+	m.ClientAddress = r.addr()
+	m.MTU = r.u16()
+	m.Encryption = r.bool()
+}
+
+func (m *IncompatibleProtocolVersion) ID() byte { return IDIncompatibleProtocolVersion }
+
+func (m *IncompatibleProtocolVersion) Append(b []byte) []byte {
+	b = append(b, IDIncompatibleProtocolVersion, m.Protocol)
+	b = append(b, OfflineMessageMagic[:]...)
+	return binary.BigEndian.AppendUint64(b, m.ServerGUID)
+}
+
+func (m *IncompatibleProtocolVersion) decode(r *reader) {
+	m.Protocol = r.u8()
+	r.magic()
+	m.ServerGUID = r.u64()
+}
+
+// fitsOpenConnectionRequest2 reports whether b is exactly an address, MTU and
+// GUID, i.e. the tail of an OpenConnectionRequest2 without a cookie.
+func fitsOpenConnectionRequest2(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	switch b[0] {
+	case AddrFamilyIPv4:
+		return len(b) == IPv4AddrSize+2+8
+	case AddrFamilyIPv6:
+		return len(b) == IPv6AddrSize+2+8
+	}
+	return false
+}
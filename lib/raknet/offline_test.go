@@ -0,0 +1,170 @@
+package raknet
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestOfflineMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		m    OfflineMessage
+	}{
+		{"UnconnectedPing", &UnconnectedPing{SendTimestamp: 1234, ClientGUID: 0x0102030405060708}},
+		{"UnconnectedPingOpenConnections", &UnconnectedPing{OpenConnections: true, SendTimestamp: 1, ClientGUID: 2}},
+		{"UnconnectedPong", &UnconnectedPong{SendTimestamp: 1234, ServerGUID: 99, Data: []byte("MCPE;name;1;1.0;0;10;99;sub;Survival;1;19132;19133;")}},
+		{"OpenConnectionRequest1", &OpenConnectionRequest1{Protocol: 11, MTU: 1492}},
+		{"OpenConnectionReply1", &OpenConnectionReply1{ServerGUID: 99, MTU: 1400}},
+		{"OpenConnectionReply1 with cookie", &OpenConnectionReply1{ServerGUID: 99, Security: true, Cookie: 0xdeadbeef, MTU: 1400}},
+		{"OpenConnectionRequest2 IPv4", &OpenConnectionRequest2{ServerAddress: netip.MustParseAddrPort("192.168.1.20:19132"), MTU: 1400, ClientGUID: 7}},
+		{"OpenConnectionRequest2 IPv6", &OpenConnectionRequest2{ServerAddress: netip.MustParseAddrPort("[2001:db8::1]:19133"), MTU: 1400, ClientGUID: 7}},
+		{"OpenConnectionRequest2 IPv4 with cookie", &OpenConnectionRequest2{HasCookie: true, Cookie: 0x04000000, ServerAddress: netip.MustParseAddrPort("192.168.1.20:19132"), MTU: 1400, ClientGUID: 7}},
+		{"OpenConnectionRequest2 IPv6 with cookie", &OpenConnectionRequest2{HasCookie: true, Cookie: 0x06000000, ServerAddress: netip.MustParseAddrPort("[2001:db8::1]:19133"), MTU: 1400, ClientGUID: 7}},
+		{"OpenConnectionReply2", &OpenConnectionReply2{ServerGUID: 99, ClientAddress: netip.MustParseAddrPort("203.0.113.7:51234"), MTU: 1400}},
+		{"OpenConnectionReply2 with encryption", &OpenConnectionReply2{ServerGUID: 99, ClientAddress: netip.MustParseAddrPort("[2001:db8::7]:51234"), MTU: 1400, Encryption: true}},
+		{"IncompatibleProtocolVersion", &IncompatibleProtocolVersion{Protocol: 10, ServerGUID: 99}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.m.Append(nil)
+			if b[0] != tt.m.ID() {
+				t.Errorf("encoded ID 0x%02x, want 0x%02x", b[0], tt.m.ID())
+			}
+			if !IsOfflineMessage(b) {
+				t.Errorf("IsOfflineMessage(% x) = false", b)
+			}
+			got, err := DecodeOfflineMessage(b)
+			if err != nil {
+				t.Fatalf("DecodeOfflineMessage: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.m) {
+				t.Errorf("DecodeOfflineMessage = %+v, want %+v", got, tt.m)
+			}
+			if again := got.Append(nil); !bytes.Equal(again, b) {
+				t.Errorf("re-encoded % x, want % x", again, b)
+			}
+		})
+	}
+}
+
+func TestOpenConnectionRequest1MTU(t *testing.T) {
+	b := (&OpenConnectionRequest1{Protocol: 11, MTU: 1492}).Append(nil)
+	if len(b) != 1492-udpHeaderOverhead {
+		t.Errorf("OpenConnectionRequest1 for MTU 1492 is %d bytes, want %d", len(b), 1492-udpHeaderOverhead)
+	}
+
+	// An MTU too small to pad to leaves the message unpadded
+	b = (&OpenConnectionRequest1{Protocol: 11, MTU: 1}).Append(nil)
+	if len(b) != 1+len(OfflineMessageMagic)+1 {
+		t.Errorf("OpenConnectionRequest1 for MTU 1 is %d bytes", len(b))
+	}
+}
+
+func TestUnconnectedPingWithoutGUID(t *testing.T) {
+	b := (&UnconnectedPing{SendTimestamp: 5, ClientGUID: 6}).Append(nil)
+	m, err := DecodeOfflineMessage(b[:len(b)-8])
+	if err != nil {
+		t.Fatalf("DecodeOfflineMessage: %v", err)
+	}
+	if ping := m.(*UnconnectedPing); ping.SendTimestamp != 5 || ping.ClientGUID != 0 {
+		t.Errorf("DecodeOfflineMessage = %+v", ping)
+	}
+}
+
+func TestFitsOpenConnectionRequest2(t *testing.T) {
+	ipv4 := AppendAddr(nil, netip.MustParseAddrPort("192.168.1.20:19132"))
+	ipv6 := AppendAddr(nil, netip.MustParseAddrPort("[2001:db8::1]:19133"))
+	tail := func(addr []byte) []byte {
+		return append(append([]byte{}, addr...), make([]byte, 2+8)...)
+	}
+	withCookie := func(b []byte) []byte {
+		return append([]byte{AddrFamilyIPv4, 0, 0, 0, 0}, b...)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"IPv4", tail(ipv4), true},
+		{"IPv6", tail(ipv6), true},
+		{"IPv4 one byte short", tail(ipv4)[:len(tail(ipv4))-1], false},
+		{"IPv4 one byte long", append(tail(ipv4), 0), false},
+		{"IPv6 one byte short", tail(ipv6)[:len(tail(ipv6))-1], false},
+		{"unknown family", append([]byte{5}, tail(ipv4)[1:]...), false},
+		// A cookie whose first byte looks like an address family
+		{"IPv4 after a cookie", withCookie(tail(ipv4)), false},
+		{"IPv6 after a cookie", withCookie(tail(ipv6)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fitsOpenConnectionRequest2(tt.b); got != tt.want {
+				t.Errorf("fitsOpenConnectionRequest2(% x) = %v, want %v", tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenConnectionRequest2SecurityChallenge(t *testing.T) {
+	b := (&OpenConnectionRequest2{HasCookie: true, Cookie: 1, ServerAddress: netip.MustParseAddrPort("192.168.1.20:19132"), MTU: 1400}).Append(nil)
+	// The byte after the cookie says whether a challenge follows
+	b[1+len(OfflineMessageMagic)+4] = 1
+	if m, err := DecodeOfflineMessage(b); err == nil {
+		t.Errorf("DecodeOfflineMessage = %+v with a security challenge, want an error", m)
+	}
+}
+
+func TestDecodeOfflineMessageErrors(t *testing.T) {
+	badMagic := (&OpenConnectionReply2{ServerGUID: 1, ClientAddress: netip.MustParseAddrPort("203.0.113.7:51234")}).Append(nil)
+	badMagic[1] ^= 0xff
+	badFamily := (&OpenConnectionReply2{ServerGUID: 1, ClientAddress: netip.MustParseAddrPort("203.0.113.7:51234")}).Append(nil)
+	badFamily[1+len(OfflineMessageMagic)+8] = 5
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"unknown ID", []byte{0x42, 0x00}},
+		{"connected datagram", []byte{0x84, 0x00, 0x00, 0x00}},
+		{"bad magic", badMagic},
+		{"unknown address family", badFamily},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if m, err := DecodeOfflineMessage(tt.b); err == nil {
+				t.Errorf("DecodeOfflineMessage(% x) = %+v, want an error", tt.b, m)
+			}
+		})
+	}
+	if IsOfflineMessage(badMagic) {
+		t.Errorf("IsOfflineMessage(% x) = true with a bad magic", badMagic)
+	}
+}
+
+func TestDecodeTruncatedOfflineMessages(t *testing.T) {
+	messages := []OfflineMessage{
+		&UnconnectedPong{SendTimestamp: 1, ServerGUID: 2, Data: []byte("data")},
+		&OpenConnectionReply1{ServerGUID: 99, Security: true, Cookie: 1, MTU: 1400},
+		&OpenConnectionRequest2{ServerAddress: netip.MustParseAddrPort("192.168.1.20:19132"), MTU: 1400, ClientGUID: 7},
+		&OpenConnectionRequest2{HasCookie: true, Cookie: 1, ServerAddress: netip.MustParseAddrPort("[2001:db8::1]:19133"), MTU: 1400, ClientGUID: 7},
+		&OpenConnectionReply2{ServerGUID: 99, ClientAddress: netip.MustParseAddrPort("[2001:db8::7]:51234"), MTU: 1400},
+		&IncompatibleProtocolVersion{Protocol: 10, ServerGUID: 99},
+	}
+	for _, m := range messages {
+		b := m.Append(nil)
+		// Pongs may omit their data, but not its length
+		end := len(b)
+		if m.ID() == IDUnconnectedPong {
+			end = len(b) - len("data") - 2
+		}
+		for n := 1; n < end; n++ {
+			if got, err := DecodeOfflineMessage(b[:n]); err == nil {
+				t.Errorf("DecodeOfflineMessage of 0x%02x truncated to %d of %d bytes = %+v, want an error", m.ID(), n, len(b), got)
+			}
+		}
+	}
+}
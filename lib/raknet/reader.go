@@ -0,0 +1,118 @@
+package raknet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// reader decodes big endian values from a byte slice. The first error is
+// sticky: once a read fails, every following read is a no-op returning a
+// zero value, so decoders only need to check err once at the end.
+type reader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.off+n > len(r.b) {
+		r.err = fmt.Errorf("unexpected end of data at offset %d: need %d bytes, have %d", r.off, n, len(r.b)-r.off)
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) remaining() int {
+	return len(r.b) - r.off
+}
+
+func (r *reader) rest() []byte {
+	return r.take(r.remaining())
+}
+
+func (r *reader) u8() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) bool() bool {
+	return r.u8() != 0
+}
+
+func (r *reader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) u24() uint32 {
+	if b := r.take(3); b != nil {
+		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) magic() {
+	b := r.take(len(OfflineMessageMagic))
+	if b != nil && [16]byte(b) != OfflineMessageMagic {
+		r.err = fmt.Errorf("invalid offline message magic at offset %d", r.off-len(b))
+	}
+}
+
+func (r *reader) addr() netip.AddrPort {
+	if r.err != nil {
+		return netip.AddrPort{}
+	}
+	addr, n, err := DecodeAddr(r.b[r.off:])
+	if err != nil {
+		r.err = err
+		return netip.AddrPort{}
+	}
+	r.off += n
+	return addr
+}
+
+func (r *reader) string() string {
+	return string(r.take(int(r.u16())))
+}
+
+// appendU24 appends a little endian 24-bit integer, as used by RakNet for
+// sequence numbers and frame indices.
+func appendU24(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
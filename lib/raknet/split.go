@@ -0,0 +1,229 @@
+package raknet
+
+import (
+	"fmt"
+)
+
+// splitHeaderSize is the extra frame header size of a fragment: split count,
+// split ID and split index
+const splitHeaderSize int = 4 + 2 + 4
+
+// MaxDatagramSize returns the largest datagram that fits in the given MTU.
+func MaxDatagramSize(mtu uint16) int {
+	return int(mtu) - udpHeaderOverhead
+}
+
+// MaxDatagramPayload returns the space available for frames in a datagram on
+// a connection with the given MTU.
+func MaxDatagramPayload(mtu uint16) int {
+	return MaxDatagramSize(mtu) - DatagramHeaderSize
+}
+
+// Reassembler collects the fragments of split messages and returns each
+// message once all of its fragments have arrived. Limits bound the number of
+// fragments of a single message, the number of incomplete messages and the
+// total size of the buffered fragments. A fragment that would exceed the
+// fragment or size limit is rejected with an error, and when too many
+// messages are incomplete the oldest one is abandoned to make room. A
+// Reassembler is not safe for concurrent use.
+type Reassembler struct {
+	maxSplitCount uint32
+	maxPending    int
+	maxBytes      int
+
+	pending map[uint16]*splitMessage
+	bytes   int
+	started uint64
+
+	// Recently completed split IDs, so that late retransmissions of their
+	// fragments are not mistaken for a new message
+	completed     []uint16
+	completedNext int
+}
+
+type splitMessage struct {
+	first     *Frame
+	fragments [][]byte
+	received  uint32
+	size      int
+	started   uint64
+}
+
+func NewReassembler(maxSplitCount uint32, maxPending int, maxBytes int) *Reassembler {
+	return &Reassembler{
+		maxSplitCount: maxSplitCount,
+		maxPending:    maxPending,
+		maxBytes:      maxBytes,
+		pending:       make(map[uint16]*splitMessage),
+		completed:     make([]uint16, 0, maxPending),
+	}
+}
+
+// Add buffers a fragment. When the fragment completes its message, the
+// reassembled message is returned as an unsplit frame carrying the indices of
+// the first fragment. Otherwise, Add returns nil. Duplicate fragments, e.g.
+// retransmissions, are ignored.
+func (r *Reassembler) Add(f *Frame) (*Frame, error) {
+	if !f.Split {
+		return f, nil
+	}
+
+	m, ok := r.pending[f.SplitID]
+	if !ok {
+		if r.recentlyCompleted(f.SplitID) {
+			return nil, nil
+		}
+		if err := r.checkNewMessage(f); err != nil {
+			return nil, err
+		}
+		r.started++
+		m = &splitMessage{fragments: make([][]byte, f.SplitCount), started: r.started}
+		r.pending[f.SplitID] = m
+	}
+
+	if f.SplitCount != uint32(len(m.fragments)) || f.SplitIndex >= f.SplitCount {
+		r.drop(f.SplitID)
+		return nil, fmt.Errorf("split %d: fragment %d/%d does not match split count %d", f.SplitID, f.SplitIndex, f.SplitCount, len(m.fragments))
+	}
+	if m.fragments[f.SplitIndex] != nil {
+		return nil, nil
+	}
+	if r.bytes+len(f.Body) > r.maxBytes {
+		r.drop(f.SplitID)
+		return nil, fmt.Errorf("split %d: buffered fragments exceed %d bytes", f.SplitID, r.maxBytes)
+	}
+
+	m.fragments[f.SplitIndex] = append([]byte{}, f.Body...)
+	m.received++
+	m.size += len(f.Body)
+	r.bytes += len(f.Body)
+	if f.SplitIndex == 0 {
+		m.first = f
+	}
+	if m.received < f.SplitCount {
+		return nil, nil
+	}
+
+	return r.complete(f.SplitID, m), nil
+}
+
+// Pending returns the number of incomplete split messages.
+func (r *Reassembler) Pending() int {
+	return len(r.pending)
+}
+
+// BufferedBytes returns the total size of the buffered fragments.
+func (r *Reassembler) BufferedBytes() int {
+	return r.bytes
+}
+
+func (r *Reassembler) checkNewMessage(f *Frame) error {
+	if f.SplitCount == 0 || f.SplitCount > r.maxSplitCount {
+		return fmt.Errorf("split %d: split count %d outside of [1-%d]", f.SplitID, f.SplitCount, r.maxSplitCount)
+	}
+	if len(r.pending) >= r.maxPending {
+		r.dropOldest()
+	}
+	return nil
+}
+
+func (r *Reassembler) dropOldest() {
+	var oldestID uint16
+	var oldest *splitMessage
+	for id, m := range r.pending {
+		if oldest == nil || m.started < oldest.started {
+			oldestID, oldest = id, m
+		}
+	}
+	r.drop(oldestID)
+}
+
+func (r *Reassembler) recentlyCompleted(splitID uint16) bool {
+	for _, id := range r.completed {
+		if id == splitID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reassembler) markCompleted(splitID uint16) {
+	if len(r.completed) < cap(r.completed) {
+		r.completed = append(r.completed, splitID)
+		return
+	}
+	if len(r.completed) > 0 {
+		r.completed[r.completedNext] = splitID
+		r.completedNext = (r.completedNext + 1) % len(r.completed)
+	}
+}
+
+func (r *Reassembler) drop(splitID uint16) {
+	if m, ok := r.pending[splitID]; ok {
+		r.bytes -= m.size
+		delete(r.pending, splitID)
+	}
+}
+
+func (r *Reassembler) complete(splitID uint16, m *splitMessage) *Frame {
+	r.drop(splitID)
+	r.markCompleted(splitID)
+
+	body := make([]byte, 0, m.size)
+	for _, fragment := range m.fragments {
+		body = append(body, fragment...)
+	}
+	return &Frame{
+		Reliability:    m.first.Reliability,
+		ReliableIndex:  m.first.ReliableIndex,
+		SequencedIndex: m.first.SequencedIndex,
+		OrderIndex:     m.first.OrderIndex,
+		OrderChannel:   m.first.OrderChannel,
+		Body:           body,
+	}
+}
+
+// SplitFrame splits f into fragments that each fit in maxFrameSize bytes,
+// typically MaxDatagramPayload of the connection's MTU. A frame that already
+// fits is returned as is. Fragments share f's ordering indices and carry the
+// given split ID; since every fragment of a reliable message needs its own
+// reliable index, the caller must assign ReliableIndex on each of them.
+// Unreliable messages are upgraded to their reliable counterpart, as RakNet
+// does, since losing a single fragment would lose the whole message.
+func SplitFrame(f *Frame, maxFrameSize int, splitID uint16) ([]*Frame, error) {
+	if f.Size() <= maxFrameSize {
+		return []*Frame{f}, nil
+	}
+
+	reliability := f.Reliability
+	switch reliability {
+	case Unreliable:
+		reliability = Reliable
+	case UnreliableSequenced:
+		reliability = ReliableSequenced
+	}
+
+	template := &Frame{Reliability: reliability, Split: true}
+	chunkSize := maxFrameSize - template.HeaderSize()
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("unable to split frame: max frame size %d too small", maxFrameSize)
+	}
+
+	count := (len(f.Body) + chunkSize - 1) / chunkSize
+	fragments := make([]*Frame, 0, count)
+	for i := 0; i < count; i++ {
+		end := min((i+1)*chunkSize, len(f.Body))
+		fragments = append(fragments, &Frame{
+			Reliability:    reliability,
+			SequencedIndex: f.SequencedIndex,
+			OrderIndex:     f.OrderIndex,
+			OrderChannel:   f.OrderChannel,
+			Split:          true,
+			SplitCount:     uint32(count),
+			SplitID:        splitID,
+			SplitIndex:     uint32(i),
+			Body:           f.Body[i*chunkSize : end],
+		})
+	}
+	return fragments, nil
+}
@@ -0,0 +1,161 @@
+package raknet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func fragment(splitID uint16, index uint32, count uint32, body []byte) *Frame {
+	return &Frame{Reliability: ReliableOrdered, ReliableIndex: index, Split: true, SplitCount: count, SplitID: splitID, SplitIndex: index, Body: body}
+}
+
+func TestSplitFrame(t *testing.T) {
+	f := &Frame{Reliability: ReliableOrdered, ReliableIndex: 3, OrderIndex: 4, OrderChannel: 1, Body: bytes.Repeat([]byte{0x01, 0x02, 0x03}, 100)}
+
+	same, err := SplitFrame(f, f.Size(), 9)
+	if err != nil || len(same) != 1 || same[0] != f {
+		t.Errorf("SplitFrame of a frame that fits = %v, %v", same, err)
+	}
+
+	const maxFrameSize = 64
+	fragments, err := SplitFrame(f, maxFrameSize, 9)
+	if err != nil {
+		t.Fatalf("SplitFrame: %v", err)
+	}
+	body := []byte{}
+	for i, fragment := range fragments {
+		if fragment.Size() > maxFrameSize {
+			t.Errorf("fragment %d is %d bytes, want at most %d", i, fragment.Size(), maxFrameSize)
+		}
+		if !fragment.Split || fragment.SplitID != 9 || fragment.SplitIndex != uint32(i) || fragment.SplitCount != uint32(len(fragments)) {
+			t.Errorf("fragment %d has split fields %+v", i, fragment)
+		}
+		if fragment.Reliability != f.Reliability || fragment.OrderIndex != f.OrderIndex || fragment.OrderChannel != f.OrderChannel {
+			t.Errorf("fragment %d lost the ordering of the frame: %+v", i, fragment)
+		}
+		body = append(body, fragment.Body...)
+	}
+	if !bytes.Equal(body, f.Body) {
+		t.Errorf("fragments do not add up to the body")
+	}
+
+	if _, err := SplitFrame(f, (&Frame{Reliability: ReliableOrdered, Split: true}).HeaderSize(), 9); err == nil {
+		t.Errorf("SplitFrame with no room for a body, want an error")
+	}
+}
+
+func TestSplitFrameUpgradesUnreliable(t *testing.T) {
+	tests := []struct {
+		in, want Reliability
+	}{
+		{Unreliable, Reliable},
+		{UnreliableSequenced, ReliableSequenced},
+		{ReliableOrdered, ReliableOrdered},
+	}
+	for _, tt := range tests {
+		fragments, err := SplitFrame(&Frame{Reliability: tt.in, Body: make([]byte, 100)}, 50, 0)
+		if err != nil {
+			t.Fatalf("SplitFrame: %v", err)
+		}
+		if fragments[0].Reliability != tt.want {
+			t.Errorf("SplitFrame of reliability %d gives %d, want %d", tt.in, fragments[0].Reliability, tt.want)
+		}
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	r := NewReassembler(4, 4, 1024)
+
+	unsplit := &Frame{Body: []byte{0x01}}
+	if got, err := r.Add(unsplit); got != unsplit || err != nil {
+		t.Errorf("Add of an unsplit frame = %v, %v", got, err)
+	}
+
+	// Out of order, with a duplicate
+	for _, f := range []*Frame{fragment(1, 2, 3, []byte{0x05}), fragment(1, 0, 3, []byte{0x01, 0x02}), fragment(1, 2, 3, []byte{0x05})} {
+		if got, err := r.Add(f); got != nil || err != nil {
+			t.Fatalf("Add of fragment %d = %v, %v", f.SplitIndex, got, err)
+		}
+	}
+	if r.Pending() != 1 || r.BufferedBytes() != 3 {
+		t.Errorf("Pending() = %d, BufferedBytes() = %d, want 1, 3", r.Pending(), r.BufferedBytes())
+	}
+	got, err := r.Add(fragment(1, 1, 3, []byte{0x03, 0x04}))
+	if err != nil || got == nil {
+		t.Fatalf("Add of the last fragment = %v, %v", got, err)
+	}
+	if !bytes.Equal(got.Body, []byte{0x01, 0x02, 0x03, 0x04, 0x05}) || got.Split || got.ReliableIndex != 0 || got.Reliability != ReliableOrdered {
+		t.Errorf("reassembled frame = %+v", got)
+	}
+	if r.Pending() != 0 || r.BufferedBytes() != 0 {
+		t.Errorf("Pending() = %d, BufferedBytes() = %d after completion", r.Pending(), r.BufferedBytes())
+	}
+
+	// A late retransmission does not start a new message
+	if got, err := r.Add(fragment(1, 0, 3, []byte{0x01, 0x02})); got != nil || err != nil || r.Pending() != 0 {
+		t.Errorf("Add of a late fragment = %v, %v with %d pending", got, err, r.Pending())
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments []*Frame
+	}{
+		{"split count zero", []*Frame{fragment(1, 0, 0, []byte{0x01})}},
+		{"split count over the limit", []*Frame{fragment(1, 0, 5, []byte{0x01})}},
+		{"split count mismatch", []*Frame{fragment(1, 0, 3, []byte{0x01}), fragment(1, 1, 2, []byte{0x02})}},
+		{"split index out of range", []*Frame{fragment(1, 3, 3, []byte{0x01})}},
+		{"byte limit", []*Frame{fragment(1, 0, 2, make([]byte, 6)), fragment(2, 0, 2, make([]byte, 5))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler(4, 4, 10)
+			last := len(tt.fragments) - 1
+			for _, f := range tt.fragments[:last] {
+				if _, err := r.Add(f); err != nil {
+					t.Fatalf("Add: %v", err)
+				}
+			}
+			if got, err := r.Add(tt.fragments[last]); err == nil {
+				t.Errorf("Add = %v, want an error", got)
+			}
+			if _, ok := r.pending[tt.fragments[last].SplitID]; ok {
+				t.Errorf("split %d still pending after an error", tt.fragments[last].SplitID)
+			}
+			// Only the split that failed is dropped
+			want := 0
+			for _, f := range tt.fragments[:last] {
+				if f.SplitID != tt.fragments[last].SplitID {
+					want += len(f.Body)
+				}
+			}
+			if r.BufferedBytes() != want {
+				t.Errorf("BufferedBytes() = %d, want %d", r.BufferedBytes(), want)
+			}
+		})
+	}
+}
+
+func TestReassemblerDropsOldestPending(t *testing.T) {
+	r := NewReassembler(4, 2, 1024)
+	for _, splitID := range []uint16{1, 2, 3} {
+		if _, err := r.Add(fragment(splitID, 0, 2, []byte{byte(splitID)})); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if r.Pending() != 2 || r.BufferedBytes() != 2 {
+		t.Errorf("Pending() = %d, BufferedBytes() = %d, want 2, 2", r.Pending(), r.BufferedBytes())
+	}
+	if _, ok := r.pending[1]; ok {
+		t.Errorf("oldest split 1 still pending")
+	}
+
+	// The dropped split starts over rather than completing
+	if got, err := r.Add(fragment(1, 1, 2, []byte{0x01})); got != nil || err != nil {
+		t.Errorf("Add to the dropped split = %v, %v", got, err)
+	}
+	if got, err := r.Add(fragment(3, 1, 2, []byte{0x03})); err != nil || got == nil || !bytes.Equal(got.Body, []byte{0x03, 0x03}) {
+		t.Errorf("Add completing split 3 = %v, %v", got, err)
+	}
+}
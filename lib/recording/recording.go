@@ -0,0 +1,132 @@
+// Package recording reads and writes recordings of proxy sessions: the
+// payloads received from each side, with the time they arrived. A recording
+// is a JSON Lines file, a header followed by one line per payload.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Version is the version of the format written by Writer
+const Version = 1
+
+// Sides of a session, as given in Entry.From
+const (
+	FromClient = "client"
+	FromServer = "server"
+)
+
+// Header describes the recorded session.
+type Header struct {
+	Version    int       `json:"version"`
+	ListenPort int       `json:"listen_port"`
+	Client     string    `json:"client"`
+	Upstream   string    `json:"upstream"`
+	Started    time.Time `json:"started"`
+}
+
+// Entry is a payload received from one side of the session.
+type Entry struct {
+	// Offset is the time since the session started
+	Offset  time.Duration `json:"offset_ns"`
+	From    string        `json:"from"`
+	Payload []byte        `json:"payload"`
+}
+
+// Writer writes a recording to a file. It is safe for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	started time.Time
+	closed  bool
+}
+
+// Create creates a recording file at path, writing its header.
+func Create(path string, header Header) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create recording: %w", err)
+	}
+
+	header.Version = Version
+	w := &Writer{file: file, w: bufio.NewWriter(file), started: header.Started}
+	w.enc = json.NewEncoder(w.w)
+	if err := w.enc.Encode(header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to write recording header: %w", err)
+	}
+	return w, nil
+}
+
+// Write records a payload received from one side at time t.
+func (w *Writer) Write(from string, t time.Time, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("unable to write to recording %v: closed", w.file.Name())
+	}
+	if err := w.enc.Encode(Entry{Offset: t.Sub(w.started), From: from, Payload: payload}); err != nil {
+		return fmt.Errorf("unable to write to recording %v: %w", w.file.Name(), err)
+	}
+	return nil
+}
+
+// Close flushes the recording and closes its file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return errors.Join(w.w.Flush(), w.file.Close())
+}
+
+// Read reads a whole recording.
+func Read(r io.Reader) (Header, []Entry, error) {
+	dec := json.NewDecoder(r)
+	header := Header{}
+	if err := dec.Decode(&header); err != nil {
+		return Header{}, nil, fmt.Errorf("unable to read recording header: %w", err)
+	}
+	if header.Version != Version {
+		return Header{}, nil, fmt.Errorf("unsupported recording version %d", header.Version)
+	}
+
+	entries := []Entry{}
+	for {
+		entry := Entry{}
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return header, entries, nil
+		}
+		if err != nil {
+			return Header{}, nil, fmt.Errorf("unable to read recording entry %d: %w", len(entries)+1, err)
+		}
+		if entry.From != FromClient && entry.From != FromServer {
+			return Header{}, nil, fmt.Errorf("invalid recording entry %d: unknown side %q", len(entries)+1, entry.From)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// ReadFile reads a whole recording from a file.
+func ReadFile(path string) (Header, []Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Header{}, nil, fmt.Errorf("unable to open recording: %w", err)
+	}
+	defer file.Close()
+	return Read(file)
+}